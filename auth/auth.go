@@ -0,0 +1,41 @@
+// MIT License
+
+// Copyright (c) 2022 Florent Brusciano
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+package auth
+
+// Authenticator drives the client side of an MQTT 5 enhanced authentication
+// exchange (CONNECT/AUTH/CONNACK). The same authenticator is used again when
+// the client re-authenticates during the session.
+type Authenticator interface {
+	// AuthenticationMethod sent in the CONNECT and AUTH packets
+	Method() string
+
+	// Start a new exchange and return the initial AuthenticationData, may be nil
+	Start() ([]byte, error)
+
+	// Answer a challenge received in an AUTH packet with the
+	// continue authentication reason code
+	Next(challenge []byte) ([]byte, error)
+
+	// Verify the AuthenticationData sent by the server with the CONNACK
+	// or the final AUTH packet
+	Finish(data []byte) error
+}
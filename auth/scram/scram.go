@@ -0,0 +1,317 @@
+// MIT License
+
+// Copyright (c) 2022 Florent Brusciano
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+package scram
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Authentication method name used in the MQTT 5 AuthenticationMethod property
+const METHOD = "SCRAM-SHA-256"
+
+// Default number of PBKDF2 iterations used by NewCredentials
+const DEFAULT_ITERATIONS = 4096
+
+// gs2 header without channel binding
+const gs2Header = "n,,"
+
+func hmacSum(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// PBKDF2 with HMAC-SHA-256 producing a single block (RFC 5802 Hi function)
+func saltPassword(password string, salt []byte, iterations int) []byte {
+	mac := hmac.New(sha256.New, []byte(password))
+	mac.Write(salt)
+	mac.Write([]byte{0, 0, 0, 1})
+	u := mac.Sum(nil)
+
+	result := make([]byte, len(u))
+	copy(result, u)
+
+	for i := 1; i < iterations; i++ {
+		mac.Reset()
+		mac.Write(u)
+		u = mac.Sum(nil)
+		for j := range result {
+			result[j] ^= u[j]
+		}
+	}
+
+	return result
+}
+
+// Replaced by tests to get deterministic conversations
+var generateNonce = nonce
+
+func nonce() (string, error) {
+	b := make([]byte, 18)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(b), nil
+}
+
+// Escape the username as required by RFC 5802
+func saslName(name string) string {
+	return strings.NewReplacer("=", "=3D", ",", "=2C").Replace(name)
+}
+
+// Split a SCRAM message into its attributes
+func parse(msg string) map[string]string {
+	attrs := make(map[string]string)
+	for _, part := range strings.Split(msg, ",") {
+		if len(part) >= 2 && part[1] == '=' {
+			attrs[part[:1]] = part[2:]
+		}
+	}
+	return attrs
+}
+
+/////////////////////////////////////////////////
+// Client
+/////////////////////////////////////////////////
+
+// Client implements auth.Authenticator for SCRAM-SHA-256
+type Client struct {
+	username string
+	password string
+
+	clientNonce     string
+	clientFirstBare string
+	serverSignature []byte
+}
+
+func NewClient(username string, password string) *Client {
+	return &Client{username: username, password: password}
+}
+
+func (c *Client) Method() string {
+	return METHOD
+}
+
+// Build the client-first-message
+func (c *Client) Start() ([]byte, error) {
+	n, err := generateNonce()
+	if err != nil {
+		return nil, err
+	}
+
+	c.clientNonce = n
+	c.clientFirstBare = "n=" + saslName(c.username) + ",r=" + n
+	c.serverSignature = nil
+
+	return []byte(gs2Header + c.clientFirstBare), nil
+}
+
+// Answer the server-first-message with the client-final-message
+func (c *Client) Next(challenge []byte) ([]byte, error) {
+	if c.clientFirstBare == "" {
+		return nil, fmt.Errorf("scram: exchange not started")
+	}
+
+	serverFirst := string(challenge)
+	attrs := parse(serverFirst)
+
+	if e, ok := attrs["e"]; ok {
+		return nil, fmt.Errorf("scram: server error %s", e)
+	}
+
+	r := attrs["r"]
+	if !strings.HasPrefix(r, c.clientNonce) || len(r) == len(c.clientNonce) {
+		return nil, fmt.Errorf("scram: invalid server nonce")
+	}
+
+	salt, err := base64.StdEncoding.DecodeString(attrs["s"])
+	if err != nil || len(salt) == 0 {
+		return nil, fmt.Errorf("scram: invalid salt")
+	}
+
+	iterations, err := strconv.Atoi(attrs["i"])
+	if err != nil || iterations < 1 {
+		return nil, fmt.Errorf("scram: invalid iteration count")
+	}
+
+	salted := saltPassword(c.password, salt, iterations)
+	clientKey := hmacSum(salted, "Client Key")
+	storedKey := sha256.Sum256(clientKey)
+
+	clientFinal := "c=" + base64.StdEncoding.EncodeToString([]byte(gs2Header)) + ",r=" + r
+	authMessage := c.clientFirstBare + "," + serverFirst + "," + clientFinal
+
+	clientSignature := hmacSum(storedKey[:], authMessage)
+	proof := make([]byte, len(clientKey))
+	for i := range clientKey {
+		proof[i] = clientKey[i] ^ clientSignature[i]
+	}
+
+	c.serverSignature = hmacSum(hmacSum(salted, "Server Key"), authMessage)
+
+	return []byte(clientFinal + ",p=" + base64.StdEncoding.EncodeToString(proof)), nil
+}
+
+// Check the server signature carried by the server-final-message
+func (c *Client) Finish(data []byte) error {
+	if c.serverSignature == nil {
+		return fmt.Errorf("scram: server finished before the proof was sent")
+	}
+
+	attrs := parse(string(data))
+	if e, ok := attrs["e"]; ok {
+		return fmt.Errorf("scram: server error %s", e)
+	}
+
+	v, err := base64.StdEncoding.DecodeString(attrs["v"])
+	if err != nil || !hmac.Equal(v, c.serverSignature) {
+		return fmt.Errorf("scram: invalid server signature")
+	}
+
+	return nil
+}
+
+/////////////////////////////////////////////////
+// Server
+/////////////////////////////////////////////////
+
+// Credentials stored by the server, the password itself is never kept
+type Credentials struct {
+	Salt       []byte
+	Iterations int
+	StoredKey  []byte
+	ServerKey  []byte
+}
+
+func NewCredentials(password string, salt []byte, iterations int) *Credentials {
+	salted := saltPassword(password, salt, iterations)
+	storedKey := sha256.Sum256(hmacSum(salted, "Client Key"))
+
+	return &Credentials{
+		Salt:       salt,
+		Iterations: iterations,
+		StoredKey:  storedKey[:],
+		ServerKey:  hmacSum(salted, "Server Key"),
+	}
+}
+
+// Return the credentials of a user, false if the user is unknown
+type CredentialsLookup func(username string) (*Credentials, bool)
+
+// Server runs one SCRAM-SHA-256 conversation on the broker side
+type Server struct {
+	lookup CredentialsLookup
+
+	username    string
+	credentials *Credentials
+	authMessage string
+	nonce       string
+}
+
+func NewServer(lookup CredentialsLookup) *Server {
+	return &Server{lookup: lookup}
+}
+
+// Username authenticated by the conversation
+func (s *Server) Username() string {
+	return s.username
+}
+
+// Answer the client-first-message with the server-first-message
+func (s *Server) Start(clientFirst []byte) ([]byte, error) {
+	msg := string(clientFirst)
+	if !strings.HasPrefix(msg, gs2Header) {
+		return nil, fmt.Errorf("scram: unsupported gs2 header")
+	}
+
+	bare := strings.TrimPrefix(msg, gs2Header)
+	attrs := parse(bare)
+
+	username := strings.NewReplacer("=2C", ",", "=3D", "=").Replace(attrs["n"])
+	credentials, ok := s.lookup(username)
+	if !ok {
+		return nil, fmt.Errorf("scram: unknown user %s", username)
+	}
+
+	n, err := generateNonce()
+	if err != nil {
+		return nil, err
+	}
+
+	s.username = username
+	s.credentials = credentials
+	s.nonce = attrs["r"] + n
+
+	serverFirst := "r=" + s.nonce +
+		",s=" + base64.StdEncoding.EncodeToString(credentials.Salt) +
+		",i=" + strconv.Itoa(credentials.Iterations)
+	s.authMessage = bare + "," + serverFirst
+
+	return []byte(serverFirst), nil
+}
+
+// Verify the client proof and return the server-final-message
+func (s *Server) Finish(clientFinal []byte) ([]byte, error) {
+	if s.credentials == nil {
+		return nil, fmt.Errorf("scram: exchange not started")
+	}
+
+	msg := string(clientFinal)
+	i := strings.LastIndex(msg, ",p=")
+	if i < 0 {
+		return nil, fmt.Errorf("scram: missing client proof")
+	}
+
+	withoutProof := msg[:i]
+	attrs := parse(msg)
+	if attrs["r"] != s.nonce {
+		return nil, fmt.Errorf("scram: nonce mismatch")
+	}
+
+	proof, err := base64.StdEncoding.DecodeString(attrs["p"])
+	if err != nil || len(proof) != sha256.Size {
+		return nil, fmt.Errorf("scram: invalid client proof")
+	}
+
+	authMessage := s.authMessage + "," + withoutProof
+	clientSignature := hmacSum(s.credentials.StoredKey, authMessage)
+
+	clientKey := make([]byte, len(proof))
+	for i := range proof {
+		clientKey[i] = proof[i] ^ clientSignature[i]
+	}
+	storedKey := sha256.Sum256(clientKey)
+	if subtle.ConstantTimeCompare(storedKey[:], s.credentials.StoredKey) != 1 {
+		return []byte("e=invalid-proof"), fmt.Errorf("scram: authentication failed for %s", s.username)
+	}
+
+	serverSignature := hmacSum(s.credentials.ServerKey, authMessage)
+
+	return []byte("v=" + base64.StdEncoding.EncodeToString(serverSignature)), nil
+}
@@ -0,0 +1,113 @@
+// MIT License
+
+// Copyright (c) 2022 Florent Brusciano
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+package scram
+
+import (
+	"encoding/base64"
+	"testing"
+)
+
+// Test vector from RFC 7677 section 3
+func TestClientRFC7677(t *testing.T) {
+
+	defer func() { generateNonce = nonce }()
+	generateNonce = func() (string, error) { return "rOprNGfwEbeRWgbNEkqO", nil }
+
+	c := NewClient("user", "pencil")
+
+	first, err := c.Start()
+	if err != nil {
+		t.Fatalf("Start error %s", err)
+	}
+	if string(first) != "n,,n=user,r=rOprNGfwEbeRWgbNEkqO" {
+		t.Errorf("client-first-message found %s", first)
+	}
+
+	serverFirst := "r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,s=W22ZaJ0SNY7soEsUEjb6gQ==,i=4096"
+	final, err := c.Next([]byte(serverFirst))
+	if err != nil {
+		t.Fatalf("Next error %s", err)
+	}
+
+	expected := "c=biws,r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,p=dHzbZapWIk4jUhN+Ute9ytag9zjfMHgsqmmiz7AndVQ="
+	if string(final) != expected {
+		t.Errorf("client-final-message found %s; want %s", final, expected)
+	}
+
+	if err := c.Finish([]byte("v=6rriTRBi23WpRR/wtup+mMhUZUn/dB5nLTJRsjl95G4=")); err != nil {
+		t.Errorf("Finish error %s", err)
+	}
+
+	if err := c.Finish([]byte("v=" + base64.StdEncoding.EncodeToString([]byte("bad")))); err == nil {
+		t.Errorf("Finish should reject a bad server signature")
+	}
+}
+
+func TestClientServer(t *testing.T) {
+
+	salt := []byte("0123456789abcdef")
+	lookup := func(username string) (*Credentials, bool) {
+		if username != "rw" {
+			return nil, false
+		}
+		return NewCredentials("readwrite", salt, DEFAULT_ITERATIONS), true
+	}
+
+	for _, tc := range []struct {
+		password string
+		success  bool
+	}{
+		{"readwrite", true},
+		{"wrong", false},
+	} {
+		c := NewClient("rw", tc.password)
+		s := NewServer(lookup)
+
+		first, _ := c.Start()
+		serverFirst, err := s.Start(first)
+		if err != nil {
+			t.Fatalf("server Start error %s", err)
+		}
+
+		clientFinal, err := c.Next(serverFirst)
+		if err != nil {
+			t.Fatalf("client Next error %s", err)
+		}
+
+		serverFinal, err := s.Finish(clientFinal)
+		if tc.success != (err == nil) {
+			t.Errorf("server Finish with password %s found error %v", tc.password, err)
+		}
+
+		if err := c.Finish(serverFinal); tc.success != (err == nil) {
+			t.Errorf("client Finish with password %s found error %v", tc.password, err)
+		}
+
+		if tc.success && s.Username() != "rw" {
+			t.Errorf("username found %s; want rw", s.Username())
+		}
+	}
+
+	if _, err := NewServer(lookup).Start([]byte("n,,n=nobody,r=abc")); err == nil {
+		t.Errorf("server should reject an unknown user")
+	}
+}
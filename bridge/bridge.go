@@ -0,0 +1,527 @@
+// MIT License
+
+// Copyright (c) 2022 Florent Brusciano
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+package bridge
+
+import (
+	"fmt"
+	"hash/fnv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/easygithdev/mqtt/client"
+	"github.com/easygithdev/mqtt/client/conn"
+	"github.com/easygithdev/mqtt/client/logger"
+	"github.com/easygithdev/mqtt/topic"
+)
+
+// Direction of a bridged topic
+const OUT byte = 0x01
+const IN byte = 0x02
+const BOTH byte = IN | OUT
+
+const DEFAULT_RETRY_DELAY = 5 * time.Second
+const DEFAULT_QUEUE_SIZE = 1000
+
+// A forwarded message coming back within this delay is dropped
+const DEFAULT_LOOP_WINDOW = 30 * time.Second
+
+// Topic forwarded by the bridge, like the mosquitto topic line :
+// the filter is subscribed with the local prefix on the local broker (OUT)
+// or with the remote prefix on the remote broker (IN),
+// the prefix is then replaced by the one of the other side.
+type Topic struct {
+	Filter       string
+	Direction    byte
+	Qos          byte
+	LocalPrefix  string
+	RemotePrefix string
+}
+
+// Define the bridge between a local and a remote broker
+type Bridge struct {
+	clientId string
+	local    *conn.MqttConn
+	remote   *conn.MqttConn
+
+	localOpts  []client.ClientOption
+	remoteOpts []client.ClientOption
+
+	topics []Topic
+
+	retryDelay time.Duration
+	queueSize  int
+	loopWindow time.Duration
+
+	logger logger.Logger
+
+	// messages recently forwarded, by side and topic
+	mu        sync.Mutex
+	forwarded map[string]time.Time
+	pruned    time.Time
+
+	clients []*client.MqttClient
+	closed  bool
+	done    chan struct{}
+	wg      sync.WaitGroup
+}
+
+type BridgeOption func(b *Bridge)
+
+// Forward the topic filter, qos is the highest QoS used on the other side
+func WithTopic(filter string, direction byte, qos byte, localPrefix string, remotePrefix string) BridgeOption {
+	return func(b *Bridge) {
+		b.topics = append(b.topics, Topic{
+			Filter:       filter,
+			Direction:    direction,
+			Qos:          qos,
+			LocalPrefix:  localPrefix,
+			RemotePrefix: remotePrefix,
+		})
+	}
+}
+
+// Options of the clients connected to the local broker, credentials for example
+func WithLocalOptions(opts ...client.ClientOption) BridgeOption {
+	return func(b *Bridge) {
+		b.localOpts = append(b.localOpts, opts...)
+	}
+}
+
+// Options of the clients connected to the remote broker
+func WithRemoteOptions(opts ...client.ClientOption) BridgeOption {
+	return func(b *Bridge) {
+		b.remoteOpts = append(b.remoteOpts, opts...)
+	}
+}
+
+// Delay between two connection attempts
+func WithRetryDelay(delay time.Duration) BridgeOption {
+	return func(b *Bridge) {
+		b.retryDelay = delay
+	}
+}
+
+// Messages kept while the other broker is unreachable, the oldest are dropped
+func WithQueueSize(size int) BridgeOption {
+	return func(b *Bridge) {
+		b.queueSize = size
+	}
+}
+
+func WithLoopWindow(window time.Duration) BridgeOption {
+	return func(b *Bridge) {
+		b.loopWindow = window
+	}
+}
+
+// Logger of the bridge, also given to its clients unless their options set another one
+func WithLogger(l logger.Logger) BridgeOption {
+	return func(b *Bridge) {
+		b.logger = l
+	}
+}
+
+func New(clientId string, local *conn.MqttConn, remote *conn.MqttConn, opts ...BridgeOption) *Bridge {
+	b := &Bridge{
+		clientId:   clientId,
+		local:      local,
+		remote:     remote,
+		retryDelay: DEFAULT_RETRY_DELAY,
+		queueSize:  DEFAULT_QUEUE_SIZE,
+		loopWindow: DEFAULT_LOOP_WINDOW,
+		logger:     logger.Default(),
+		forwarded:  make(map[string]time.Time),
+		done:       make(chan struct{}),
+	}
+
+	for _, applyOpt := range opts {
+		if applyOpt != nil {
+			applyOpt(b)
+		}
+	}
+
+	return b
+}
+
+// One way of the bridge, messages read on the source and published on the destination
+type forwarder struct {
+	name string
+
+	src      *conn.MqttConn
+	srcOpts  []client.ClientOption
+	srcSide  string
+	dst      *conn.MqttConn
+	dstOpts  []client.ClientOption
+	dstSide  string
+	topics   []Topic
+	queue    chan *client.Message
+	outbound bool
+}
+
+// Start forwarding, the connections are retried until Close
+func (b *Bridge) Start() error {
+
+	out := &forwarder{name: "out", src: b.local, srcOpts: b.localOpts, srcSide: "local", dst: b.remote, dstOpts: b.remoteOpts, dstSide: "remote", outbound: true}
+	in := &forwarder{name: "in", src: b.remote, srcOpts: b.remoteOpts, srcSide: "remote", dst: b.local, dstOpts: b.localOpts, dstSide: "local"}
+
+	for _, t := range b.topics {
+		if t.Qos > client.QOS_2 {
+			return fmt.Errorf("invalid QoS %d for topic %s", t.Qos, t.Filter)
+		}
+		if t.Direction&OUT != 0 {
+			out.topics = append(out.topics, t)
+		}
+		if t.Direction&IN != 0 {
+			in.topics = append(in.topics, t)
+		}
+	}
+
+	for _, f := range []*forwarder{out, in} {
+		if len(f.topics) == 0 {
+			continue
+		}
+		f.queue = make(chan *client.Message, b.queueSize)
+		b.wg.Add(2)
+		go b.subscribe(f)
+		go b.publish(f)
+	}
+
+	return nil
+}
+
+// Stop forwarding and close the connections
+func (b *Bridge) Close() {
+	b.mu.Lock()
+	if b.closed {
+		b.mu.Unlock()
+		return
+	}
+	b.closed = true
+	close(b.done)
+	// release removes the clients from b.clients in place
+	clients := append([]*client.MqttClient(nil), b.clients...)
+	b.mu.Unlock()
+
+	for _, mc := range clients {
+		mc.Close()
+	}
+
+	b.wg.Wait()
+}
+
+func (b *Bridge) isClosed() bool {
+	select {
+	case <-b.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// Wait before retrying, return false if the bridge is closed meanwhile
+func (b *Bridge) wait() bool {
+	select {
+	case <-b.done:
+		return false
+	case <-time.After(b.retryDelay):
+		return true
+	}
+}
+
+// Connect a new client, registered to be closed with the bridge
+func (b *Bridge) connect(clientId string, infos *conn.MqttConn, opts []client.ClientOption) (*client.MqttClient, error) {
+
+	mc := client.New(clientId, append([]client.ClientOption{client.WithConnInfos(infos), client.WithLogger(b.logger)}, opts...)...)
+
+	if _, err := mc.Connect(); err != nil {
+		return nil, err
+	}
+
+	if ok, err := mc.MqttConnect(); err != nil || !ok {
+		mc.Close()
+		if err == nil {
+			err = fmt.Errorf("connection refused")
+		}
+		return nil, err
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.closed {
+		mc.Close()
+		return nil, fmt.Errorf("bridge closed")
+	}
+	b.clients = append(b.clients, mc)
+
+	return mc, nil
+}
+
+func (b *Bridge) log(level logger.Level, msg string, f *forwarder, keyvals ...interface{}) {
+	if b.logger != nil {
+		b.logger.Log(level, msg, append([]interface{}{"bridge", f.name}, keyvals...)...)
+	}
+}
+
+func (b *Bridge) release(mc *client.MqttClient) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for i, c := range b.clients {
+		if c == mc {
+			b.clients = append(b.clients[:i], b.clients[i+1:]...)
+			break
+		}
+	}
+}
+
+// Read the messages of the source broker and queue them
+func (b *Bridge) subscribe(f *forwarder) {
+	defer b.wg.Done()
+
+	for !b.isClosed() {
+
+		mc, err := b.connect(b.clientId+"-"+f.name+"-sub", f.src, f.srcOpts)
+		if err != nil {
+			b.log(logger.ERROR, "connection failed", f, "err", err)
+			if !b.wait() {
+				return
+			}
+			continue
+		}
+
+		mc.OnMessageReceived = func(mc *client.MqttClient, userData interface{}, message *client.Message) {
+			b.receive(f, message)
+		}
+
+		subscribed := true
+		for _, t := range f.topics {
+			filter := t.RemotePrefix + t.Filter
+			if f.outbound {
+				filter = t.LocalPrefix + t.Filter
+			}
+			if _, err := mc.Subscribe(filter, t.Qos); err != nil {
+				b.log(logger.ERROR, "subscribe failed", f, "filter", filter, "err", err)
+				subscribed = false
+				break
+			}
+		}
+
+		if subscribed {
+			stop := make(chan struct{})
+			go b.keepAlive(mc, f.src.KeepAlive, stop)
+			err = mc.Loop()
+			close(stop)
+			b.log(logger.WARN, "connection lost", f, "err", err)
+		}
+
+		mc.Close()
+		b.release(mc)
+
+		if !b.wait() {
+			return
+		}
+	}
+}
+
+// Ping the source broker while the client is waiting for messages,
+// the PINGRESP is read by the client loop
+// The connection is closed when the broker does not answer, so that Loop returns
+func (b *Bridge) keepAlive(mc *client.MqttClient, keepAlive uint16, stop chan struct{}) {
+	if keepAlive == 0 {
+		return
+	}
+
+	ticker := time.NewTicker(time.Duration(keepAlive) * time.Second / 2)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			if ok, err := mc.Ping(); err != nil || !ok {
+				mc.Close()
+				return
+			}
+		}
+	}
+}
+
+// Remap the topic, downgrade the QoS and queue the message
+func (b *Bridge) receive(f *forwarder, message *client.Message) {
+
+	// Our own message coming back from the other side
+	if b.echo(f.srcSide, message.Topic, message.Payload) {
+		return
+	}
+
+	for _, t := range f.topics {
+		srcPrefix, dstPrefix := t.RemotePrefix, t.LocalPrefix
+		if f.outbound {
+			srcPrefix, dstPrefix = t.LocalPrefix, t.RemotePrefix
+		}
+
+		if !strings.HasPrefix(message.Topic, srcPrefix) || !topic.Match(t.Filter, message.Topic[len(srcPrefix):]) {
+			continue
+		}
+
+		qos := message.Qos
+		if qos > t.Qos {
+			qos = t.Qos
+		}
+
+		forwarded := &client.Message{
+			Topic:   dstPrefix + message.Topic[len(srcPrefix):],
+			Payload: message.Payload,
+			Qos:     qos,
+			Retain:  message.Retain,
+		}
+
+		// Buffer while the destination is unreachable, the oldest message is dropped when full
+		for {
+			select {
+			case f.queue <- forwarded:
+				return
+			default:
+			}
+			select {
+			case dropped := <-f.queue:
+				b.log(logger.WARN, "queue full, message dropped", f, "topic", dropped.Topic)
+			default:
+			}
+		}
+	}
+}
+
+// Publish the queued messages on the destination broker
+func (b *Bridge) publish(f *forwarder) {
+	defer b.wg.Done()
+
+	var mc *client.MqttClient
+	var pending *client.Message
+
+	defer func() {
+		if mc != nil {
+			mc.MqttDisconnect()
+			b.release(mc)
+		}
+	}()
+
+	keepAlive := time.Duration(f.dst.KeepAlive) * time.Second / 2
+	if keepAlive == 0 {
+		keepAlive = time.Hour
+	}
+	ticker := time.NewTicker(keepAlive)
+	defer ticker.Stop()
+
+	for {
+		if mc == nil {
+			var err error
+			mc, err = b.connect(b.clientId+"-"+f.name+"-pub", f.dst, f.dstOpts)
+			if err != nil {
+				b.log(logger.ERROR, "connection failed", f, "err", err)
+				mc = nil
+				if !b.wait() {
+					return
+				}
+				continue
+			}
+		}
+
+		if pending == nil {
+			select {
+			case <-b.done:
+				return
+			case pending = <-f.queue:
+			case <-ticker.C:
+				if _, err := mc.Ping(); err != nil {
+					b.log(logger.WARN, "ping failed", f, "err", err)
+					mc.Close()
+					b.release(mc)
+					mc = nil
+				}
+				continue
+			}
+		}
+
+		b.record(f.dstSide, pending.Topic, pending.Payload)
+
+		if ok, err := mc.Publish(pending.Topic, pending.Payload, pending.Qos, pending.Retain); err != nil || !ok {
+			// Published again after the reconnection
+			b.log(logger.WARN, "publish failed", f, "topic", pending.Topic, "err", err)
+			mc.Close()
+			b.release(mc)
+			mc = nil
+			if !b.wait() {
+				return
+			}
+			continue
+		}
+
+		pending = nil
+	}
+}
+
+/////////////////////////////////////////////////
+// Loop prevention
+/////////////////////////////////////////////////
+
+func key(side string, topic string, payload string) string {
+	h := fnv.New64a()
+	h.Write([]byte(payload))
+	return fmt.Sprintf("%s %x %s", side, h.Sum64(), topic)
+}
+
+// Remember a message published by the bridge
+func (b *Bridge) record(side string, topic string, payload string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	// Forget the old messages once per window
+	now := time.Now()
+	if now.Sub(b.pruned) > b.loopWindow {
+		for k, t := range b.forwarded {
+			if now.Sub(t) > b.loopWindow {
+				delete(b.forwarded, k)
+			}
+		}
+		b.pruned = now
+	}
+	b.forwarded[key(side, topic, payload)] = now
+}
+
+// Check whether a received message was published by the bridge
+func (b *Bridge) echo(side string, topic string, payload string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	k := key(side, topic, payload)
+	t, ok := b.forwarded[k]
+	if !ok {
+		return false
+	}
+	delete(b.forwarded, k)
+
+	return time.Since(t) <= b.loopWindow
+}
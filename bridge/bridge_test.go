@@ -0,0 +1,284 @@
+// MIT License
+
+// Copyright (c) 2022 Florent Brusciano
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+package bridge
+
+import (
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/easygithdev/mqtt/broker"
+	"github.com/easygithdev/mqtt/client"
+	"github.com/easygithdev/mqtt/client/conn"
+	"github.com/easygithdev/mqtt/client/logger"
+)
+
+// Start a broker, on a free port if addr ends with :0
+func start(t *testing.T, addr string, opts ...broker.BrokerOption) (*broker.Broker, *conn.MqttConn) {
+	t.Helper()
+
+	b := broker.New(opts...)
+	a, err := b.Start(addr)
+	if err != nil {
+		t.Fatalf("Start error %s", err)
+	}
+	t.Cleanup(func() { b.Close() })
+
+	host, port, _ := net.SplitHostPort(a.String())
+	return b, conn.New(host, conn.WithPort(port))
+}
+
+func newClient(t *testing.T, clientId string, infos *conn.MqttConn) *client.MqttClient {
+	t.Helper()
+
+	mc := client.New(clientId, client.WithConnInfos(infos))
+	if _, err := mc.Connect(); err != nil {
+		t.Fatalf("Connect error %s", err)
+	}
+	if _, err := mc.MqttConnect(); err != nil {
+		t.Fatalf("MqttConnect error %s", err)
+	}
+	t.Cleanup(func() { mc.Close() })
+
+	return mc
+}
+
+// Subscribe and return the messages received
+func listen(t *testing.T, infos *conn.MqttConn, filter string, qos byte) chan *client.Message {
+	t.Helper()
+
+	messages := make(chan *client.Message, 100)
+	mc := newClient(t, "listen-"+filter, infos)
+	mc.OnMessageReceived = func(mc *client.MqttClient, userData interface{}, message *client.Message) {
+		messages <- message
+	}
+	if _, err := mc.Subscribe(filter, qos); err != nil {
+		t.Fatalf("Subscribe error %s", err)
+	}
+	go mc.Loop()
+
+	return messages
+}
+
+// Publish until a message goes through the bridge, then forget the received ones
+func ready(t *testing.T, pub *client.MqttClient, topic string, messages chan *client.Message) {
+	t.Helper()
+
+	timeout := time.After(5 * time.Second)
+	for {
+		if _, err := pub.Publish(topic, "ready", client.QOS_0, false); err != nil {
+			t.Fatalf("Publish error %s", err)
+		}
+		select {
+		case <-messages:
+			// Late ready messages
+			time.Sleep(100 * time.Millisecond)
+			for len(messages) > 0 {
+				<-messages
+			}
+			return
+		case <-time.After(50 * time.Millisecond):
+		case <-timeout:
+			t.Fatalf("Bridge not ready")
+		}
+	}
+}
+
+func expect(t *testing.T, messages chan *client.Message, topic string, payload string, qos byte) {
+	t.Helper()
+
+	select {
+	case m := <-messages:
+		if m.Topic != topic || m.Payload != payload || m.Qos != qos {
+			t.Errorf("Message found %s %q qos %d; want %s %q qos %d", m.Topic, m.Payload, m.Qos, topic, payload, qos)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Message %s %q not received", topic, payload)
+	}
+}
+
+func TestForward(t *testing.T) {
+
+	_, local := start(t, "127.0.0.1:0")
+	_, remote := start(t, "127.0.0.1:0")
+
+	upstream := listen(t, remote, "site1/sensors/#", client.QOS_2)
+	downstream := listen(t, local, "commands/#", client.QOS_2)
+
+	b := New("site1", local, remote,
+		WithTopic("sensors/#", OUT, client.QOS_0, "", "site1/"),
+		WithTopic("#", IN, client.QOS_1, "commands/", "site1/commands/"),
+		WithRetryDelay(50*time.Millisecond),
+	)
+	if err := b.Start(); err != nil {
+		t.Fatalf("Start error %s", err)
+	}
+	defer b.Close()
+
+	localPub := newClient(t, "local-pub", local)
+	remotePub := newClient(t, "remote-pub", remote)
+
+	ready(t, localPub, "sensors/ready", upstream)
+	ready(t, remotePub, "site1/commands/ready", downstream)
+
+	// Out, the prefix is added and the QoS downgraded to 0
+	localPub.Publish("sensors/kitchen/temperature", "21", client.QOS_1, false)
+	expect(t, upstream, "site1/sensors/kitchen/temperature", "21", client.QOS_0)
+
+	// Not bridged
+	localPub.Publish("other/topic", "ignored", client.QOS_0, false)
+
+	// In, the remote prefix is replaced by the local one
+	remotePub.Publish("site1/commands/reboot", "now", client.QOS_2, false)
+	expect(t, downstream, "commands/reboot", "now", client.QOS_1)
+
+	localPub.Publish("sensors/kitchen/humidity", "40", client.QOS_0, false)
+	expect(t, upstream, "site1/sensors/kitchen/humidity", "40", client.QOS_0)
+}
+
+func TestLoopPrevention(t *testing.T) {
+
+	_, local := start(t, "127.0.0.1:0")
+	_, remote := start(t, "127.0.0.1:0")
+
+	localMessages := listen(t, local, "shared/#", client.QOS_0)
+	remoteMessages := listen(t, remote, "shared/#", client.QOS_0)
+
+	b := New("loop", local, remote,
+		WithTopic("shared/#", BOTH, client.QOS_0, "", ""),
+		WithRetryDelay(50*time.Millisecond),
+	)
+	if err := b.Start(); err != nil {
+		t.Fatalf("Start error %s", err)
+	}
+	defer b.Close()
+
+	localPub := newClient(t, "local-pub", local)
+	remotePub := newClient(t, "remote-pub", remote)
+
+	ready(t, localPub, "shared/ready", remoteMessages)
+	ready(t, remotePub, "shared/ready", localMessages)
+	time.Sleep(200 * time.Millisecond)
+	for len(localMessages) > 0 || len(remoteMessages) > 0 {
+		select {
+		case <-localMessages:
+		case <-remoteMessages:
+		}
+	}
+
+	localPub.Publish("shared/value", "1", client.QOS_0, false)
+	expect(t, localMessages, "shared/value", "1", client.QOS_0)
+	expect(t, remoteMessages, "shared/value", "1", client.QOS_0)
+
+	// The message does not come back, the next one is the marker
+	remotePub.Publish("shared/marker", "2", client.QOS_0, false)
+	expect(t, remoteMessages, "shared/marker", "2", client.QOS_0)
+	expect(t, localMessages, "shared/marker", "2", client.QOS_0)
+}
+
+// Messages are buffered while the remote broker is down
+func TestReconnect(t *testing.T) {
+
+	_, local := start(t, "127.0.0.1:0")
+	remoteBroker, remote := start(t, "127.0.0.1:0")
+	addr := net.JoinHostPort(remote.Host, remote.Port)
+
+	b := New("site1", local, remote,
+		WithTopic("sensors/#", OUT, client.QOS_1, "", ""),
+		WithRetryDelay(50*time.Millisecond),
+	)
+	if err := b.Start(); err != nil {
+		t.Fatalf("Start error %s", err)
+	}
+	defer b.Close()
+
+	upstream := listen(t, remote, "sensors/#", client.QOS_1)
+	localPub := newClient(t, "local-pub", local)
+	ready(t, localPub, "sensors/ready", upstream)
+
+	remoteBroker.Close()
+	time.Sleep(100 * time.Millisecond)
+
+	localPub.Publish("sensors/offline", "buffered", client.QOS_1, false)
+	time.Sleep(200 * time.Millisecond)
+
+	// The bridge is refused until the listener is subscribed, the message would be lost otherwise
+	subscribed := make(chan struct{})
+	_, remote = start(t, addr, broker.WithAuthenticator(broker.AuthenticatorFunc(func(info *broker.ConnectInfo) bool {
+		select {
+		case <-subscribed:
+			return true
+		default:
+			return !strings.HasPrefix(info.ClientId, "site1-")
+		}
+	})))
+	upstream = listen(t, remote, "sensors/#", client.QOS_1)
+	close(subscribed)
+
+	expect(t, upstream, "sensors/offline", "buffered", client.QOS_1)
+}
+
+// The subscribing client is kept alive by its pings and the bridge logs through its logger
+func TestKeepAlive(t *testing.T) {
+
+	_, local := start(t, "127.0.0.1:0")
+	_, remote := start(t, "127.0.0.1:0")
+	src := conn.New(local.Host, conn.WithPort(local.Port), conn.WithKeepAlive(1))
+
+	var mu sync.Mutex
+	var lost []string
+	l := logger.Func(func(level logger.Level, msg string, keyvals ...interface{}) {
+		if level >= logger.WARN {
+			mu.Lock()
+			lost = append(lost, msg)
+			mu.Unlock()
+		}
+	})
+
+	b := New("site1", src, remote,
+		WithTopic("sensors/#", OUT, client.QOS_0, "", ""),
+		WithRetryDelay(50*time.Millisecond),
+		WithLogger(l),
+	)
+	if err := b.Start(); err != nil {
+		t.Fatalf("Start error %s", err)
+	}
+	defer b.Close()
+
+	upstream := listen(t, remote, "sensors/#", client.QOS_0)
+	localPub := newClient(t, "local-pub", local)
+	ready(t, localPub, "sensors/ready", upstream)
+
+	// Longer than one and a half keep-alive
+	time.Sleep(2 * time.Second)
+
+	localPub.Publish("sensors/alive", "1", client.QOS_0, false)
+	expect(t, upstream, "sensors/alive", "1", client.QOS_0)
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(lost) > 0 {
+		t.Errorf("Logged %v; want nothing", lost)
+	}
+}
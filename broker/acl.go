@@ -0,0 +1,224 @@
+// MIT License
+
+// Copyright (c) 2022 Florent Brusciano
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+package broker
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/easygithdev/mqtt/topic"
+)
+
+// Rule of an ACL file, access 0 denies
+type aclRule struct {
+	access byte
+	topic  string
+}
+
+// Authorizer reading a mosquitto-like ACL file :
+//
+//	# rules before any user line apply to the clients without username
+//	topic read public/#
+//
+//	user alice
+//	topic readwrite alice/#
+//	topic deny alice/secret
+//
+//	# rules for every client, %c is the client identifier and %u the username
+//	pattern write devices/%c/#
+//
+// The access is read, write, readwrite or deny, readwrite is used if omitted.
+// A deny rule wins over the others, the access is refused if no rule grants it.
+// Like mosquitto, a subscription is granted when a rule covers its filter,
+// the deny rules are then applied to each message delivered.
+type ACL struct {
+	anonymous []aclRule
+	users     map[string][]aclRule
+	patterns  []aclRule
+}
+
+// Load the ACL file
+func LoadACL(path string) (*ACL, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return ParseACL(f)
+}
+
+func ParseACL(r io.Reader) (*ACL, error) {
+
+	acl := &ACL{users: make(map[string][]aclRule)}
+
+	user := ""
+	hasUser := false
+
+	scanner := bufio.NewScanner(r)
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		keyword, rest := splitWord(text)
+		switch keyword {
+
+		case "user":
+			if rest == "" {
+				return nil, fmt.Errorf("line %d: missing username", line)
+			}
+			user = rest
+			hasUser = true
+
+		case "topic", "pattern":
+			rule, err := parseRule(rest)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %s", line, err)
+			}
+			if keyword == "pattern" {
+				acl.patterns = append(acl.patterns, rule)
+			} else if hasUser {
+				acl.users[user] = append(acl.users[user], rule)
+			} else {
+				acl.anonymous = append(acl.anonymous, rule)
+			}
+
+		default:
+			return nil, fmt.Errorf("line %d: unknown keyword %s", line, keyword)
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return acl, nil
+}
+
+func splitWord(text string) (string, string) {
+	i := strings.IndexAny(text, " \t")
+	if i < 0 {
+		return text, ""
+	}
+	return text[:i], strings.TrimSpace(text[i:])
+}
+
+// [read|write|readwrite|deny] topic, the topic may contain spaces
+func parseRule(text string) (aclRule, error) {
+
+	rule := aclRule{access: ACCESS_READWRITE, topic: text}
+
+	word, rest := splitWord(text)
+	if rest != "" {
+		switch word {
+		case "read":
+			rule = aclRule{access: ACCESS_READ, topic: rest}
+		case "write":
+			rule = aclRule{access: ACCESS_WRITE, topic: rest}
+		case "readwrite":
+			rule = aclRule{access: ACCESS_READWRITE, topic: rest}
+		case "deny":
+			rule = aclRule{access: 0, topic: rest}
+		}
+	}
+
+	if topic.ValidateFilter(rule.topic) != nil {
+		return rule, fmt.Errorf("invalid topic %s", rule.topic)
+	}
+
+	return rule, nil
+}
+
+func (acl *ACL) Authorize(info *ConnectInfo, topic string, access byte) bool {
+
+	var rules []aclRule
+	if info.HasUsername {
+		rules = append(rules, acl.users[info.Username]...)
+	} else {
+		rules = append(rules, acl.anonymous...)
+	}
+
+	for _, rule := range acl.patterns {
+		// A pattern using the username does not apply without username
+		if strings.Contains(rule.topic, "%u") && !info.HasUsername {
+			continue
+		}
+		rule.topic = strings.NewReplacer("%c", info.ClientId, "%u", info.Username).Replace(rule.topic)
+		rules = append(rules, rule)
+	}
+
+	granted := false
+	for _, rule := range rules {
+		if !covers(rule.topic, topic) {
+			continue
+		}
+		if rule.access == 0 {
+			return false
+		}
+		if rule.access&access == access {
+			granted = true
+		}
+	}
+
+	return granted
+}
+
+// Check that every topic matched by the filter is matched by the rule
+// A topic name is a filter without wildcard
+func covers(rule string, filter string) bool {
+
+	// Wildcards do not match the topics starting with $
+	if strings.HasPrefix(filter, "$") && !strings.HasPrefix(rule, "$") {
+		return false
+	}
+
+	rs := strings.Split(rule, "/")
+	fs := strings.Split(filter, "/")
+
+	for i, r := range rs {
+		if r == "#" {
+			return true
+		}
+		if i >= len(fs) {
+			return false
+		}
+		f := fs[i]
+		switch {
+		case f == "#":
+			return false
+		case r == "+":
+		case f == "+":
+			return false
+		case r != f:
+			return false
+		}
+	}
+
+	return len(rs) == len(fs)
+}
@@ -0,0 +1,113 @@
+// MIT License
+
+// Copyright (c) 2022 Florent Brusciano
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+package broker
+
+import (
+	"crypto/subtle"
+	"crypto/x509"
+	"net"
+)
+
+// Access to a topic checked by an Authorizer
+const ACCESS_READ byte = 0x01
+const ACCESS_WRITE byte = 0x02
+const ACCESS_READWRITE byte = ACCESS_READ | ACCESS_WRITE
+
+// Identity of a connected client, given to the hooks
+type ConnectInfo struct {
+	ClientId string
+
+	// Username and Password of the CONNECT payload
+	Username    string
+	Password    string
+	HasUsername bool
+	HasPassword bool
+
+	// Client certificate of a TLS connection verified by the TLS configuration
+	// (VerifyClientCertIfGiven, RequireAndVerifyClientCert), nil otherwise
+	Certificate *x509.Certificate
+
+	RemoteAddr net.Addr
+}
+
+// Decide whether a client may connect
+type Authenticator interface {
+	Authenticate(info *ConnectInfo) bool
+}
+
+// Decide whether a client may publish (ACCESS_WRITE) to a topic
+// or subscribe and receive (ACCESS_READ) the messages of a topic
+// The topic of a subscription check is a topic filter
+// It is called while the broker is locked and must not use the broker
+type Authorizer interface {
+	Authorize(info *ConnectInfo, topic string, access byte) bool
+}
+
+// Use a function as an Authenticator
+type AuthenticatorFunc func(info *ConnectInfo) bool
+
+func (f AuthenticatorFunc) Authenticate(info *ConnectInfo) bool {
+	return f(info)
+}
+
+// Use a function as an Authorizer
+type AuthorizerFunc func(info *ConnectInfo, topic string, access byte) bool
+
+func (f AuthorizerFunc) Authorize(info *ConnectInfo, topic string, access byte) bool {
+	return f(info, topic, access)
+}
+
+// Password of each username, clients without credentials are refused
+type PasswordAuthenticator map[string]string
+
+func (pa PasswordAuthenticator) Authenticate(info *ConnectInfo) bool {
+	password, ok := pa[info.Username]
+	if !ok || !info.HasUsername || !info.HasPassword {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(password), []byte(info.Password)) == 1
+}
+
+// Refuse the connections without a verified client certificate
+// and use the certificate common name as username, like the mosquitto use_identity_as_username
+func WithCertificateIdentity() BrokerOption {
+	return func(b *Broker) {
+		b.certificateIdentity = true
+	}
+}
+
+func WithAuthenticator(authenticator Authenticator) BrokerOption {
+	return func(b *Broker) {
+		b.authenticator = authenticator
+	}
+}
+
+func WithAuthorizer(authorizer Authorizer) BrokerOption {
+	return func(b *Broker) {
+		b.authorizer = authorizer
+	}
+}
+
+// Every access is granted without Authorizer
+func (b *Broker) authorized(info *ConnectInfo, topic string, access byte) bool {
+	return b.authorizer == nil || b.authorizer.Authorize(info, topic, access)
+}
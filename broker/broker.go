@@ -0,0 +1,220 @@
+// MIT License
+
+// Copyright (c) 2022 Florent Brusciano
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+package broker
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/easygithdev/mqtt/topic"
+)
+
+// Time allowed to a new connection to send its CONNECT
+const DEFAULT_CONNECT_TIMEOUT = 10 * time.Second
+
+// Time allowed to write a packet to a client
+const DEFAULT_WRITE_TIMEOUT = 10 * time.Second
+
+// QoS > 0 messages kept for an offline persistent session, the oldest are dropped
+const DEFAULT_MAX_QUEUED_MESSAGES = 1000
+
+// Highest QoS granted to the subscriptions
+const MAX_QOS byte = 2
+
+// Application message routed by the broker
+type Message struct {
+	Topic   string
+	Payload []byte
+	Qos     byte
+	Retain  bool
+}
+
+// Define the MQTT 3.1.1 broker
+type Broker struct {
+	mu sync.Mutex
+
+	// sessions by client identifier
+	sessions map[string]*session
+
+	// subscriptions of the sessions by topic filter
+	subscriptions *topic.Trie
+
+	// retained messages by topic
+	retained RetainedStore
+
+	listeners []net.Listener
+	clients   map[*client]bool
+	closed    bool
+
+	// hooks
+	authenticator       Authenticator
+	authorizer          Authorizer
+	certificateIdentity bool
+
+	// parameters
+	connectTimeout    time.Duration
+	writeTimeout      time.Duration
+	maxQueuedMessages int
+}
+
+type BrokerOption func(b *Broker)
+
+func WithConnectTimeout(timeout time.Duration) BrokerOption {
+	return func(b *Broker) {
+		b.connectTimeout = timeout
+	}
+}
+
+func WithWriteTimeout(timeout time.Duration) BrokerOption {
+	return func(b *Broker) {
+		b.writeTimeout = timeout
+	}
+}
+
+func WithMaxQueuedMessages(max int) BrokerOption {
+	return func(b *Broker) {
+		b.maxQueuedMessages = max
+	}
+}
+
+// Store the retained messages in the store instead of memory
+func WithRetainedStore(store RetainedStore) BrokerOption {
+	return func(b *Broker) {
+		b.retained = store
+	}
+}
+
+func New(opts ...BrokerOption) *Broker {
+	b := &Broker{
+		sessions:          make(map[string]*session),
+		subscriptions:     topic.NewTrie(),
+		retained:          NewMemoryStore(),
+		clients:           make(map[*client]bool),
+		connectTimeout:    DEFAULT_CONNECT_TIMEOUT,
+		writeTimeout:      DEFAULT_WRITE_TIMEOUT,
+		maxQueuedMessages: DEFAULT_MAX_QUEUED_MESSAGES,
+	}
+
+	for _, applyOpt := range opts {
+		if applyOpt != nil {
+			applyOpt(b)
+		}
+	}
+
+	return b
+}
+
+// Accept the connections of the listener until it is closed
+func (b *Broker) Serve(l net.Listener) error {
+	if err := b.track(l); err != nil {
+		return err
+	}
+	return b.accept(l)
+}
+
+// Listen on the TCP address and serve the connections
+func (b *Broker) ListenAndServe(addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return b.Serve(l)
+}
+
+// Listen on the TCP address and serve the connections in background
+// Return the address listened, useful with port 0
+func (b *Broker) Start(addr string) (net.Addr, error) {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := b.track(l); err != nil {
+		return nil, err
+	}
+
+	go func() {
+		if err := b.accept(l); err != nil {
+			log.Printf("Serve Error: %s\n", err)
+		}
+	}()
+
+	return l.Addr(), nil
+}
+
+// Keep the listener to close it with the broker
+func (b *Broker) track(l net.Listener) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.closed {
+		l.Close()
+		return fmt.Errorf("broker closed")
+	}
+	b.listeners = append(b.listeners, l)
+
+	return nil
+}
+
+func (b *Broker) accept(l net.Listener) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			b.mu.Lock()
+			closed := b.closed
+			b.mu.Unlock()
+			if closed {
+				return nil
+			}
+			return err
+		}
+
+		go b.ServeConn(conn)
+	}
+}
+
+// Stop the listeners and close the client connections
+func (b *Broker) Close() error {
+
+	b.mu.Lock()
+	b.closed = true
+	listeners := b.listeners
+	b.listeners = nil
+	clients := make([]*client, 0, len(b.clients))
+	for c := range b.clients {
+		clients = append(clients, c)
+	}
+	b.mu.Unlock()
+
+	for _, l := range listeners {
+		l.Close()
+	}
+
+	for _, c := range clients {
+		c.conn.Close()
+	}
+
+	return nil
+}
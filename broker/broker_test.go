@@ -0,0 +1,776 @@
+// MIT License
+
+// Copyright (c) 2022 Florent Brusciano
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+package broker
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"math/big"
+	"net"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	mqtt "github.com/easygithdev/mqtt/client"
+	"github.com/easygithdev/mqtt/client/conn"
+	"github.com/easygithdev/mqtt/packet"
+	"github.com/easygithdev/mqtt/packet/header"
+	"github.com/easygithdev/mqtt/packet/payload"
+	"github.com/easygithdev/mqtt/packet/property"
+	"github.com/easygithdev/mqtt/packet/vheader"
+)
+
+// Raw MQTT client used to check the packets sent by the broker
+type testClient struct {
+	t    *testing.T
+	conn net.Conn
+}
+
+// Start a broker listening on a local port
+func start(t *testing.T, opts ...BrokerOption) (*Broker, string) {
+	t.Helper()
+
+	b := New(opts...)
+	addr, err := b.Start("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Start error %s", err)
+	}
+	t.Cleanup(func() { b.Close() })
+
+	return b, addr.String()
+}
+
+func dial(t *testing.T, addr string) *testClient {
+	t.Helper()
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Dial error %s", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	return &testClient{t: t, conn: conn}
+}
+
+func (tc *testClient) write(mp *packet.MqttPacket) {
+	tc.t.Helper()
+	tc.conn.SetWriteDeadline(time.Now().Add(time.Second))
+	data, err := packet.Encode(mp)
+	if err != nil {
+		tc.t.Fatalf("Encode error %s", err)
+	}
+	if _, err := tc.conn.Write(data); err != nil {
+		tc.t.Fatalf("Write error %s", err)
+	}
+}
+
+func (tc *testClient) read() *packet.MqttPacket {
+	tc.t.Helper()
+	tc.conn.SetReadDeadline(time.Now().Add(time.Second))
+	data, err := packet.Read(tc.conn)
+	if err != nil {
+		tc.t.Fatalf("Read error %s", err)
+	}
+	return packet.Decode(data)
+}
+
+// Expect the connection to be closed by the broker
+func (tc *testClient) closed(timeout time.Duration) {
+	tc.t.Helper()
+	tc.conn.SetReadDeadline(time.Now().Add(timeout))
+	if _, err := packet.Read(tc.conn); err == nil {
+		tc.t.Fatalf("Connection should be closed")
+	} else if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		tc.t.Fatalf("Connection still open after %s", timeout)
+	}
+}
+
+func connectPacket(clientId string, flag byte, keepAlive uint16, strs ...string) *packet.MqttPacket {
+	mh := header.New(header.WithControl(header.CONNECT))
+	mvh := vheader.NewConnectHeader("MQTT", 4, flag, keepAlive)
+	mpl := payload.New(payload.WithString(clientId))
+	for _, str := range strs {
+		mpl.AddString(str)
+	}
+	return packet.NewMqttPacket(mh, packet.WithVariableHeader(mvh), packet.WithPayload(mpl))
+}
+
+// Connect and return the CONNACK bytes
+func (tc *testClient) connect(clientId string, flag byte, keepAlive uint16, strs ...string) []byte {
+	tc.t.Helper()
+	tc.write(connectPacket(clientId, flag, keepAlive, strs...))
+	connack := tc.read()
+	if connack == nil || connack.Header.Control != header.CONNACK {
+		tc.t.Fatalf("CONNACK expected, found %v", connack)
+	}
+	return connack.VariableHeader.(*vheader.GenericHeader).Data
+}
+
+func (tc *testClient) subscribe(filter string, qos byte) byte {
+	tc.t.Helper()
+	mh := header.New(header.WithSubscribe())
+	mvh := vheader.NewPacketIdHeader(1)
+	mpl := payload.New(payload.WithString(filter), payload.WithQos(qos))
+	tc.write(packet.NewMqttPacket(mh, packet.WithVariableHeader(mvh), packet.WithPayload(mpl)))
+	suback := tc.read()
+	if suback.Header.Control != header.SUBACK {
+		tc.t.Fatalf("SUBACK expected, found %s", header.ControlToString(suback.Header.Control))
+	}
+	return *suback.Payload.Qos
+}
+
+func (tc *testClient) publish(topic string, msg string, qos byte, retain bool, packetId uint16) {
+	tc.t.Helper()
+	mh := header.New(header.WithControl(header.PUBLISH))
+	mh.Control |= qos << 1
+	if retain {
+		mh.Control |= 1
+	}
+	mvh := vheader.NewPublishHeader(topic)
+	mvh.PacketId = packetId
+	mpl := payload.New(payload.WithData([]byte(msg)))
+	tc.write(packet.NewMqttPacket(mh, packet.WithVariableHeader(mvh), packet.WithPayload(mpl)))
+}
+
+func (tc *testClient) ack(control byte, packetId uint16) {
+	tc.t.Helper()
+	mh := header.New(header.WithControl(control))
+	if control == header.PUBREL {
+		mh = header.New(header.WithPubrel())
+	}
+	tc.write(packet.NewMqttPacket(mh, packet.WithVariableHeader(vheader.NewPacketIdHeader(packetId))))
+}
+
+// Read a PUBLISH and check its topic and message
+func (tc *testClient) expectPublish(topic string, msg string) *packet.MqttPacket {
+	tc.t.Helper()
+	mp := tc.read()
+	if mp == nil || mp.Header.Control&0xF0 != header.PUBLISH {
+		tc.t.Fatalf("PUBLISH expected, found %v", mp)
+	}
+	vh := mp.VariableHeader.(*vheader.PublishHeader)
+	if vh.TopicName != topic || !bytes.Equal(mp.Payload.Data, []byte(msg)) {
+		tc.t.Fatalf("PUBLISH found %s %q; want %s %q", vh.TopicName, mp.Payload.Data, topic, msg)
+	}
+	return mp
+}
+
+func TestPublishQos(t *testing.T) {
+
+	_, addr := start(t)
+
+	sub := dial(t, addr)
+	sub.connect("sub", vheader.CONNECT_FLAG_CLEAN_SESSION, 0)
+	if granted := sub.subscribe("hello/+", 2); granted != 2 {
+		t.Fatalf("Granted QoS found %d; want 2", granted)
+	}
+
+	pub := dial(t, addr)
+	pub.connect("pub", vheader.CONNECT_FLAG_CLEAN_SESSION, 0)
+
+	// QoS 0
+	pub.publish("hello/world", "qos0", 0, false, 0)
+	sub.expectPublish("hello/world", "qos0")
+
+	// QoS 1
+	pub.publish("hello/world", "qos1", 1, false, 10)
+	if puback := pub.read(); puback.Header.Control != header.PUBACK {
+		t.Fatalf("PUBACK expected")
+	}
+	mp := sub.expectPublish("hello/world", "qos1")
+	sub.ack(header.PUBACK, mp.VariableHeader.(*vheader.PublishHeader).PacketId)
+
+	// QoS 2, the PUBLISH is sent twice but delivered once
+	pub.publish("hello/world", "qos2", 2, false, 11)
+	pub.read()
+	pub.publish("hello/world", "qos2", 2, false, 11)
+	if pubrec := pub.read(); pubrec.Header.Control != header.PUBREC {
+		t.Fatalf("PUBREC expected")
+	}
+	pub.ack(header.PUBREL, 11)
+	if pubcomp := pub.read(); pubcomp.Header.Control != header.PUBCOMP {
+		t.Fatalf("PUBCOMP expected")
+	}
+
+	mp = sub.expectPublish("hello/world", "qos2")
+	id := mp.VariableHeader.(*vheader.PublishHeader).PacketId
+	sub.ack(header.PUBREC, id)
+	if pubrel := sub.read(); pubrel.Header.Control&0xF0 != header.PUBREL {
+		t.Fatalf("PUBREL expected")
+	}
+	sub.ack(header.PUBCOMP, id)
+
+	// Not matching
+	pub.publish("other/world", "nothing", 0, false, 0)
+	pub.publish("hello/world", "last", 0, false, 0)
+	sub.expectPublish("hello/world", "last")
+}
+
+func TestRetained(t *testing.T) {
+
+	_, addr := start(t)
+
+	pub := dial(t, addr)
+	pub.connect("pub", vheader.CONNECT_FLAG_CLEAN_SESSION, 0)
+	pub.publish("hello/retain", "last known good", 0, true, 0)
+	pub.ack(header.PINGREQ, 0)
+
+	sub := dial(t, addr)
+	sub.connect("sub", vheader.CONNECT_FLAG_CLEAN_SESSION, 0)
+	sub.subscribe("hello/#", 0)
+	mp := sub.expectPublish("hello/retain", "last known good")
+	if mp.Header.Control&0x01 == 0 {
+		t.Errorf("Retain flag should be set for a new subscription")
+	}
+
+	// Established subscription, the retain flag is cleared
+	pub.publish("hello/retain", "new value", 0, true, 0)
+	mp = sub.expectPublish("hello/retain", "new value")
+	if mp.Header.Control&0x01 != 0 {
+		t.Errorf("Retain flag should be cleared for an established subscription")
+	}
+
+	// Clear the retained message
+	pub.publish("hello/retain", "", 0, true, 0)
+	sub.expectPublish("hello/retain", "")
+
+	other := dial(t, addr)
+	other.connect("other", vheader.CONNECT_FLAG_CLEAN_SESSION, 0)
+	other.subscribe("hello/#", 0)
+	pub.publish("hello/next", "next", 0, false, 0)
+	other.expectPublish("hello/next", "next")
+}
+
+func TestWill(t *testing.T) {
+
+	_, addr := start(t)
+
+	sub := dial(t, addr)
+	sub.connect("sub", vheader.CONNECT_FLAG_CLEAN_SESSION, 0)
+	sub.subscribe("status/#", 1)
+
+	flag := vheader.CONNECT_FLAG_CLEAN_SESSION | vheader.CONNECT_FLAG_WILL_FLAG
+	polite := dial(t, addr)
+	polite.connect("polite", flag, 0, "status/polite", "gone")
+	polite.write(packet.NewMqttPacket(header.New(header.WithControl(header.DISCONNECT))))
+
+	lost := dial(t, addr)
+	lost.connect("lost", flag, 0, "status/lost", "gone")
+	lost.conn.Close()
+
+	// Only the connection lost without DISCONNECT publishes its will
+	sub.expectPublish("status/lost", "gone")
+}
+
+func TestPersistentSession(t *testing.T) {
+
+	_, addr := start(t)
+
+	sub := dial(t, addr)
+	if connack := sub.connect("persistent", 0, 0); connack[0] != 0 {
+		t.Errorf("Session present found %d; want 0", connack[0])
+	}
+	sub.subscribe("hello/world", 1)
+	sub.write(packet.NewMqttPacket(header.New(header.WithControl(header.DISCONNECT))))
+
+	pub := dial(t, addr)
+	pub.connect("pub", vheader.CONNECT_FLAG_CLEAN_SESSION, 0)
+	pub.publish("hello/world", "while offline", 1, false, 1)
+	pub.read()
+
+	sub = dial(t, addr)
+	if connack := sub.connect("persistent", 0, 0); connack[0] != 1 {
+		t.Errorf("Session present found %d; want 1", connack[0])
+	}
+	sub.expectPublish("hello/world", "while offline")
+
+	// A clean session removes the stored one
+	sub = dial(t, addr)
+	if connack := sub.connect("persistent", vheader.CONNECT_FLAG_CLEAN_SESSION, 0); connack[0] != 0 {
+		t.Errorf("Session present found %d; want 0", connack[0])
+	}
+}
+
+func TestResendOrder(t *testing.T) {
+
+	_, addr := start(t)
+
+	sub := dial(t, addr)
+	sub.connect("resend", 0, 0)
+	sub.subscribe("resend/order", 1)
+
+	pub := dial(t, addr)
+	pub.connect("resend-pub", vheader.CONNECT_FLAG_CLEAN_SESSION, 0)
+	for i := 0; i < 10; i++ {
+		pub.publish("resend/order", fmt.Sprint(i), 1, false, uint16(i+1))
+		pub.read()
+	}
+
+	// Only the fourth message is acknowledged before the connection is lost
+	for i := 0; i < 10; i++ {
+		mp := sub.expectPublish("resend/order", fmt.Sprint(i))
+		if i == 3 {
+			sub.ack(header.PUBACK, mp.VariableHeader.(*vheader.PublishHeader).PacketId)
+		}
+	}
+	// The PUBACK is handled once the PINGRESP is received
+	sub.write(packet.NewMqttPacket(header.New(header.WithControl(header.PINGREQ))))
+	sub.read()
+	sub.conn.Close()
+
+	// The others are sent again in their original order
+	sub = dial(t, addr)
+	if connack := sub.connect("resend", 0, 0); connack[0] != 1 {
+		t.Fatalf("Session present found %d; want 1", connack[0])
+	}
+	for i := 0; i < 10; i++ {
+		if i == 3 {
+			continue
+		}
+		if mp := sub.expectPublish("resend/order", fmt.Sprint(i)); mp.Header.Control&0x08 == 0 {
+			t.Errorf("DUP flag not set on the message %d sent again", i)
+		}
+	}
+}
+
+func TestKeepAlive(t *testing.T) {
+
+	_, addr := start(t)
+
+	c := dial(t, addr)
+	c.connect("idle", vheader.CONNECT_FLAG_CLEAN_SESSION, 1)
+	c.closed(3 * time.Second)
+}
+
+func TestRefused(t *testing.T) {
+
+	_, addr := start(t)
+
+	// MQTT 5 is not supported
+	c := dial(t, addr)
+	mp := connectPacket("v5", vheader.CONNECT_FLAG_CLEAN_SESSION, 0)
+	mvh := mp.VariableHeader.(*vheader.ConnectHeader)
+	mvh.ProtocolVersion = 5
+	mvh.Properties = property.New()
+	c.write(mp)
+	if rc := c.read().VariableHeader.(*vheader.GenericHeader).Data[1]; rc != header.CONNECT_REFUSED_1 {
+		t.Errorf("Return code found %d; want 1", rc)
+	}
+
+	// An empty client identifier requires a clean session
+	c = dial(t, addr)
+	if connack := c.connect("", 0, 0); connack[1] != header.CONNECT_REFUSED_2 {
+		t.Errorf("Return code found %d; want 2", connack[1])
+	}
+
+	// The first packet must be a CONNECT
+	c = dial(t, addr)
+	c.write(packet.NewMqttPacket(header.New(header.WithControl(header.PINGREQ))))
+	c.closed(time.Second)
+}
+
+func TestMalformedConnect(t *testing.T) {
+
+	_, addr := start(t)
+
+	// Protocol level 5 with a property length longer than 4 bytes
+	c := dial(t, addr)
+	data := []byte{header.CONNECT, 22, 0, 4, 'M', 'Q', 'T', 'T', 5, vheader.CONNECT_FLAG_CLEAN_SESSION, 0, 0}
+	data = append(data, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0x7F)
+	data = append(data, 0, 0)
+	c.conn.Write(data)
+	c.closed(time.Second)
+
+	// The broker still serves the other connections
+	c = dial(t, addr)
+	if connack := c.connect("after", vheader.CONNECT_FLAG_CLEAN_SESSION, 0); connack[1] != header.CONNECT_ACCEPTED {
+		t.Errorf("Return code found %d; want 0", connack[1])
+	}
+}
+
+func TestClose(t *testing.T) {
+
+	b, addr := start(t)
+
+	c := dial(t, addr)
+	c.connect("closed", vheader.CONNECT_FLAG_CLEAN_SESSION, 0)
+
+	b.Close()
+	c.closed(time.Second)
+
+	if _, err := net.Dial("tcp", addr); err == nil {
+		t.Errorf("Listener should be closed")
+	}
+}
+
+func TestRetainedStore(t *testing.T) {
+
+	dir := t.TempDir()
+	fs, err := NewFileStore(dir)
+	if err != nil {
+		t.Fatalf("NewFileStore error %s", err)
+	}
+
+	for name, store := range map[string]RetainedStore{"memory": NewMemoryStore(), "file": fs} {
+		store.Store(&Message{Topic: "sport/tennis", Payload: []byte("tennis"), Qos: 1, Retain: true})
+		store.Store(&Message{Topic: "sport/golf", Payload: []byte("golf"), Retain: true})
+		store.Store(&Message{Topic: "news", Payload: []byte("news"), Retain: true})
+		store.Store(&Message{Topic: "sport/golf", Payload: []byte("golf again"), Retain: true})
+		store.Delete("news")
+		store.Delete("unknown")
+
+		messages, err := store.Match("sport/+")
+		if err != nil {
+			t.Fatalf("%s: Match error %s", name, err)
+		}
+		var found []string
+		for _, msg := range messages {
+			found = append(found, msg.Topic+"="+string(msg.Payload))
+		}
+		sort.Strings(found)
+		if len(found) != 2 || found[0] != "sport/golf=golf again" || found[1] != "sport/tennis=tennis" {
+			t.Errorf("%s: Match found %v", name, found)
+		}
+
+		if messages, _ := store.Match("#"); len(messages) != 2 {
+			t.Errorf("%s: Match # found %d message(s); want 2", name, len(messages))
+		}
+	}
+
+	// The messages survive a restart
+	fs, err = NewFileStore(dir)
+	if err != nil {
+		t.Fatalf("NewFileStore error %s", err)
+	}
+	messages, _ := fs.Match("sport/tennis")
+	if len(messages) != 1 || string(messages[0].Payload) != "tennis" || messages[0].Qos != 1 {
+		t.Errorf("Reopened store found %v", messages)
+	}
+}
+
+// A retained publish of the client is kept by the broker, even across a restart
+func TestRetainedEndToEnd(t *testing.T) {
+
+	dir := t.TempDir()
+
+	fs, err := NewFileStore(dir)
+	if err != nil {
+		t.Fatalf("NewFileStore error %s", err)
+	}
+	b, addr := start(t, WithRetainedStore(fs))
+
+	host, port, _ := net.SplitHostPort(addr)
+	mc := mqtt.New("retain", mqtt.WithConnInfos(conn.New(host, conn.WithPort(port))))
+	if _, err := mc.Connect(); err != nil {
+		t.Fatalf("Connect error %s", err)
+	}
+	if ok, err := mc.Publish("hello/mqtt", "The temperature is 10 degrees", mqtt.QOS_2, true); err != nil || !ok {
+		t.Fatalf("Publish error %v", err)
+	}
+	mc.MqttDisconnect()
+	mc.Close()
+	b.Close()
+
+	fs, err = NewFileStore(dir)
+	if err != nil {
+		t.Fatalf("NewFileStore error %s", err)
+	}
+	_, addr = start(t, WithRetainedStore(fs))
+
+	sub := dial(t, addr)
+	sub.connect("sub", vheader.CONNECT_FLAG_CLEAN_SESSION, 0)
+	sub.subscribe("hello/+", 0)
+	sub.expectPublish("hello/mqtt", "The temperature is 10 degrees")
+
+	// A zero-length retained publish clears it
+	sub.publish("hello/mqtt", "", 0, true, 0)
+	other := dial(t, addr)
+	other.connect("other", vheader.CONNECT_FLAG_CLEAN_SESSION, 0)
+	other.subscribe("hello/+", 0)
+	sub.publish("hello/next", "next", 0, false, 0)
+	other.expectPublish("hello/next", "next")
+
+	if messages, _ := fs.Match("#"); len(messages) != 0 {
+		t.Errorf("Retained messages found %d; want 0", len(messages))
+	}
+}
+
+const aclFile = `
+# anonymous clients
+topic read public/#
+
+user alice
+topic alice/#
+topic deny alice/secret
+topic read sensors/+/temperature
+
+user bob
+topic write public/news
+
+pattern readwrite devices/%c/#
+pattern read users/%u
+`
+
+func TestACL(t *testing.T) {
+
+	acl, err := ParseACL(strings.NewReader(aclFile))
+	if err != nil {
+		t.Fatalf("ParseACL error %s", err)
+	}
+
+	anonymous := &ConnectInfo{ClientId: "anon"}
+	alice := &ConnectInfo{ClientId: "a1", Username: "alice", HasUsername: true}
+	bob := &ConnectInfo{ClientId: "b1", Username: "bob", HasUsername: true}
+
+	for _, tc := range []struct {
+		info    *ConnectInfo
+		topic   string
+		access  byte
+		granted bool
+	}{
+		{anonymous, "public/news", ACCESS_READ, true},
+		{anonymous, "public/#", ACCESS_READ, true},
+		{anonymous, "public/news", ACCESS_WRITE, false},
+		{anonymous, "#", ACCESS_READ, false},
+		{alice, "alice/inbox", ACCESS_READWRITE, true},
+		{alice, "alice/+", ACCESS_READ, true},
+		{alice, "alice/secret", ACCESS_READ, false},
+		{alice, "alice/#", ACCESS_READ, true},
+		{alice, "sensors/kitchen/temperature", ACCESS_READ, true},
+		{alice, "sensors/+/temperature", ACCESS_READ, true},
+		{alice, "sensors/#", ACCESS_READ, false},
+		{alice, "sensors/kitchen/temperature", ACCESS_WRITE, false},
+		{alice, "public/news", ACCESS_READ, false},
+		{bob, "public/news", ACCESS_WRITE, true},
+		{bob, "public/news", ACCESS_READ, false},
+		{bob, "devices/b1/state", ACCESS_WRITE, true},
+		{bob, "devices/a1/state", ACCESS_WRITE, false},
+		{bob, "users/bob", ACCESS_READ, true},
+		{anonymous, "devices/anon/state", ACCESS_READ, true},
+		{anonymous, "users/", ACCESS_READ, false},
+	} {
+		if acl.Authorize(tc.info, tc.topic, tc.access) != tc.granted {
+			t.Errorf("Authorize(%s, %s, %d) found %v; want %v", tc.info.ClientId, tc.topic, tc.access, !tc.granted, tc.granted)
+		}
+	}
+
+	for _, invalid := range []string{"user", "topic read sport/#/tennis", "unknown public"} {
+		if _, err := ParseACL(strings.NewReader(invalid)); err == nil {
+			t.Errorf("ParseACL(%s) should fail", invalid)
+		}
+	}
+}
+
+func TestAuthentication(t *testing.T) {
+
+	_, addr := start(t, WithAuthenticator(PasswordAuthenticator{"alice": "secret"}))
+
+	userFlag := vheader.CONNECT_FLAG_CLEAN_SESSION | vheader.CONNECT_FLAG_USERNAME | vheader.CONNECT_FLAG_PASSWORD
+
+	c := dial(t, addr)
+	if connack := c.connect("good", userFlag, 0, "alice", "secret"); connack[1] != header.CONNECT_ACCEPTED {
+		t.Errorf("Return code found %d; want 0", connack[1])
+	}
+
+	c = dial(t, addr)
+	if connack := c.connect("bad", userFlag, 0, "alice", "wrong"); connack[1] != header.CONNECT_REFUSED_4 {
+		t.Errorf("Return code found %d; want 4", connack[1])
+	}
+
+	c = dial(t, addr)
+	if connack := c.connect("anonymous", vheader.CONNECT_FLAG_CLEAN_SESSION, 0); connack[1] != header.CONNECT_REFUSED_5 {
+		t.Errorf("Return code found %d; want 5", connack[1])
+	}
+
+	// A password needs a username
+	c = dial(t, addr)
+	c.write(connectPacket("password", vheader.CONNECT_FLAG_CLEAN_SESSION|vheader.CONNECT_FLAG_PASSWORD, 0, "secret"))
+	c.closed(time.Second)
+}
+
+func TestAuthorization(t *testing.T) {
+
+	acl, err := ParseACL(strings.NewReader(aclFile))
+	if err != nil {
+		t.Fatalf("ParseACL error %s", err)
+	}
+	_, addr := start(t, WithAuthorizer(acl))
+
+	userFlag := vheader.CONNECT_FLAG_CLEAN_SESSION | vheader.CONNECT_FLAG_USERNAME
+
+	alice := dial(t, addr)
+	alice.connect("a1", userFlag, 0, "alice")
+	if granted := alice.subscribe("sensors/#", 0); granted != 0x80 {
+		t.Errorf("Granted QoS found %d; want 0x80", granted)
+	}
+	alice.subscribe("alice/#", 0)
+
+	bob := dial(t, addr)
+	bob.connect("b1", userFlag, 0, "bob")
+
+	// Not allowed to write, acknowledged and dropped
+	bob.publish("alice/inbox", "dropped", 1, false, 1)
+	if puback := bob.read(); puback.Header.Control != header.PUBACK {
+		t.Fatalf("PUBACK expected")
+	}
+
+	anonymous := dial(t, addr)
+	anonymous.connect("anon", vheader.CONNECT_FLAG_CLEAN_SESSION, 0)
+	anonymous.subscribe("public/#", 0)
+
+	bob.publish("public/news", "news", 0, false, 0)
+	anonymous.expectPublish("public/news", "news")
+
+	// The deny rule applies to the messages of a granted filter
+	alice.publish("alice/secret", "denied", 0, false, 0)
+	alice.publish("alice/inbox", "hello", 0, false, 0)
+	alice.expectPublish("alice/inbox", "hello")
+
+	// A will needs the write access
+	c := dial(t, addr)
+	if connack := c.connect("anon2", vheader.CONNECT_FLAG_CLEAN_SESSION|vheader.CONNECT_FLAG_WILL_FLAG, 0, "public/will", "gone"); connack[1] != header.CONNECT_REFUSED_5 {
+		t.Errorf("Return code found %d; want 5", connack[1])
+	}
+}
+
+// Self-signed CA, server certificate for 127.0.0.1 and client certificate
+func certificates(t *testing.T, commonName string) (*x509.CertPool, tls.Certificate, tls.Certificate) {
+	t.Helper()
+
+	issue := func(template *x509.Certificate, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, tls.Certificate, *ecdsa.PrivateKey) {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			t.Fatalf("GenerateKey error %s", err)
+		}
+		if parent == nil {
+			parent, parentKey = template, key
+		}
+		der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+		if err != nil {
+			t.Fatalf("CreateCertificate error %s", err)
+		}
+		cert, _ := x509.ParseCertificate(der)
+		return cert, tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, key
+	}
+
+	validity := func(serial int64, cn string) *x509.Certificate {
+		return &x509.Certificate{
+			SerialNumber: big.NewInt(serial),
+			Subject:      pkix.Name{CommonName: cn},
+			NotBefore:    time.Now().Add(-time.Hour),
+			NotAfter:     time.Now().Add(time.Hour),
+		}
+	}
+
+	caTemplate := validity(1, "test ca")
+	caTemplate.IsCA = true
+	caTemplate.BasicConstraintsValid = true
+	caTemplate.KeyUsage = x509.KeyUsageCertSign
+	ca, _, caKey := issue(caTemplate, nil, nil)
+
+	serverTemplate := validity(2, "server")
+	serverTemplate.IPAddresses = []net.IP{net.ParseIP("127.0.0.1")}
+	serverTemplate.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+	_, server, _ := issue(serverTemplate, ca, caKey)
+
+	clientTemplate := validity(3, commonName)
+	clientTemplate.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}
+	_, client, _ := issue(clientTemplate, ca, caKey)
+
+	pool := x509.NewCertPool()
+	pool.AddCert(ca)
+
+	return pool, server, client
+}
+
+func TestCertificateIdentity(t *testing.T) {
+
+	pool, server, clientCert := certificates(t, "device1")
+
+	l, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{server},
+		ClientCAs:    pool,
+		ClientAuth:   tls.VerifyClientCertIfGiven,
+	})
+	if err != nil {
+		t.Fatalf("Listen error %s", err)
+	}
+
+	acl, _ := ParseACL(strings.NewReader("pattern readwrite devices/%u/#"))
+	b := New(WithCertificateIdentity(), WithAuthorizer(acl))
+	go b.Serve(l)
+	defer b.Close()
+
+	dialTLS := func(certs []tls.Certificate) *testClient {
+		conn, err := tls.Dial("tcp", l.Addr().String(), &tls.Config{RootCAs: pool, Certificates: certs})
+		if err != nil {
+			t.Fatalf("Dial error %s", err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		return &testClient{t: t, conn: conn}
+	}
+
+	c := dialTLS([]tls.Certificate{clientCert})
+	if connack := c.connect("any", vheader.CONNECT_FLAG_CLEAN_SESSION, 0); connack[1] != header.CONNECT_ACCEPTED {
+		t.Fatalf("Return code found %d; want 0", connack[1])
+	}
+	if granted := c.subscribe("devices/device1/#", 1); granted != 1 {
+		t.Errorf("Granted QoS found %d; want 1", granted)
+	}
+	if granted := c.subscribe("devices/device2/#", 1); granted != 0x80 {
+		t.Errorf("Granted QoS found %d; want 0x80", granted)
+	}
+
+	// Without certificate
+	c = dialTLS(nil)
+	if connack := c.connect("none", vheader.CONNECT_FLAG_CLEAN_SESSION, 0); connack[1] != header.CONNECT_REFUSED_5 {
+		t.Errorf("Return code found %d; want 5", connack[1])
+	}
+
+	// A certificate accepted without verification is not an identity
+	_, _, forged := certificates(t, "device1")
+	unverified, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{server},
+		ClientAuth:   tls.RequireAnyClientCert,
+	})
+	if err != nil {
+		t.Fatalf("Listen error %s", err)
+	}
+	go b.Serve(unverified)
+
+	conn, err := tls.Dial("tcp", unverified.Addr().String(), &tls.Config{RootCAs: pool, Certificates: []tls.Certificate{forged}})
+	if err != nil {
+		t.Fatalf("Dial error %s", err)
+	}
+	defer conn.Close()
+	c = &testClient{t: t, conn: conn}
+	if connack := c.connect("forged", vheader.CONNECT_FLAG_CLEAN_SESSION, 0); connack[1] != header.CONNECT_REFUSED_5 {
+		t.Errorf("Return code found %d; want 5", connack[1])
+	}
+}
@@ -0,0 +1,206 @@
+// MIT License
+
+// Copyright (c) 2022 Florent Brusciano
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+package broker
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/easygithdev/mqtt/packet/util"
+	"github.com/easygithdev/mqtt/topic"
+)
+
+// Keep the last retained message of each topic
+type RetainedStore interface {
+	// Keep the message, replacing the one retained for its topic
+	Store(msg *Message) error
+
+	// Remove the message retained for the topic, if any
+	Delete(topic string) error
+
+	// Messages whose topic matches the filter
+	Match(filter string) ([]*Message, error)
+}
+
+/////////////////////////////////////////////////
+// Memory
+/////////////////////////////////////////////////
+
+// Retained messages lost when the process stops
+type MemoryStore struct {
+	mu       sync.RWMutex
+	messages map[string]*Message
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{messages: make(map[string]*Message)}
+}
+
+func (ms *MemoryStore) Store(msg *Message) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	ms.messages[msg.Topic] = msg
+
+	return nil
+}
+
+func (ms *MemoryStore) Delete(topic string) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	delete(ms.messages, topic)
+
+	return nil
+}
+
+func (ms *MemoryStore) Match(filter string) ([]*Message, error) {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+
+	var messages []*Message
+	for name, msg := range ms.messages {
+		if topic.Match(filter, name) {
+			messages = append(messages, msg)
+		}
+	}
+
+	return messages, nil
+}
+
+/////////////////////////////////////////////////
+// Disk
+/////////////////////////////////////////////////
+
+// Extension of the files written by the FileStore
+const RETAINED_FILE_EXT = ".retained"
+
+// Retained messages written in a directory, one file per topic
+// The files are loaded when the store is opened and the messages are served from memory
+type FileStore struct {
+	dir    string
+	memory *MemoryStore
+}
+
+// Open the store, the directory is created if needed
+func NewFileStore(dir string) (*FileStore, error) {
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	fs := &FileStore{dir: dir, memory: NewMemoryStore()}
+
+	files, err := filepath.Glob(filepath.Join(dir, "*"+RETAINED_FILE_EXT))
+	if err != nil {
+		return nil, err
+	}
+
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		msg, err := decodeRetained(data)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", file, err)
+		}
+		fs.memory.Store(msg)
+	}
+
+	return fs, nil
+}
+
+// Topics may contain any character, the file is named after a hash
+func (fs *FileStore) path(topic string) string {
+	sum := sha256.Sum256([]byte(topic))
+	return filepath.Join(fs.dir, hex.EncodeToString(sum[:])+RETAINED_FILE_EXT)
+}
+
+func (fs *FileStore) Store(msg *Message) error {
+
+	// Write then rename, a crash never leaves a partial file
+	path := fs.path(msg.Topic)
+	tmp := path + ".tmp"
+	data, err := encodeRetained(msg)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	return fs.memory.Store(msg)
+}
+
+func (fs *FileStore) Delete(topic string) error {
+
+	if err := os.Remove(fs.path(topic)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	return fs.memory.Delete(topic)
+}
+
+func (fs *FileStore) Match(filter string) ([]*Message, error) {
+	return fs.memory.Match(filter)
+}
+
+// QoS, topic as an encoded string, then the payload
+func encodeRetained(msg *Message) ([]byte, error) {
+	name, err := util.StringEncode(msg.Topic)
+	if err != nil {
+		return nil, err
+	}
+	var data []byte
+	data = append(data, msg.Qos)
+	data = append(data, name...)
+	data = append(data, msg.Payload...)
+	return data, nil
+}
+
+func decodeRetained(data []byte) (*Message, error) {
+
+	if len(data) < 3 || data[0] > MAX_QOS {
+		return nil, fmt.Errorf("invalid retained message")
+	}
+
+	n, topic, err := util.StringDecode(data[1:])
+	if err != nil {
+		return nil, fmt.Errorf("invalid retained message topic: %s", err)
+	}
+
+	return &Message{
+		Topic:   topic,
+		Payload: data[1+n:],
+		Qos:     data[0],
+		Retain:  true,
+	}, nil
+}
@@ -0,0 +1,705 @@
+// MIT License
+
+// Copyright (c) 2022 Florent Brusciano
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+package broker
+
+import (
+	"crypto/tls"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/easygithdev/mqtt/packet"
+	"github.com/easygithdev/mqtt/packet/header"
+	"github.com/easygithdev/mqtt/packet/payload"
+	"github.com/easygithdev/mqtt/packet/util"
+	"github.com/easygithdev/mqtt/packet/vheader"
+	"github.com/easygithdev/mqtt/topic"
+)
+
+// QoS > 0 message sent to a client and waiting for its acknowledgement
+type outgoing struct {
+	msg *Message
+	qos byte
+
+	// PUBREC received, PUBREL sent
+	released bool
+}
+
+// State kept by the broker for a client identifier
+type session struct {
+	clientId string
+	clean    bool
+
+	// subscriptions with their granted QoS by topic filter
+	subscriptions map[string]byte
+
+	// connected client, nil when offline
+	client *client
+
+	// identity of the last connection, checked by the authorizer
+	info *ConnectInfo
+
+	// messages waiting for the client to come back
+	queue []*Message
+
+	inflight map[uint16]*outgoing
+	received map[uint16]bool
+	lastId   uint16
+
+	// packet identifiers of the messages in flight, in the order they were sent
+	order []uint16
+}
+
+func newSession(clientId string, clean bool) *session {
+	return &session{
+		clientId:      clientId,
+		clean:         clean,
+		subscriptions: make(map[string]byte),
+		inflight:      make(map[uint16]*outgoing),
+		received:      make(map[uint16]bool),
+	}
+}
+
+// Next free packet identifier, 0 is not allowed
+func (s *session) nextId() uint16 {
+	for {
+		s.lastId++
+		if s.lastId == 0 {
+			continue
+		}
+		if _, used := s.inflight[s.lastId]; !used {
+			return s.lastId
+		}
+	}
+}
+
+// Keep a message in flight until its acknowledgement
+func (s *session) track(packetId uint16, o *outgoing) {
+	s.inflight[packetId] = o
+	s.order = append(s.order, packetId)
+}
+
+// Forget an acknowledged message
+func (s *session) untrack(packetId uint16) {
+	if _, ok := s.inflight[packetId]; !ok {
+		return
+	}
+	delete(s.inflight, packetId)
+	for i, id := range s.order {
+		if id == packetId {
+			s.order = append(s.order[:i], s.order[i+1:]...)
+			break
+		}
+	}
+}
+
+// Network connection of a client
+type client struct {
+	conn    net.Conn
+	session *session
+	info    *ConnectInfo
+
+	// published if the connection is lost without DISCONNECT
+	will *Message
+
+	writeMu sync.Mutex
+}
+
+func (c *client) write(timeout time.Duration, data []byte) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	c.conn.SetWriteDeadline(time.Now().Add(timeout))
+	_, err := c.conn.Write(data)
+	if err != nil {
+		// The read loop stops and cleans up
+		c.conn.Close()
+	}
+
+	return err
+}
+
+func minQos(a byte, b byte) byte {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// Packet written to a client once the broker lock is released
+type delivery struct {
+	client *client
+	data   []byte
+}
+
+func (b *Broker) send(deliveries []delivery) {
+	for _, d := range deliveries {
+		d.client.write(b.writeTimeout, d.data)
+	}
+}
+
+// Packet made of the packet identifier, encoded without string to check
+func ackPacket(control byte, packetId uint16) []byte {
+	if control == header.PUBREL {
+		control |= 1 << 1
+	}
+	return util.AppendUint16([]byte{control, 2}, packetId)
+}
+
+// The topic of a message read from the retained store or a will is checked by the encoder
+func publishPacket(msg *Message, qos byte, packetId uint16, retain bool, dup bool) ([]byte, error) {
+	mh := header.New(header.WithControl(header.PUBLISH))
+	mh.Control |= qos << 1
+	if retain {
+		mh.Control |= 1
+	}
+	if dup {
+		mh.Control |= 1 << 3
+	}
+
+	mvh := vheader.NewPublishHeader(msg.Topic)
+	mvh.PacketId = packetId
+	mpl := payload.New(payload.WithData(msg.Payload))
+
+	return packet.Encode(packet.NewMqttPacket(mh, packet.WithVariableHeader(mvh), packet.WithPayload(mpl)))
+}
+
+// Serve a client connection until it is closed
+// Use it directly to run the broker in-process, with net.Pipe for example
+func (b *Broker) ServeConn(conn net.Conn) {
+	defer conn.Close()
+
+	// A malformed packet must not take the broker down
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("Connection Error: %s: %v\n", conn.RemoteAddr(), r)
+		}
+	}()
+
+	// The first packet must be a CONNECT
+	conn.SetReadDeadline(time.Now().Add(b.connectTimeout))
+	data, err := packet.Read(conn)
+	if err != nil {
+		return
+	}
+
+	mp := packet.Decode(data)
+	if mp == nil || mp.Header.Control != header.CONNECT {
+		return
+	}
+
+	c, keepAlive := b.connect(conn, mp)
+	if c == nil {
+		return
+	}
+	defer b.disconnect(c)
+
+	for {
+		// The client must send a packet within one and a half times the keep alive
+		deadline := time.Time{}
+		if keepAlive > 0 {
+			deadline = time.Now().Add(time.Duration(keepAlive) * time.Second * 3 / 2)
+		}
+		conn.SetReadDeadline(deadline)
+
+		data, err := packet.Read(conn)
+		if err != nil {
+			return
+		}
+
+		mp := packet.Decode(data)
+		if mp == nil {
+			return
+		}
+
+		if !b.handle(c, mp, data) {
+			return
+		}
+	}
+}
+
+// Handle the CONNECT, return nil if the connection must be closed
+func (b *Broker) connect(conn net.Conn, mp *packet.MqttPacket) (*client, uint16) {
+
+	vh := mp.VariableHeader.(*vheader.ConnectHeader)
+	strs := mp.Payload.Payload
+
+	connack := func(sessionPresent bool, rc byte) {
+		conn.SetWriteDeadline(time.Now().Add(b.writeTimeout))
+		data, err := (&packet.Connack{SessionPresent: sessionPresent, ReturnCode: rc}).Encode()
+		if err != nil {
+			log.Printf("Connack Error: %s\n", err)
+			return
+		}
+		conn.Write(data)
+	}
+
+	v31 := vh.ProtocolName == "MQIsdp" && vh.ProtocolVersion == 3
+	v311 := vh.ProtocolName == "MQTT" && vh.ProtocolVersion == 4
+	if !v31 && !v311 {
+		connack(false, header.CONNECT_REFUSED_1)
+		return nil, 0
+	}
+
+	// The reserved flag must be 0
+	if vh.Flag&0x01 != 0 {
+		return nil, 0
+	}
+
+	clean := vh.Flag&vheader.CONNECT_FLAG_CLEAN_SESSION != 0
+	clientId := strs[0]
+
+	if clientId == "" {
+		if !clean || v31 {
+			connack(false, header.CONNECT_REFUSED_2)
+			return nil, 0
+		}
+		clientId = fmt.Sprintf("auto-%p", conn)
+	}
+
+	if v31 && len(clientId) > 23 {
+		connack(false, header.CONNECT_REFUSED_2)
+		return nil, 0
+	}
+
+	info := &ConnectInfo{ClientId: clientId, RemoteAddr: conn.RemoteAddr()}
+	c := &client{conn: conn, info: info}
+
+	// Client identifier, will topic and message, username, password
+	next := 1
+	if vh.Flag&vheader.CONNECT_FLAG_WILL_FLAG != 0 {
+		qos := (vh.Flag >> 3) & 0x03
+		if qos > 2 || topic.ValidateName(strs[1]) != nil {
+			return nil, 0
+		}
+		c.will = &Message{
+			Topic:   strs[1],
+			Payload: []byte(strs[2]),
+			Qos:     qos,
+			Retain:  vh.Flag&vheader.CONNECT_FLAG_WILL_RETAIN != 0,
+		}
+		next += 2
+	}
+	if vh.Flag&vheader.CONNECT_FLAG_USERNAME != 0 {
+		info.Username = strs[next]
+		info.HasUsername = true
+		next++
+	} else if vh.Flag&vheader.CONNECT_FLAG_PASSWORD != 0 {
+		// A password without username is a protocol violation
+		return nil, 0
+	}
+	if vh.Flag&vheader.CONNECT_FLAG_PASSWORD != 0 {
+		info.Password = strs[next]
+		info.HasPassword = true
+	}
+
+	// The TLS handshake is done by the first read, a certificate the TLS configuration
+	// does not verify (RequestClientCert, RequireAnyClientCert) is ignored
+	if tc, ok := conn.(*tls.Conn); ok {
+		if chains := tc.ConnectionState().VerifiedChains; len(chains) > 0 && len(chains[0]) > 0 {
+			info.Certificate = chains[0][0]
+		}
+	}
+
+	if b.certificateIdentity {
+		if info.Certificate == nil {
+			connack(false, header.CONNECT_REFUSED_5)
+			return nil, 0
+		}
+		info.Username = info.Certificate.Subject.CommonName
+		info.HasUsername = true
+	}
+
+	if b.authenticator != nil && !b.authenticator.Authenticate(info) {
+		if info.HasUsername || info.HasPassword {
+			connack(false, header.CONNECT_REFUSED_4)
+		} else {
+			connack(false, header.CONNECT_REFUSED_5)
+		}
+		return nil, 0
+	}
+
+	// The will is published with the rights of the client
+	if c.will != nil && !b.authorized(info, c.will.Topic, ACCESS_WRITE) {
+		connack(false, header.CONNECT_REFUSED_5)
+		return nil, 0
+	}
+
+	b.mu.Lock()
+
+	if b.closed {
+		b.mu.Unlock()
+		return nil, 0
+	}
+
+	// An existing connection with the same identifier is closed
+	var takenOver *client
+	s, exists := b.sessions[clientId]
+	if exists && s.client != nil {
+		takenOver = s.client
+	}
+
+	sessionPresent := false
+	if clean || !exists {
+		if exists {
+			b.forget(s)
+		}
+		s = newSession(clientId, clean)
+		b.sessions[clientId] = s
+	} else {
+		sessionPresent = true
+	}
+	s.clean = clean
+	s.client = c
+	s.info = info
+	c.session = s
+	b.clients[c] = true
+
+	// Resend the unacknowledged messages in their original order, then the queued ones
+	var resend [][]byte
+	for _, id := range s.order {
+		o := s.inflight[id]
+		if o.released {
+			resend = append(resend, ackPacket(header.PUBREL, id))
+			continue
+		}
+		data, err := publishPacket(o.msg, o.qos, id, false, true)
+		if err != nil {
+			log.Printf("Publish Error: %s\n", err)
+			continue
+		}
+		resend = append(resend, data)
+	}
+	for _, msg := range s.queue {
+		id := s.nextId()
+		data, err := publishPacket(msg, msg.Qos, id, false, false)
+		if err != nil {
+			log.Printf("Publish Error: %s\n", err)
+			continue
+		}
+		s.track(id, &outgoing{msg: msg, qos: msg.Qos})
+		resend = append(resend, data)
+	}
+	s.queue = nil
+
+	b.mu.Unlock()
+
+	if takenOver != nil {
+		takenOver.conn.Close()
+	}
+
+	// MQTT 3.1 has no session present flag
+	if v31 {
+		sessionPresent = false
+	}
+	connack(sessionPresent, header.CONNECT_ACCEPTED)
+
+	for _, data := range resend {
+		c.write(b.writeTimeout, data)
+	}
+
+	return c, vh.KeepAlive
+}
+
+// The connection is closed, publish the will and forget a clean session
+func (b *Broker) disconnect(c *client) {
+
+	b.mu.Lock()
+	s := c.session
+	delete(b.clients, c)
+	if s.client == c {
+		s.client = nil
+		if s.clean && b.sessions[s.clientId] == s {
+			delete(b.sessions, s.clientId)
+			b.forget(s)
+		}
+	}
+	will := c.will
+	b.mu.Unlock()
+
+	if will != nil {
+		b.publish(will)
+	}
+}
+
+// Handle a packet sent by a connected client
+// Return false if the connection must be closed
+func (b *Broker) handle(c *client, mp *packet.MqttPacket, data []byte) bool {
+
+	s := c.session
+	control := mp.Header.Control
+
+	switch control & 0xF0 {
+
+	case header.PUBLISH:
+		qos := (control >> 1) & 0x03
+		vh := mp.VariableHeader.(*vheader.PublishHeader)
+		if qos > 2 || topic.ValidateName(vh.TopicName) != nil {
+			return false
+		}
+
+		msg := &Message{
+			Topic:   vh.TopicName,
+			Payload: mp.Payload.Data,
+			Qos:     qos,
+			Retain:  control&0x01 != 0,
+		}
+
+		// A refused message is acknowledged but dropped, MQTT 3.1.1 cannot tell the client
+		allowed := b.authorized(c.info, msg.Topic, ACCESS_WRITE)
+
+		switch qos {
+		case 0:
+			if allowed {
+				b.publish(msg)
+			}
+		case 1:
+			if allowed {
+				b.publish(msg)
+			}
+			c.write(b.writeTimeout, ackPacket(header.PUBACK, vh.PacketId))
+		case 2:
+			// Deliver once, the client may send the PUBLISH again before the PUBREC
+			b.mu.Lock()
+			dup := s.received[vh.PacketId]
+			s.received[vh.PacketId] = true
+			b.mu.Unlock()
+			if !dup && allowed {
+				b.publish(msg)
+			}
+			c.write(b.writeTimeout, ackPacket(header.PUBREC, vh.PacketId))
+		}
+
+	case header.PUBREL:
+		id := mp.VariableHeader.(*vheader.PacketIdHeader).PacketId
+		b.mu.Lock()
+		delete(s.received, id)
+		b.mu.Unlock()
+		c.write(b.writeTimeout, ackPacket(header.PUBCOMP, id))
+
+	case header.PUBACK, header.PUBCOMP:
+		id := mp.VariableHeader.(*vheader.PacketIdHeader).PacketId
+		b.mu.Lock()
+		s.untrack(id)
+		b.mu.Unlock()
+
+	case header.PUBREC:
+		id := mp.VariableHeader.(*vheader.PacketIdHeader).PacketId
+		b.mu.Lock()
+		if o, ok := s.inflight[id]; ok {
+			o.released = true
+		}
+		b.mu.Unlock()
+		c.write(b.writeTimeout, ackPacket(header.PUBREL, id))
+
+	case header.SUBSCRIBE:
+		if control != header.SUBSCRIBE|1<<1 {
+			return false
+		}
+		return b.subscribe(c, mp, data)
+
+	case header.UNSUBSCRIBE:
+		if control != header.UNSUBSCRIBE|1<<1 || len(mp.Payload.Payload) == 0 {
+			return false
+		}
+		b.mu.Lock()
+		for _, filter := range mp.Payload.Payload {
+			delete(s.subscriptions, filter)
+			b.subscriptions.Remove(filter, s)
+		}
+		b.mu.Unlock()
+		id := mp.VariableHeader.(*vheader.PacketIdHeader).PacketId
+		c.write(b.writeTimeout, ackPacket(header.UNSUBACK, id))
+
+	case header.PINGREQ:
+		c.write(b.writeTimeout, []byte{header.PINGRESP, 0})
+
+	case header.DISCONNECT:
+		// Normal disconnection, the will is discarded
+		c.will = nil
+		return false
+
+	default:
+		// CONNECT sent twice or packet sent by a server
+		return false
+	}
+
+	return true
+}
+
+// Remove the subscriptions of a session from the topic trie
+func (b *Broker) forget(s *session) {
+	for filter := range s.subscriptions {
+		b.subscriptions.Remove(filter, s)
+	}
+}
+
+// Handle a SUBSCRIBE, the topic filters follow the packet identifier
+func (b *Broker) subscribe(c *client, mp *packet.MqttPacket, data []byte) bool {
+
+	id := mp.VariableHeader.(*vheader.PacketIdHeader).PacketId
+	body := data[mp.Header.Len()+2:]
+	if len(body) == 0 {
+		return false
+	}
+
+	var filters []string
+	var qoss []byte
+	for len(body) > 0 {
+		n, filter, err := util.StringDecode(body)
+		if err != nil || len(body) < n+1 {
+			return false
+		}
+		qos := body[n]
+		if qos&0xFC != 0 {
+			return false
+		}
+		body = body[n+1:]
+		filters = append(filters, filter)
+		qos = minQos(qos, MAX_QOS)
+		qoss = append(qoss, qos)
+	}
+
+	s := c.session
+	codes := make([]byte, len(filters))
+	var retained [][]byte
+
+	b.mu.Lock()
+	for i, filter := range filters {
+		if topic.ValidateFilter(filter) != nil || !b.authorized(c.info, filter, ACCESS_READ) {
+			codes[i] = 0x80
+			continue
+		}
+		codes[i] = qoss[i]
+		s.subscriptions[filter] = qoss[i]
+		b.subscriptions.Insert(filter, s, qoss[i])
+
+		// The retained messages are sent with the retain flag
+		messages, err := b.retained.Match(filter)
+		if err != nil {
+			log.Printf("Retained Error: %s\n", err)
+		}
+		for _, msg := range messages {
+			if !b.authorized(c.info, msg.Topic, ACCESS_READ) {
+				continue
+			}
+			qos := minQos(msg.Qos, qoss[i])
+			var packetId uint16
+			if qos > 0 {
+				packetId = s.nextId()
+			}
+			data, err := publishPacket(msg, qos, packetId, true, false)
+			if err != nil {
+				log.Printf("Retained Error: %s\n", err)
+				continue
+			}
+			if qos > 0 {
+				s.track(packetId, &outgoing{msg: msg, qos: qos})
+			}
+			retained = append(retained, data)
+		}
+	}
+	b.mu.Unlock()
+
+	suback, err := (&packet.Suback{PacketID: id, ReturnCodes: codes}).Encode()
+	if err == nil {
+		err = c.write(b.writeTimeout, suback)
+	}
+	if err != nil {
+		return false
+	}
+
+	for _, data := range retained {
+		c.write(b.writeTimeout, data)
+	}
+
+	return true
+}
+
+// Route a message to the matching subscriptions and keep it if retained
+func (b *Broker) publish(msg *Message) {
+
+	var deliveries []delivery
+
+	b.mu.Lock()
+
+	if msg.Retain {
+		// A retained message with an empty payload removes the retained message
+		var err error
+		if len(msg.Payload) == 0 {
+			err = b.retained.Delete(msg.Topic)
+		} else {
+			err = b.retained.Store(msg)
+		}
+		if err != nil {
+			log.Printf("Retained Error: %s\n", err)
+		}
+	}
+
+	// The highest QoS of the matching subscriptions of each session
+	granted := make(map[*session]byte)
+	for _, e := range b.subscriptions.Match(msg.Topic) {
+		s := e.Id.(*session)
+		if qos, ok := granted[s]; !ok || e.Qos > qos {
+			granted[s] = e.Qos
+		}
+	}
+
+	for s, maxQos := range granted {
+
+		if !b.authorized(s.info, msg.Topic, ACCESS_READ) {
+			continue
+		}
+
+		qos := minQos(msg.Qos, maxQos)
+
+		if s.client == nil {
+			if qos > 0 && !s.clean {
+				if len(s.queue) >= b.maxQueuedMessages {
+					s.queue = s.queue[1:]
+				}
+				s.queue = append(s.queue, &Message{Topic: msg.Topic, Payload: msg.Payload, Qos: qos})
+			}
+			continue
+		}
+
+		var packetId uint16
+		if qos > 0 {
+			packetId = s.nextId()
+		}
+		data, err := publishPacket(msg, qos, packetId, false, false)
+		if err != nil {
+			log.Printf("Publish Error: %s\n", err)
+			continue
+		}
+		if qos > 0 {
+			s.track(packetId, &outgoing{msg: msg, qos: qos})
+		}
+		deliveries = append(deliveries, delivery{client: s.client, data: data})
+	}
+
+	b.mu.Unlock()
+
+	b.send(deliveries)
+}
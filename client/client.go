@@ -23,23 +23,32 @@ package client
 
 import (
 	"bytes"
+	"context"
+	"errors"
 	"fmt"
-	"io"
-	"log"
 	"math"
 	"math/rand"
 	"net"
+	"strings"
+	"sync"
 	"time"
 
+	"github.com/easygithdev/mqtt/auth"
 	"github.com/easygithdev/mqtt/client/conn"
 	"github.com/easygithdev/mqtt/client/credentials"
+	"github.com/easygithdev/mqtt/client/logger"
+	"github.com/easygithdev/mqtt/client/metrics"
 	"github.com/easygithdev/mqtt/client/protocol"
 	"github.com/easygithdev/mqtt/client/subscription"
+	"github.com/easygithdev/mqtt/client/tracing"
 	"github.com/easygithdev/mqtt/packet"
 	"github.com/easygithdev/mqtt/packet/header"
 	"github.com/easygithdev/mqtt/packet/payload"
+	"github.com/easygithdev/mqtt/packet/property"
+	"github.com/easygithdev/mqtt/packet/reason"
 	"github.com/easygithdev/mqtt/packet/util"
 	"github.com/easygithdev/mqtt/packet/vheader"
+	mqtttopic "github.com/easygithdev/mqtt/topic"
 )
 
 // Fixed size for the read buffer
@@ -53,12 +62,67 @@ const QOS_2 = 0x02
 // Default clean session for connect in variable Header
 var CLEAN_SESSION bool = true
 
+// MQTT 5 session expiry interval meaning the session does not expire
+const SESSION_EXPIRY_NEVER uint32 = 0xFFFFFFFF
+
+// Returned when a packet exceeds the maximum packet size of the receiver
+var ErrPacketTooLarge = packet.ErrPacketTooLarge
+
+// Returned by a non blocking publish when the receive maximum of the server is reached
+var ErrReceiveMaximumExceeded = errors.New("receive maximum exceeded")
+
+// Returned by Loop when the server closes the session with a DISCONNECT
+var ErrServerDisconnect = errors.New("disconnected by the server")
+
+// Returned when the SUBACK refuses a topic filter (return code 0x80 or above)
+var ErrSubscriptionFailed = errors.New("subscription refused by the server")
+
+// Returned when the client has no network connection
+var ErrNotConnected = errors.New("not connected")
+
+// Returned by the publishes and the loops once Shutdown is called
+var ErrClientClosed = errors.New("client shut down")
+
+// Returned by Shutdown when messages in flight kept for the session are dropped
+var ErrMessagesDropped = errors.New("messages in flight dropped")
+
 // Define the Mqtt client
+// A client is safe for concurrent use: Loop may run while other goroutines publish,
+// subscribe or ping, the packets read by one goroutine are handed to the goroutine
+// waiting for them
 type MqttClient struct {
 	// Connection
 	conn      *net.Conn
 	connInfos *conn.MqttConn
 
+	// Guards the state shared by the goroutines using the client
+	mu sync.Mutex
+
+	// One packet written at a time
+	writeMu sync.Mutex
+
+	// One MQTT connection at a time
+	connectMu sync.Mutex
+
+	// Token of the goroutine reading the connection, the responses it reads
+	// are given to the goroutines waiting for them
+	reader  chan struct{}
+	waiters map[response][]chan []byte
+
+	// Closed by Shutdown: no more publishes nor connections, the loops return
+	stop chan struct{}
+
+	// Publishes in progress and channel closed once they and the messages
+	// in flight are done, while Shutdown waits for them
+	publishes int
+	drain     chan struct{}
+
+	// Loops running, Shutdown waits for them to return
+	loops sync.WaitGroup
+
+	// LoopForever running, a lost connection is then reconnecting
+	forever int
+
 	// Credentials
 	credentials *credentials.MqttCredentials
 
@@ -68,29 +132,149 @@ type MqttClient struct {
 	userData     interface{}
 	protocol     *protocol.MqttProtocol
 
+	// MQTT 5 enhanced authentication
+	authenticator auth.Authenticator
+
+	// MQTT 5 properties received with the CONNACK
+	serverProperties *property.Properties
+
+	// MQTT 5 session expiry interval wanted and the one in use for the session
+	sessionExpiry           uint32
+	negotiatedSessionExpiry uint32
+
+	// MQTT 5 server redirection
+	followRedirect bool
+
+	// Try older protocol versions when the server refuses the one in use
+	protocolFallback bool
+
+	// Flow control, limits advertised to the server (0 means no limit)
+	receiveMaximum    uint16
+	maximumPacketSize uint32
+
+	// Flow control, limits of the server from the CONNACK or configured
+	serverReceiveMaximum    uint16
+	serverMaximumPacketSize uint32
+	publishNoWait           bool
+
+	// One slot per QoS > 0 publish waiting for its acknowledgement, and channel
+	// closed when the window is replaced to wake the publishes waiting for a slot
+	inflight      chan struct{}
+	inflightReset chan struct{}
+
+	// QoS 2 messages received and waiting for their PUBREL
+	received map[uint16]bool
+
+	// QoS > 0 messages sent and not acknowledged yet, sent again when the session is resumed
+	pending []*outgoing
+
+	// Session Present flag of the last CONNACK
+	sessionPresent bool
+
+	// Subscribe again after a reconnection even when the server kept the session
+	forceResubscribe bool
+
+	// MQTT 5 reason of the last disconnection sent by the server
+	disconnectReason     byte
+	disconnectProperties *property.Properties
+
+	// Logger of the client, the packet dumps are written at debug level
+	logger logger.Logger
+
+	// Events counted for monitoring, discarded by default
+	metrics metrics.Metrics
+
+	// Spans of the messages, the trace context is sent in a MQTT 5 user property
+	// or in the payload envelope before MQTT 5
+	tracer   tracing.Tracer
+	envelope tracing.Envelope
+
 	// behaviours
-	mqttConnected bool
+	state         State
+	stateHandlers map[string]StateHandler
 
 	// subcription list
 	subscribed subscription.Subscriptions
 
-	// callbacks
-	OnConnect     func(mc MqttClient, userData interface{}, rc net.Conn)
-	OnDisconnect  func(mc MqttClient, userData interface{}, rc net.Conn)
-	OnPublish     func(mc MqttClient, userData interface{}, mid uint16)
-	OnSubscribe   func(mc MqttClient, userData interface{}, mid uint16)
-	OnUnsubscribe func(mc MqttClient, userData interface{}, mid uint16)
-	OnMessage     func(mc MqttClient, userData interface{}, message string)
+	// message handlers by MQTT 5 subscription identifier
+	handlers map[int]MessageHandler
+
+	// message handlers by topic filter, matched with the router
+	topicHandlers map[string]MessageHandler
+	router        *mqtttopic.Trie
+
+	// callbacks, set them before using the client
+	// They are called by the goroutine which read the packet, without any lock held
+	OnConnect     func(mc *MqttClient, userData interface{}, rc net.Conn, sessionPresent bool)
+	OnDisconnect  func(mc *MqttClient, userData interface{}, rc net.Conn)
+	OnPublish     func(mc *MqttClient, userData interface{}, mid uint16)
+	OnSubscribe   func(mc *MqttClient, userData interface{}, mid uint16, grantedQos []byte)
+	OnUnsubscribe func(mc *MqttClient, userData interface{}, mid uint16)
+	OnMessage     func(mc *MqttClient, userData interface{}, message string)
+
+	// Called before OnMessage with the topic and flags of the message
+	OnMessageReceived func(mc *MqttClient, userData interface{}, message *Message)
+
+	// Middlewares wrapping the publish and the delivery of the messages
+	publishMiddlewares []PublishMiddleware
+	receiveMiddlewares []ReceiveMiddleware
+
+	// Called for every packet written to and read from the connection
+	// OnPacketSent is called with the write lock held, in the order of the wire, it must not write
+	// OnPacketReceived is called by the reading goroutine, it must not wait for a response
+	OnPacketSent     func(mc *MqttClient, userData interface{}, trace *PacketTrace)
+	OnPacketReceived func(mc *MqttClient, userData interface{}, trace *PacketTrace)
 }
 
 type ClientOption func(f *MqttClient)
 
+type MessageHandler func(mc *MqttClient, userData interface{}, message string)
+
+// Application message received from the server
+type Message struct {
+	Topic   string
+	Payload string
+	Qos     byte
+	Retain  bool
+
+	// MQTT 5 properties, nil otherwise
+	Properties *property.Properties
+
+	// W3C traceparent of the receive span, "" without tracer
+	TraceParent string
+}
+
+// Packet written or read by the client
+type PacketTrace struct {
+	// Decoded packet, nil when it can not be decoded (AUTH)
+	Packet *packet.MqttPacket
+
+	// Bytes on the wire, a copy the hook may keep
+	Data []byte
+
+	// Time the packet was written or read
+	Time time.Time
+}
+
+// Response a goroutine waits for: control packet type and packet identifier
+type response struct {
+	control  byte
+	packetId uint16
+}
+
 func WithCleanSession(cleanSession bool) ClientOption {
 	return func(mc *MqttClient) {
 		mc.cleanSession = cleanSession
 	}
 }
 
+// Subscribe again after a reconnection even when the server kept the session
+func WithForceResubscribe(force bool) ClientOption {
+	return func(mc *MqttClient) {
+		mc.forceResubscribe = force
+	}
+}
+
 func WithUserData(userData interface{}) ClientOption {
 	return func(mc *MqttClient) {
 		mc.userData = userData
@@ -103,6 +287,14 @@ func WithProtocol(name string, level byte) ClientOption {
 	}
 }
 
+// Negotiate the protocol: start with the configured version and fall back
+// 5 -> 3.1.1 -> 3.1 while the server answers unacceptable protocol version
+func WithProtocolFallback() ClientOption {
+	return func(mc *MqttClient) {
+		mc.protocolFallback = true
+	}
+}
+
 func WithCredentials(login string, password string) ClientOption {
 	return func(mc *MqttClient) {
 		mc.credentials = credentials.New(login, password)
@@ -115,15 +307,113 @@ func WithConnInfos(connInfos *conn.MqttConn) ClientOption {
 	}
 }
 
+// MQTT 5 session expiry interval in seconds, 0 ends the session with the connection
+func WithSessionExpiry(seconds uint32) ClientOption {
+	return func(mc *MqttClient) {
+		mc.sessionExpiry = seconds
+	}
+}
+
+// Connect to the server given by a MQTT 5 server reference
+// when the server answers use another server or server moved
+func WithFollowRedirect() ClientOption {
+	return func(mc *MqttClient) {
+		mc.followRedirect = true
+	}
+}
+
+// Number of QoS > 0 messages the client accepts to process at once
+// It is advertised to a MQTT 5 server
+func WithReceiveMaximum(max uint16) ClientOption {
+	return func(mc *MqttClient) {
+		mc.receiveMaximum = max
+	}
+}
+
+// Largest packet the client accepts, bigger packets are rejected
+// It is advertised to a MQTT 5 server
+func WithMaximumPacketSize(max uint32) ClientOption {
+	return func(mc *MqttClient) {
+		mc.maximumPacketSize = max
+	}
+}
+
+// Limits of the server when it can not advertise them (MQTT 3.1.1)
+// A MQTT 5 server overrides them in the CONNACK, 0 means no limit
+func WithServerLimits(receiveMaximum uint16, maximumPacketSize uint32) ClientOption {
+	return func(mc *MqttClient) {
+		mc.serverReceiveMaximum = receiveMaximum
+		mc.serverMaximumPacketSize = maximumPacketSize
+	}
+}
+
+// Fail with ErrReceiveMaximumExceeded instead of waiting for an acknowledgement
+// when the receive maximum of the server is reached
+func WithPublishNoWait() ClientOption {
+	return func(mc *MqttClient) {
+		mc.publishNoWait = true
+	}
+}
+
+// Use MQTT 5 enhanced authentication, the protocol level must be 5
+func WithAuthenticator(authenticator auth.Authenticator) ClientOption {
+	return func(mc *MqttClient) {
+		mc.authenticator = authenticator
+	}
+}
+
+// Logger of the client instead of the global logger at info level
+// logger.Discard() silences the client without silencing the application
+func WithLogger(l logger.Logger) ClientOption {
+	return func(mc *MqttClient) {
+		mc.logger = l
+	}
+}
+
+// Report the events of the client, a metrics.Registry exposes them to Prometheus
+func WithMetrics(m metrics.Metrics) ClientOption {
+	return func(mc *MqttClient) {
+		if m == nil {
+			m = metrics.Discard()
+		}
+		mc.metrics = m
+	}
+}
+
+// Start a span for each message published or received and propagate the W3C trace context
+func WithTracer(tracer tracing.Tracer) ClientOption {
+	return func(mc *MqttClient) {
+		mc.tracer = tracer
+	}
+}
+
+// Carry the trace context in the payload before MQTT 5, which has no user property
+func WithTraceEnvelope(envelope tracing.Envelope) ClientOption {
+	return func(mc *MqttClient) {
+		mc.envelope = envelope
+	}
+}
+
 // client_id=””, clean_session=True, userdata=None, protocol=MQTTv311)
 func New(clientId string, opts ...ClientOption) *MqttClient {
 	mc := &MqttClient{
-		conn:         nil,
-		clientId:     clientId,
-		cleanSession: CLEAN_SESSION,
-		userData:     nil,
-		protocol:     protocol.New(protocol.PROTOCOL_NAME, protocol.PROTOCOL_LEVEL),
-		subscribed:   make(subscription.Subscriptions, 10),
+		conn:          nil,
+		reader:        make(chan struct{}, 1),
+		waiters:       make(map[response][]chan []byte),
+		stop:          make(chan struct{}),
+		state:         STATE_DISCONNECTED,
+		stateHandlers: make(map[string]StateHandler),
+		clientId:      clientId,
+		cleanSession:  CLEAN_SESSION,
+		userData:      nil,
+		protocol:      protocol.New(protocol.PROTOCOL_NAME, protocol.PROTOCOL_LEVEL),
+		subscribed:    make(subscription.Subscriptions, 10),
+		handlers:      make(map[int]MessageHandler),
+		topicHandlers: make(map[string]MessageHandler),
+		router:        mqtttopic.NewTrie(),
+		received:      make(map[uint16]bool),
+		logger:        logger.Default(),
+		metrics:       metrics.Discard(),
 	}
 
 	for _, applyOpt := range opts {
@@ -135,49 +425,703 @@ func New(clientId string, opts ...ClientOption) *MqttClient {
 	return mc
 }
 
+func (mc *MqttClient) log(level logger.Level, msg string, keyvals ...interface{}) {
+	if mc.logger != nil {
+		mc.logger.Log(level, msg, keyvals...)
+	}
+}
+
+// Value formatted only when the logger writes it
+type lazy func() string
+
+func (l lazy) String() string {
+	return l()
+}
+
+// Dump the packet at debug level
 func (mc *MqttClient) ShowPacket(mp *packet.MqttPacket) {
-	log.Printf("\n%s\n\n", mp)
+	mc.log(logger.DEBUG, "packet", "packet", lazy(func() string { return "\n" + mp.String() }))
+}
+
+func (mc *MqttClient) showParsed(p packet.Packet) {
+	mc.log(logger.DEBUG, "packet", "packet", lazy(func() string {
+		return fmt.Sprintf("\n%s %+v", header.ControlToString(p.Type()), p)
+	}))
 }
 
 func (mc *MqttClient) Connect() (bool, error) {
 
-	conn, err := net.Dial(mc.connInfos.Transport, mc.connInfos.Host+":"+mc.connInfos.Port)
+	mc.setState(STATE_DIALING)
+
+	connInfos := mc.infos()
+	conn, err := net.Dial(connInfos.Transport, connInfos.Host+":"+connInfos.Port)
 
 	if err != nil {
-		log.Println("Error connecting:", err.Error())
+		mc.log(logger.ERROR, "connection failed", "err", err)
+		mc.setState(mc.idleState())
 		return false, err
 	}
+
+	mc.mu.Lock()
+	// Shutdown closes the connection in use, not the new one
+	if mc.stopped() {
+		mc.mu.Unlock()
+		conn.Close()
+		return false, ErrClientClosed
+	}
 	mc.conn = &conn
+	mc.mu.Unlock()
+
+	mc.setState(STATE_CONNECTING)
 
 	return true, nil
 }
 
+// Close the network connection, the MQTT connection ends with it
 func (mc *MqttClient) Close() {
-	(*mc.conn).Close()
+	mc.mu.Lock()
+	c := mc.conn
+	// Nothing in flight can be acknowledged anymore
+	if mc.drain != nil {
+		close(mc.drain)
+		mc.drain = nil
+	}
+	mc.mu.Unlock()
+
+	if c != nil {
+		(*c).Close()
+	}
+
+	mc.setState(mc.idleState())
+}
+
+// State without connection, reconnecting while LoopForever runs until Shutdown
+func (mc *MqttClient) idleState() State {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	if mc.forever > 0 && !mc.stopped() {
+		return STATE_RECONNECTING
+	}
+	return STATE_DISCONNECTED
 }
 
+// Stop publishing and wait for the acknowledgements of the messages in flight
+// until the context is done, then send the DISCONNECT, close the connection and
+// wait for the loops to return
+// The publishes waiting for a slot of the in-flight window fail with ErrClientClosed
+// Return the context error if the messages in flight or the loops were abandoned,
+// ErrMessagesDropped if messages kept while disconnected were dropped
+func (mc *MqttClient) Shutdown(ctx context.Context) error {
+
+	mc.mu.Lock()
+	if mc.stopped() {
+		mc.mu.Unlock()
+		return nil
+	}
+	close(mc.stop)
+	drain := mc.drainChannel()
+	connected := mc.state.connected()
+	mc.mu.Unlock()
+
+	if connected {
+		mc.setState(STATE_DISCONNECTING)
+	}
+
+	// The acknowledgements are read by Loop or by the goroutines publishing
+	var err error
+	if drain != nil {
+		select {
+		case <-drain:
+		case <-ctx.Done():
+			err = ctx.Err()
+		}
+	}
+
+	// The messages still in flight, or kept while disconnected to be sent again
+	// when the session is resumed, are dropped with their slots
+	mc.mu.Lock()
+	mc.drain = nil
+	dropped := len(mc.pending)
+	if dropped > 0 {
+		mc.log(logger.WARN, "shutdown, messages in flight dropped", "count", dropped)
+		for _, o := range mc.pending {
+			releaseInflight(o.window)
+		}
+		mc.pending = nil
+		mc.metrics.InFlight(0)
+	}
+	mc.mu.Unlock()
+
+	if dropped > 0 && err == nil {
+		err = fmt.Errorf("%w: %d message(s)", ErrMessagesDropped, dropped)
+	}
+
+	if _, disconnectErr := mc.MqttDisconnect(); disconnectErr != nil && err == nil {
+		err = disconnectErr
+	}
+	mc.Close()
+
+	stopped := make(chan struct{})
+	go func() {
+		mc.loops.Wait()
+		close(stopped)
+	}()
+
+	select {
+	case <-stopped:
+	case <-ctx.Done():
+		mc.log(logger.WARN, "shutdown, loops still running")
+		if err == nil {
+			err = ctx.Err()
+		}
+	}
+
+	mc.setState(STATE_CLOSED)
+
+	return err
+}
+
+// True once Shutdown is called
+func (mc *MqttClient) stopped() bool {
+	select {
+	case <-mc.stop:
+		return true
+	default:
+		return false
+	}
+}
+
+// Channel closed once the publishes in progress and the messages in flight are done,
+// nil if there are none, mu must be held
+func (mc *MqttClient) drainChannel() chan struct{} {
+	if mc.publishes == 0 && len(mc.pending) == 0 {
+		return nil
+	}
+	if !mc.state.connected() {
+		return nil
+	}
+	mc.drain = make(chan struct{})
+	return mc.drain
+}
+
+// Close the drain channel if nothing is left in flight, mu must be held
+func (mc *MqttClient) drained() {
+	if mc.drain != nil && mc.publishes == 0 && len(mc.pending) == 0 {
+		close(mc.drain)
+		mc.drain = nil
+	}
+}
+
+// Count a publish in progress, refused once Shutdown is called
+func (mc *MqttClient) startPublish() error {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+
+	if mc.stopped() {
+		return ErrClientClosed
+	}
+	mc.publishes++
+
+	return nil
+}
+
+func (mc *MqttClient) endPublish() {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+
+	mc.publishes--
+	mc.drained()
+}
+
+// Count a running loop, refused once Shutdown is called
+func (mc *MqttClient) startLoop() bool {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+
+	if mc.stopped() {
+		return false
+	}
+	mc.loops.Add(1)
+
+	return true
+}
+
+// Network connection in use, nil before Connect
+func (mc *MqttClient) netConn() net.Conn {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+
+	if mc.conn == nil {
+		return nil
+	}
+	return *mc.conn
+}
+
+// Connection infos in use, they may change after a redirection or a CONNACK
+func (mc *MqttClient) infos() *conn.MqttConn {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	return mc.connInfos
+}
+
+// True once the server accepted the connection, until the DISCONNECT
+func (mc *MqttClient) isConnected() bool {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	return mc.state.connected()
+}
+
+// Read one control packet
 func (mc *MqttClient) Read() (*bytes.Buffer, error) {
-	readBuffer := make([]byte, READ_BUFFER_SISE)
-	n, readErr := (*mc.conn).Read(readBuffer)
+	c := mc.netConn()
+	if c == nil {
+		return nil, ErrNotConnected
+	}
+
+	data, readErr := packet.ReadLimit(c, int(mc.maximumPacketSize))
 	if readErr != nil {
 		return nil, readErr
 	}
-	return bytes.NewBuffer(readBuffer[:n]), nil
+	mc.metrics.BytesReceived(len(data))
+	if mc.OnPacketReceived != nil {
+		mc.OnPacketReceived(mc, mc.userData, mc.trace(data))
+	}
+	return bytes.NewBuffer(data), nil
 }
 
+// Write one control packet, it must fit in the maximum packet size of the server
 func (mc *MqttClient) Write(buffer []byte) (int, error) {
-	return (*mc.conn).Write(buffer)
+	if !mc.fits(len(buffer)) {
+		return 0, ErrPacketTooLarge
+	}
+
+	c := mc.netConn()
+	if c == nil {
+		return 0, ErrNotConnected
+	}
+
+	mc.writeMu.Lock()
+	n, err := c.Write(buffer)
+	if err == nil && mc.OnPacketSent != nil {
+		mc.OnPacketSent(mc, mc.userData, mc.trace(buffer))
+	}
+	mc.writeMu.Unlock()
+	mc.metrics.BytesSent(n)
+
+	return n, err
+}
+
+// Encode the packet straight to the connection, without an intermediate buffer
+// OnPacketSent gets the bytes written: the packet is then encoded once in a buffer
+func (mc *MqttClient) writePacket(mp *packet.MqttPacket) (int, error) {
+	if mc.OnPacketSent != nil {
+		data, err := packet.AppendEncode(make([]byte, 0, packet.Len(mp)), mp)
+		if err != nil {
+			return 0, err
+		}
+		return mc.Write(data)
+	}
+
+	if !mc.fits(packet.Len(mp)) {
+		return 0, ErrPacketTooLarge
+	}
+
+	c := mc.netConn()
+	if c == nil {
+		return 0, ErrNotConnected
+	}
+
+	mc.writeMu.Lock()
+	n, err := packet.EncodeTo(c, mp)
+	mc.writeMu.Unlock()
+	mc.metrics.BytesSent(n)
+
+	return n, err
+}
+
+// Trace of a packet for the hooks, decoded from a copy of the bytes
+func (mc *MqttClient) trace(data []byte) *PacketTrace {
+	now := time.Now()
+	data = append([]byte(nil), data...)
+	return &PacketTrace{Packet: mc.decode(data), Data: data, Time: now}
+}
+
+// True if a packet of this size fits in the maximum packet size of the server
+func (mc *MqttClient) fits(size int) bool {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	return mc.serverMaximumPacketSize == 0 || size <= int(mc.serverMaximumPacketSize)
+}
+
+// Reset the in-flight window to the receive maximum of the server, mu must be held
+// The messages still in flight take their slot in the new window, the publishes
+// waiting for a slot of the old window wait for one of the new window
+func (mc *MqttClient) resetInflight() {
+	mc.inflight = nil
+	if mc.serverReceiveMaximum != 0 {
+		mc.inflight = make(chan struct{}, mc.serverReceiveMaximum)
+	}
+	if mc.inflightReset != nil {
+		close(mc.inflightReset)
+	}
+	mc.inflightReset = make(chan struct{})
+
+	for _, o := range mc.pending {
+		o.window = mc.takeInflight()
+	}
+}
+
+// Take a slot of the in-flight window without waiting, nil if there is no window or
+// no free slot, mu must be held
+func (mc *MqttClient) takeInflight() chan struct{} {
+	if mc.inflight == nil {
+		return nil
+	}
+	select {
+	case mc.inflight <- struct{}{}:
+		return mc.inflight
+	default:
+		return nil
+	}
+}
+
+// Take a slot of the in-flight window for a QoS > 0 publish, waiting for a free slot
+// until the context is done or the client is shut down
+// The returned window must be given back to releaseInflight
+func (mc *MqttClient) acquireInflight(ctx context.Context) (chan struct{}, error) {
+	for {
+		mc.mu.Lock()
+		window, reset := mc.inflight, mc.inflightReset
+		mc.mu.Unlock()
+
+		if window == nil {
+			return nil, nil
+		}
+
+		if mc.publishNoWait {
+			select {
+			case window <- struct{}{}:
+				return window, nil
+			default:
+				return nil, ErrReceiveMaximumExceeded
+			}
+		}
+
+		select {
+		case window <- struct{}{}:
+			return window, nil
+		case <-reset:
+			// The window was replaced by a new CONNACK
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-mc.stop:
+			return nil, ErrClientClosed
+		}
+	}
+}
+
+func releaseInflight(window chan struct{}) {
+	if window != nil {
+		<-window
+	}
+}
+
+// Number of QoS > 0 publishes waiting for their acknowledgement
+func (mc *MqttClient) InFlight() int {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	return len(mc.inflight)
+}
+
+// True if the protocol in use is MQTT 5
+func (mc *MqttClient) isV5() bool {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	return mc.protocol.IsV5()
+}
+
+// Decode a packet according to the protocol level in use
+func (mc *MqttClient) decode(data []byte) *packet.MqttPacket {
+	if mc.isV5() {
+		return packet.DecodeV5(data)
+	}
+	return packet.Decode(data)
+}
+
+// Decode a structured packet according to the protocol level in use
+func (mc *MqttClient) parse(data []byte) (packet.Packet, error) {
+	if mc.isV5() {
+		return packet.ParseV5(data)
+	}
+	return packet.Parse(data)
+}
+
+// Properties to add to the variable header, nil before MQTT 5
+func (mc *MqttClient) properties() *property.Properties {
+	if mc.isV5() {
+		return property.New()
+	}
+	return nil
+}
+
+// Packet identifier for the packets requiring one, 0 is not allowed
+func newPacketId() uint16 {
+	return uint16(rand.Intn(math.MaxInt16)) + 1
+}
+
+// Take a packet identifier not used by another request nor by a message in flight,
+// and register the goroutine waiting for the response of the request
+func (mc *MqttClient) request(control byte) (uint16, chan []byte) {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+
+	for {
+		id := newPacketId()
+		if !mc.inUse(id) {
+			return id, mc.register(response{control: control, packetId: id})
+		}
+	}
+}
+
+// True if the packet identifier is in use, mu must be held
+func (mc *MqttClient) inUse(packetId uint16) bool {
+	for _, control := range []byte{header.PUBACK, header.SUBACK, header.UNSUBACK} {
+		if len(mc.waiters[response{control: control, packetId: packetId}]) > 0 {
+			return true
+		}
+	}
+	for _, o := range mc.pending {
+		if o.packetId == packetId {
+			return true
+		}
+	}
+	return false
+}
+
+// Register a goroutine waiting for a response, before the request is written
+func (mc *MqttClient) expect(r response) chan []byte {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	return mc.register(r)
+}
+
+// mu must be held
+func (mc *MqttClient) register(r response) chan []byte {
+	waiter := make(chan []byte, 1)
+	mc.waiters[r] = append(mc.waiters[r], waiter)
+	return waiter
+}
+
+// Unregister a goroutine which does not wait for the response anymore
+func (mc *MqttClient) forget(r response, waiter chan []byte) {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+
+	waiters := mc.waiters[r]
+	for i, w := range waiters {
+		if w == waiter {
+			waiters = append(waiters[:i], waiters[i+1:]...)
+			break
+		}
+	}
+
+	if len(waiters) == 0 {
+		delete(mc.waiters, r)
+	} else {
+		mc.waiters[r] = waiters
+	}
+}
+
+// Response carried by the packet, if any
+// The acknowledgements of a PUBLISH share one response, so do the AUTH and the CONNACK
+func responseOf(data []byte) (response, bool) {
+
+	control := data[0] & 0xF0
+	switch control {
+	case header.PINGRESP:
+		return response{control: control}, true
+	case header.CONNACK, header.AUTH:
+		return response{control: header.AUTH}, true
+	case header.PUBACK, header.PUBREC, header.PUBCOMP:
+		control = header.PUBACK
+	case header.SUBACK, header.UNSUBACK:
+	default:
+		return response{}, false
+	}
+
+	// Packet identifier after the fixed header
+	nb, _, err := header.RemainingLengthDecode(data[1:])
+	if err != nil || len(data) < 1+nb+2 {
+		return response{}, false
+	}
+
+	return response{control: control, packetId: util.Bytes2uint16(data[1+nb:])}, true
+}
+
+// Give the packet to the first goroutine waiting for it
+// Return false if no goroutine waits for it
+func (mc *MqttClient) respond(data []byte) bool {
+
+	r, ok := responseOf(data)
+	if !ok {
+		return false
+	}
+
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+
+	waiters := mc.waiters[r]
+	if len(waiters) == 0 {
+		return false
+	}
+
+	waiters[0] <- data
+	if len(waiters) == 1 {
+		delete(mc.waiters, r)
+	} else {
+		mc.waiters[r] = waiters[1:]
+	}
+
+	return true
+}
+
+// Wait for the response registered with expect or request
+// The goroutine reads the connection itself while no other goroutine does,
+// the packets read on the way are dispatched as Loop does
+func (mc *MqttClient) await(r response, waiter chan []byte) ([]byte, error) {
+	return mc.awaitContext(context.Background(), r, waiter)
+}
+
+// Wait for the response until the context is done
+// Once the context is done the packet being read is still read and dispatched,
+// by another goroutine holding the reader token
+func (mc *MqttClient) awaitContext(ctx context.Context, r response, waiter chan []byte) ([]byte, error) {
+
+	defer mc.forget(r, waiter)
+
+	for {
+		select {
+		case data := <-waiter:
+			return data, nil
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case mc.reader <- struct{}{}:
+		}
+
+		// Read by the previous reader
+		select {
+		case data := <-waiter:
+			<-mc.reader
+			return data, nil
+		default:
+		}
+
+		// The read can not be interrupted without losing the packet
+		if ctx.Done() == nil {
+			if err := mc.readOne(); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		read := make(chan error, 1)
+		go func() { read <- mc.readOne() }()
+
+		select {
+		case err := <-read:
+			if err != nil {
+				return nil, err
+			}
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// Read and dispatch one packet, the caller holds the reader token which is released
+func (mc *MqttClient) readOne() error {
+	bb, err := mc.Read()
+	if err != nil {
+		<-mc.reader
+		return err
+	}
+
+	notify, err := mc.dispatch(bb.Bytes())
+	<-mc.reader
+
+	if notify != nil {
+		notify()
+	}
+	return err
+}
+
+// Protocol in use, it may differ from the configured one after a fallback
+func (mc *MqttClient) Protocol() protocol.MqttProtocol {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	return *mc.protocol
+}
+
+// Properties received with the CONNACK, nil before MQTT 5
+func (mc *MqttClient) ServerProperties() *property.Properties {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	return mc.serverProperties
 }
 
 // connect(host, port=1883, keepalive=60, bind_address="")
 func (mc *MqttClient) MqttConnect() (bool, error) {
 
-	if mc.conn == nil {
+	connected, _, err := mc.mqttConnectSession()
+	return connected, err
+}
+
+// Connect if needed and return the session present flag of the connection in use,
+// read under connectMu so that a reconnection cannot change it meanwhile
+func (mc *MqttClient) mqttConnectSession() (bool, bool, error) {
+
+	mc.connectMu.Lock()
+
+	if mc.isConnected() {
+		sessionPresent := mc.SessionPresent()
+		mc.connectMu.Unlock()
+		return true, sessionPresent, nil
+	}
+
+	connected, err := mc.mqttConnect()
+	sessionPresent := connected && mc.SessionPresent()
+	if !connected {
+		// Refused, not waiting for a CONNACK anymore
+		mc.setState(mc.idleState())
+	}
+	mc.connectMu.Unlock()
+
+	// The callback may publish or subscribe
+	if connected && mc.OnConnect != nil {
+		mc.OnConnect(mc, mc.userData, mc.netConn(), sessionPresent)
+	}
+
+	return connected, sessionPresent, err
+}
+
+// Send the CONNECT and read the CONNACK, connectMu must be held
+func (mc *MqttClient) mqttConnect() (bool, error) {
+
+	if mc.netConn() == nil {
 		return false, nil
 	}
 
-	if mc.mqttConnected {
-		return true, nil
+	// Copied under mu, SetSessionExpiry and the CONNACK of the previous connection write them
+	mc.mu.Lock()
+	clientId := mc.clientId
+	sessionExpiry := mc.sessionExpiry
+	receiveMaximum := mc.receiveMaximum
+	maximumPacketSize := mc.maximumPacketSize
+	mc.mu.Unlock()
+
+	// MQTT 3.1 requires an identifier of 1 to 23 characters
+	if mc.protocol.IsV31() && (len(clientId) == 0 || len(clientId) > protocol.CLIENT_ID_MAX_LEN_31) {
+		return false, fmt.Errorf("client identifier must be 1 to %d characters with MQTT 3.1", protocol.CLIENT_ID_MAX_LEN_31)
 	}
 
 	var connectFlag byte = 0
@@ -190,8 +1134,30 @@ func (mc *MqttClient) MqttConnect() (bool, error) {
 	}
 
 	mh := header.New(header.WithControl(header.CONNECT))
-	mvh := vheader.NewConnectHeader(mc.protocol.Name, mc.protocol.Level, connectFlag, mc.connInfos.KeepAlive)
-	mpl := payload.New(payload.WithString(mc.clientId))
+	mvh := vheader.NewConnectHeader(mc.protocol.Name, mc.protocol.Level, connectFlag, mc.infos().KeepAlive)
+	mvh.Properties = mc.properties()
+	if mvh.Properties != nil && sessionExpiry != 0 {
+		mvh.Properties.SessionExpiryInterval = property.Uint32(sessionExpiry)
+	}
+	if mvh.Properties != nil && receiveMaximum != 0 {
+		mvh.Properties.ReceiveMaximum = property.Uint16(receiveMaximum)
+	}
+	if mvh.Properties != nil && maximumPacketSize != 0 {
+		mvh.Properties.MaximumPacketSize = property.Uint32(maximumPacketSize)
+	}
+	mpl := payload.New(payload.WithString(clientId))
+
+	if mc.authenticator != nil {
+		if !mc.protocol.IsV5() {
+			return false, fmt.Errorf("enhanced authentication requires MQTT 5")
+		}
+		data, err := mc.authenticator.Start()
+		if err != nil {
+			return false, err
+		}
+		mvh.Properties.AuthenticationMethod = mc.authenticator.Method()
+		mvh.Properties.AuthenticationData = data
+	}
 
 	if mc.credentials != nil {
 		// mp.Header.Control = mp.Header.Control | (0x01 << 7) | (0x01 << 6)
@@ -200,34 +1166,53 @@ func (mc *MqttClient) MqttConnect() (bool, error) {
 	}
 
 	mp := packet.NewMqttPacket(mh, packet.WithVariableHeader(mvh), packet.WithPayload(mpl))
+	if err := packet.Validate(mp); err != nil {
+		return false, err
+	}
 
 	mc.ShowPacket(mp)
 
 	// Write CONNECT
-	_, err := (*mc.conn).Write(packet.Encode(mp))
+	waiter := mc.expect(response{control: header.AUTH})
+	_, err := mc.writePacket(mp)
 	if err != nil {
-		log.Printf("Write Error: %s\n", err)
+		mc.forget(response{control: header.AUTH}, waiter)
+		mc.log(logger.ERROR, "write failed", "err", err)
 		return false, err
 	}
 
-	// Read CONNHACK
-	bb, readErr := mc.Read()
-	if err != nil {
-		log.Printf("Read Error: %s\n", readErr)
+	// Read CONNHACK, the server may send AUTH challenges before
+	pRead, readErr := mc.authExchange(waiter)
+	if readErr != nil {
+		mc.log(logger.ERROR, "read failed", "err", readErr)
 		return false, readErr
 	}
 
-	mpRead := packet.Decode(bb.Bytes())
-	mc.ShowPacket(mpRead)
+	if connack, ok := pRead.(*packet.Connack); ok {
 
-	if mpRead.Header.Control == header.CONNACK {
+		// A server not speaking MQTT 5 answers with a MQTT 3.1.1 CONNACK
+		unacceptable := connack.ReturnCode == header.CONNECT_REFUSED_1 && (!mc.protocol.IsV5() || connack.Properties == nil)
+		if mc.protocol.IsV5() && connack.ReturnCode == reason.UNSUPPORTED_PROTOCOL_VERSION {
+			unacceptable = true
+		}
+		if unacceptable && mc.protocolFallback && mc.protocol.Fallback() != nil {
+			return mc.fallback()
+		}
 
-		switch mpRead.VariableHeader.(*vheader.GenericHeader).Data[1] {
+		if mc.protocol.IsV5() && !unacceptable {
+			return mc.connackV5(connack)
+		}
+
+		switch connack.ReturnCode {
 		case header.CONNECT_ACCEPTED:
-			if mc.OnConnect != nil {
-				mc.OnConnect(*mc, mc.userData, *mc.conn)
-			}
-			mc.mqttConnected = true
+			mc.mu.Lock()
+			mc.resetInflight()
+			mc.mu.Unlock()
+
+			// The first byte of a MQTT 3.1 CONNACK is reserved, there is no session present flag
+			mc.resumeSession(connack.SessionPresent && !mc.protocol.IsV31())
+
+			mc.setState(STATE_CONNECTED)
 			return true, nil
 		case header.CONNECT_REFUSED_1:
 			return false, fmt.Errorf("connection Refused, unacceptable protocol version")
@@ -247,30 +1232,419 @@ func (mc *MqttClient) MqttConnect() (bool, error) {
 	return false, nil
 }
 
+// Reconnect with the previous protocol version
+func (mc *MqttClient) fallback() (bool, error) {
+
+	previous := mc.protocol
+	mc.mu.Lock()
+	mc.protocol = previous.Fallback()
+	mc.mu.Unlock()
+
+	mc.log(logger.INFO, "protocol refused", "protocol", previous, "fallback", mc.protocol)
+
+	// The server closes the connection after refusing the protocol
+	mc.Close()
+	if _, err := mc.Connect(); err != nil {
+		return false, err
+	}
+
+	return mc.mqttConnect()
+}
+
+// Message sent and waiting for its acknowledgement
+type outgoing struct {
+	packetId uint16
+
+	// encoded PUBLISH
+	data []byte
+
+	// PUBREC received, the PUBREL is sent again instead of the PUBLISH
+	released bool
+
+	// Slot taken in the in-flight window, given back on PUBACK or PUBCOMP
+	window chan struct{}
+}
+
+// True if the server kept the session of the client at the last connection
+// The flag of a given connection is passed to OnConnect, it may change here on reconnection
+func (mc *MqttClient) SessionPresent() bool {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	return mc.sessionPresent
+}
+
+// Keep or drop the session state according to the Session Present flag of the CONNACK
+func (mc *MqttClient) resumeSession(sessionPresent bool) {
+
+	mc.mu.Lock()
+
+	mc.sessionPresent = sessionPresent
+
+	if !sessionPresent {
+		// The server starts a new session, the messages in flight are lost
+		if len(mc.pending) > 0 {
+			mc.log(logger.WARN, "session not present, messages in flight dropped", "count", len(mc.pending))
+		}
+		for _, o := range mc.pending {
+			releaseInflight(o.window)
+		}
+		mc.pending = nil
+		mc.metrics.InFlight(0)
+		mc.received = make(map[uint16]bool)
+		mc.mu.Unlock()
+		return
+	}
+
+	var resend [][]byte
+	for _, o := range mc.pending {
+		if o.released {
+			pubrel, err := packet.Encode(packet.NewMqttPacket(header.New(header.WithPubrel()), packet.WithVariableHeader(vheader.NewPacketIdHeader(o.packetId))))
+			if err != nil {
+				mc.log(logger.ERROR, "encode failed", "err", err)
+				continue
+			}
+			resend = append(resend, pubrel)
+		} else {
+			// DUP flag
+			o.data[0] |= 1 << 3
+			resend = append(resend, o.data)
+		}
+	}
+
+	mc.mu.Unlock()
+
+	// Send again what was not acknowledged, in order, the acknowledgements are read by Loop
+	for _, data := range resend {
+		if _, err := mc.Write(data); err != nil {
+			mc.log(logger.ERROR, "write failed", "err", err)
+			return
+		}
+	}
+}
+
+// Handle the acknowledgement of a message in flight, OnPublish is left to the caller
+// Return false if no message in flight has this packet identifier
+func (mc *MqttClient) acknowledge(control byte, packetId uint16) bool {
+
+	mc.mu.Lock()
+
+	found := false
+	for i, o := range mc.pending {
+		if o.packetId != packetId {
+			continue
+		}
+
+		switch control {
+		case header.PUBACK, header.PUBCOMP:
+			mc.pending = append(mc.pending[:i], mc.pending[i+1:]...)
+			releaseInflight(o.window)
+			mc.metrics.InFlight(len(mc.pending))
+			mc.drained()
+			found = true
+		case header.PUBREC:
+			o.released = true
+			found = true
+		}
+		break
+	}
+
+	mc.mu.Unlock()
+
+	if found && control == header.PUBREC {
+		// The variable header contains the same Packet Identifier as the PUBREC Packet that is being acknowledged
+		mp := packet.NewMqttPacket(header.New(header.WithPubrel()), packet.WithVariableHeader(vheader.NewPacketIdHeader(packetId)))
+		mc.ShowPacket(mp)
+		if _, err := mc.writePacket(mp); err != nil {
+			mc.log(logger.ERROR, "write failed", "err", err)
+		}
+	}
+
+	return found
+}
+
+// Handle a MQTT 5 CONNACK: flags, reason code and properties
+func (mc *MqttClient) connackV5(connack *packet.Connack) (bool, error) {
+
+	properties := connack.Properties
+	if properties == nil {
+		return false, packet.ErrMalformedPacket
+	}
+
+	mc.mu.Lock()
+	mc.serverProperties = properties
+	mc.mu.Unlock()
+
+	if reason.IsError(connack.ReturnCode) {
+		if mc.redirect(connack.ReturnCode, properties) {
+			return false, fmt.Errorf("connection Refused, %s, redirected to %s", reason.String(connack.ReturnCode), properties.ServerReference)
+		}
+		return false, fmt.Errorf("connection Refused, %s", reason.String(connack.ReturnCode))
+	}
+
+	mc.mu.Lock()
+
+	// The server may override the session expiry interval and the keep alive
+	mc.negotiatedSessionExpiry = mc.sessionExpiry
+	if properties.SessionExpiryInterval != nil {
+		mc.negotiatedSessionExpiry = *properties.SessionExpiryInterval
+		mc.sessionExpiry = mc.negotiatedSessionExpiry
+	}
+	if properties.ServerKeepAlive != nil {
+		// The connection infos may be shared with other clients
+		connInfos := *mc.connInfos
+		connInfos.KeepAlive = *properties.ServerKeepAlive
+		mc.connInfos = &connInfos
+	}
+	if properties.AssignedClientIdentifier != "" {
+		mc.clientId = properties.AssignedClientIdentifier
+	}
+	if properties.ReceiveMaximum != nil {
+		mc.serverReceiveMaximum = *properties.ReceiveMaximum
+	}
+	if properties.MaximumPacketSize != nil {
+		mc.serverMaximumPacketSize = *properties.MaximumPacketSize
+	}
+	mc.resetInflight()
+
+	mc.mu.Unlock()
+
+	if mc.authenticator != nil {
+		if err := mc.authenticator.Finish(properties.AuthenticationData); err != nil {
+			return false, err
+		}
+	}
+
+	mc.resumeSession(connack.SessionPresent)
+
+	mc.setState(STATE_CONNECTED)
+
+	return true, nil
+}
+
+// Read the next AUTH or CONNACK with the waiter, answering the AUTH challenges
+// of the server on the way
+func (mc *MqttClient) authExchange(waiter chan []byte) (packet.Packet, error) {
+
+	r := response{control: header.AUTH}
+
+	for {
+		data, err := mc.await(r, waiter)
+		if err != nil {
+			return nil, err
+		}
+
+		p, err := mc.parse(data)
+		if err != nil {
+			return nil, fmt.Errorf("unexpected or malformed packet 0x%X: %w", data[0], err)
+		}
+		mc.showParsed(p)
+
+		auth, ok := p.(*packet.Auth)
+		if !ok || auth.ReasonCode != reason.CONTINUE_AUTHENTICATION {
+			return p, nil
+		}
+
+		if mc.authenticator == nil || auth.Properties.AuthenticationMethod != mc.authenticator.Method() {
+			return nil, fmt.Errorf("unexpected authentication method")
+		}
+
+		data, err = mc.authenticator.Next(auth.Properties.AuthenticationData)
+		if err != nil {
+			return nil, err
+		}
+
+		mp := mc.authPacket(reason.CONTINUE_AUTHENTICATION, data)
+		mc.ShowPacket(mp)
+
+		waiter = mc.expect(r)
+		if _, err := mc.writePacket(mp); err != nil {
+			mc.forget(r, waiter)
+			return nil, err
+		}
+	}
+}
+
+func (mc *MqttClient) authPacket(reasonCode byte, data []byte) *packet.MqttPacket {
+	properties := property.New()
+	properties.AuthenticationMethod = mc.authenticator.Method()
+	properties.AuthenticationData = data
+
+	mh := header.New(header.WithControl(header.AUTH))
+	mvh := vheader.NewAuthHeader(reasonCode, properties)
+
+	return packet.NewMqttPacket(mh, packet.WithVariableHeader(mvh))
+}
+
+// Start a new enhanced authentication exchange on an established MQTT 5 session
+// The server keeps the session if it succeeds and disconnects otherwise
+func (mc *MqttClient) Reauthenticate() (bool, error) {
+
+	if mc.authenticator == nil || !mc.isV5() {
+		return false, fmt.Errorf("re-authentication requires MQTT 5 and an authenticator")
+	}
+
+	if !mc.isConnected() {
+		return false, ErrNotConnected
+	}
+
+	data, err := mc.authenticator.Start()
+	if err != nil {
+		return false, err
+	}
+
+	mp := mc.authPacket(reason.RE_AUTHENTICATE, data)
+	mc.ShowPacket(mp)
+
+	waiter := mc.expect(response{control: header.AUTH})
+	if _, err := mc.writePacket(mp); err != nil {
+		mc.forget(response{control: header.AUTH}, waiter)
+		mc.log(logger.ERROR, "write failed", "err", err)
+		return false, err
+	}
+
+	pRead, err := mc.authExchange(waiter)
+	if err != nil {
+		mc.log(logger.ERROR, "read failed", "err", err)
+		return false, err
+	}
+
+	if auth, ok := pRead.(*packet.Auth); ok && auth.ReasonCode == reason.SUCCESS {
+		if err := mc.authenticator.Finish(auth.Properties.AuthenticationData); err != nil {
+			return false, err
+		}
+		return true, nil
+	}
+
+	return false, nil
+}
+
+// Change the MQTT 5 session expiry interval, the new value is sent with the DISCONNECT
+func (mc *MqttClient) SetSessionExpiry(seconds uint32) error {
+
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+
+	if !mc.protocol.IsV5() {
+		return fmt.Errorf("session expiry requires MQTT 5")
+	}
+
+	// A session ending with the connection can not be extended at disconnect
+	if mc.state.connected() && mc.negotiatedSessionExpiry == 0 && seconds != 0 {
+		return fmt.Errorf("session expiry was 0 at connect and can not be changed")
+	}
+
+	mc.sessionExpiry = seconds
+
+	return nil
+}
+
+// Reason code and properties of the last DISCONNECT sent by a MQTT 5 server
+func (mc *MqttClient) DisconnectReason() (byte, *property.Properties) {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	return mc.disconnectReason, mc.disconnectProperties
+}
+
+// Update the connection infos with the server reference
+// Return true if the client will connect to another server
+func (mc *MqttClient) redirect(reasonCode byte, properties *property.Properties) bool {
+
+	if !mc.followRedirect || properties == nil || properties.ServerReference == "" {
+		return false
+	}
+
+	if reasonCode != reason.USE_ANOTHER_SERVER && reasonCode != reason.SERVER_MOVED {
+		return false
+	}
+
+	// The reference may contain several servers separated by spaces
+	reference := strings.Fields(properties.ServerReference)[0]
+
+	mc.mu.Lock()
+	connInfos := *mc.connInfos
+	host, port, err := net.SplitHostPort(reference)
+	if err != nil {
+		connInfos.Host = reference
+	} else {
+		connInfos.Host = host
+		connInfos.Port = port
+	}
+	mc.connInfos = &connInfos
+	mc.mu.Unlock()
+
+	mc.log(logger.INFO, "redirected", "host", connInfos.Host, "port", connInfos.Port)
+
+	return true
+}
+
+// Handle a DISCONNECT sent by the server
+func (mc *MqttClient) serverDisconnect(mp *packet.MqttPacket) {
+
+	code := reason.NORMAL_DISCONNECTION
+	var properties *property.Properties
+	if mp == nil {
+		mc.log(logger.ERROR, "malformed DISCONNECT")
+	} else if dh, ok := mp.VariableHeader.(*vheader.DisconnectHeader); ok {
+		code = dh.ReasonCode
+		properties = dh.Properties
+	}
+
+	mc.mu.Lock()
+	mc.disconnectReason = code
+	mc.disconnectProperties = properties
+	mc.mu.Unlock()
+
+	mc.log(logger.WARN, "disconnected by server", "reason", reason.String(code))
+
+	mc.redirect(code, properties)
+
+	c := mc.netConn()
+	mc.Close()
+
+	if mc.OnDisconnect != nil && c != nil {
+		mc.OnDisconnect(mc, mc.userData, c)
+	}
+}
+
 func (mc *MqttClient) MqttDisconnect() (bool, error) {
 
-	if !mc.mqttConnected {
+	if !mc.isConnected() {
 		return true, nil
 	}
 
 	mh := header.New(header.WithControl(header.DISCONNECT))
 	mp := packet.NewMqttPacket(mh)
 
+	mc.mu.Lock()
+	sessionExpiry := mc.sessionExpiry
+	changed := mc.protocol.IsV5() && sessionExpiry != mc.negotiatedSessionExpiry
+	mc.mu.Unlock()
+
+	if changed {
+		properties := property.New()
+		properties.SessionExpiryInterval = property.Uint32(sessionExpiry)
+		mp = packet.NewMqttPacket(mh, packet.WithVariableHeader(vheader.NewDisconnectHeader(reason.NORMAL_DISCONNECTION, properties)))
+	}
+
 	mc.ShowPacket(mp)
 
-	n, err := (*mc.conn).Write(packet.Encode(mp))
+	from := mc.State()
+	mc.setState(STATE_DISCONNECTING)
+
+	n, err := mc.writePacket(mp)
 	if err != nil {
-		log.Printf("Write Error: %s\n", err)
+		mc.log(logger.ERROR, "write failed", "err", err)
+		mc.setState(from)
 		return false, err
 	}
 
-	log.Printf("Wrote %d byte(s)\n", n)
+	mc.log(logger.DEBUG, "wrote", "bytes", n)
 
-	mc.mqttConnected = false
+	c := mc.netConn()
 	mc.Close()
 
-	if mc.OnDisconnect != nil {
-		mc.OnDisconnect(*mc, mc.userData, *mc.conn)
+	if mc.OnDisconnect != nil && c != nil {
+		mc.OnDisconnect(mc, mc.userData, c)
 	}
 
 	return true, nil
@@ -279,103 +1653,259 @@ func (mc *MqttClient) MqttDisconnect() (bool, error) {
 
 // The SUBSCRIBE Packet is sent from the Client to the Server to create one or more Subscriptions.
 // Each Subscription registers a Client’s interest in one or more Topics. The Server sends PUBLISH Packets to the Client in order to forward Application Messages that were published to Topics that match these Subscriptions. The SUBSCRIBE Packet also specifies (for each Subscription) the maximum QoS with which the Server can send Application Messages to the Client.
-func (mc *MqttClient) Subscribe(topic string, qos byte) (bool, error) {
+// With MQTT 5 the subscription options (No Local, Retain As Published, Retain Handling, Subscription Identifier) can be given.
+// Return the QoS granted by the server, which may be lower than the one requested,
+// and ErrSubscriptionFailed when the server refuses the subscription.
+func (mc *MqttClient) Subscribe(topic string, qos byte, opts ...subscription.SubscriptionOption) (byte, error) {
+	return mc.subscribe(subscription.New(topic, qos, opts...))
+}
+
+func (mc *MqttClient) subscribe(sub *subscription.Subscription) (byte, error) {
+	codes, err := mc.SubscribeMultiple(sub)
+	if len(codes) == 0 {
+		return reason.UNSPECIFIED_ERROR, err
+	}
+	return codes[0], err
+}
 
-	sub := subscription.New(topic, qos)
-	mc.subscribed[topic] = *sub
+// Subscribe to several topic filters with a single SUBSCRIBE
+// Return the SUBACK return code of each filter, in order : the granted QoS or 0x80 on failure,
+// and ErrSubscriptionFailed when any filter is refused. Only the granted subscriptions are kept.
+// With MQTT 5 the filters share the subscription identifier of the packet
+func (mc *MqttClient) SubscribeMultiple(subs ...*subscription.Subscription) ([]byte, error) {
+
+	if len(subs) == 0 {
+		return nil, fmt.Errorf("no topic filter to subscribe")
+	}
+
+	v5 := mc.isV5()
+	subscriptionIdentifier := 0
+	for _, sub := range subs {
+		if err := sub.Validate(); err != nil {
+			return nil, err
+		}
+
+		if sub.HasV5Options() && !v5 {
+			return nil, fmt.Errorf("subscription options require MQTT 5")
+		}
+
+		if sub.SubscriptionIdentifier != 0 {
+			if subscriptionIdentifier != 0 && sub.SubscriptionIdentifier != subscriptionIdentifier {
+				return nil, fmt.Errorf("the filters of a SUBSCRIBE share one subscription identifier")
+			}
+			subscriptionIdentifier = sub.SubscriptionIdentifier
+		}
+	}
 
 	// Adding connection to mc
 	if _, err := mc.MqttConnect(); err != nil {
-		return false, err
+		return nil, err
+	}
+
+	// The server tells in the CONNACK which features are not available
+	if sp := mc.ServerProperties(); sp != nil {
+		for _, sub := range subs {
+			if sub.IsShared() && sp.SharedSubscriptionAvailable != nil && *sp.SharedSubscriptionAvailable == 0 {
+				return nil, fmt.Errorf("shared subscriptions not supported by the server")
+			}
+		}
+		if subscriptionIdentifier != 0 && sp.SubscriptionIdentifierAvailable != nil && *sp.SubscriptionIdentifierAvailable == 0 {
+			return nil, fmt.Errorf("subscription identifiers not supported by the server")
+		}
 	}
 
 	//The variable header component of many of the Control Packet types includes a 2 byte Packet Identifier field.
 	//These Control Packets are PUBLISH (where QoS > 0), PUBACK, PUBREC, PUBREL, PUBCOMP, SUBSCRIBE, SUBACK, UNSUBSCRIBE, UNSUBACK.
-	var packetId uint16 = uint16(rand.Intn(math.MaxInt16))
-
-	mh := header.New(header.WithSubscribe())
-
-	mvh := vheader.NewPacketIdHeader(packetId)
-
-	mpl := payload.New(payload.WithString(topic), payload.WithQos(qos))
+	subscribe := &packet.Subscribe{Properties: mc.properties()}
+	if subscriptionIdentifier != 0 {
+		subscribe.Properties.SubscriptionIdentifier = []int{subscriptionIdentifier}
+	}
+	for _, sub := range subs {
+		subscribe.Filters = append(subscribe.Filters, packet.SubscribeFilter{Filter: sub.Topic, Options: sub.Options()})
+	}
 
-	mp := packet.NewMqttPacket(mh, packet.WithVariableHeader(mvh), packet.WithPayload(mpl))
+	id, waiter := mc.request(header.SUBACK)
+	subscribe.PacketID = id
 
-	mc.ShowPacket(mp)
+	mc.showParsed(subscribe)
 
-	n, writeErr := (*mc.conn).Write(packet.Encode(mp))
+	data, writeErr := subscribe.Encode()
+	n := 0
+	if writeErr == nil {
+		n, writeErr = mc.Write(data)
+	}
 	if writeErr != nil {
-		log.Printf("Write Error: %s\n", writeErr)
-		return false, writeErr
+		mc.forget(response{control: header.SUBACK, packetId: id}, waiter)
+		mc.log(logger.ERROR, "write failed", "err", writeErr)
+		return nil, writeErr
 	}
 
-	log.Printf("Wrote %d byte(s)\n", n)
+	mc.log(logger.DEBUG, "wrote", "bytes", n)
 
 	// Read SUBACK
 
-	bb, readErr := mc.Read()
+	data, readErr := mc.await(response{control: header.SUBACK, packetId: id}, waiter)
 	if readErr != nil {
-		log.Printf("Read Error: %s\n", readErr)
-		return false, readErr
+		mc.log(logger.ERROR, "read failed", "err", readErr)
+		return nil, readErr
 	}
 
-	// fmt.Println(util.ShowHexa(bb.Bytes()))
+	pRead, err := mc.parse(data)
+	if err != nil {
+		return nil, err
+	}
+	mc.showParsed(pRead)
+
+	subAck, ok := pRead.(*packet.Suback)
+	if !ok {
+		return nil, fmt.Errorf("unexpected %s instead of SUBACK", header.ControlToString(pRead.Type()))
+	}
+	if subAck.PacketID != subscribe.PacketID || len(subAck.ReturnCodes) != len(subs) {
+		return nil, fmt.Errorf("SUBACK %d with %d return code(s) for SUBSCRIBE %d with %d filter(s)",
+			subAck.PacketID, len(subAck.ReturnCodes), subscribe.PacketID, len(subs))
+	}
 
-	subAck := packet.Decode(bb.Bytes())
-	mc.ShowPacket(subAck)
+	// A failure is any code from 0x80 with MQTT 5 and 0x80 with MQTT 3.1.1,
+	// a MQTT 3.1 server only grants a QoS
+	p := mc.Protocol()
+	for _, code := range subAck.ReturnCodes {
+		if code <= QOS_2 || (p.IsV5() && reason.IsError(code)) || (!p.IsV31() && code == reason.UNSPECIFIED_ERROR) {
+			continue
+		}
+		return nil, fmt.Errorf("%w: SUBACK return code 0x%X with %s", packet.ErrMalformedPacket, code, p.String())
+	}
 
-	if subAck.Header.Control == header.SUBACK {
-		if mc.OnSubscribe != nil {
-			mid := subAck.VariableHeader.(*vheader.PacketIdHeader).PacketId
-			mc.OnSubscribe(*mc, mc.userData, mid)
+	// Keep the granted subscriptions to subscribe again after a reconnection
+	var failed []string
+	mc.mu.Lock()
+	for i, sub := range subs {
+		code := subAck.ReturnCodes[i]
+		if reason.IsError(code) {
+			failed = append(failed, fmt.Sprintf("%s (0x%X)", sub.Topic, code))
+			continue
 		}
-		return true, nil
+		granted := *sub
+		granted.GrantedQos = code
+		mc.subscribed[sub.Topic] = granted
 	}
+	mc.mu.Unlock()
 
-	return false, nil
+	if mc.OnSubscribe != nil {
+		mc.OnSubscribe(mc, mc.userData, subAck.PacketID, subAck.ReturnCodes)
+	}
+
+	if len(failed) > 0 {
+		return subAck.ReturnCodes, fmt.Errorf("%w: %s", ErrSubscriptionFailed, strings.Join(failed, ", "))
+	}
+
+	return subAck.ReturnCodes, nil
 }
 
-func (mc *MqttClient) Unsubscribe(topic string) (bool, error) {
+// Route the messages carrying the MQTT 5 subscription identifier to the handler
+// instead of OnMessage
+func (mc *MqttClient) AddMessageHandler(subscriptionId int, handler MessageHandler) {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	mc.handlers[subscriptionId] = handler
+}
 
-	// Adding connection to mc
-	if _, err := mc.MqttConnect(); err != nil {
-		return false, err
+// Call the handler for the messages matching the topic filter instead of OnMessage
+// A shared subscription filter matches the topics of its filter
+func (mc *MqttClient) AddTopicHandler(filter string, handler MessageHandler) {
+	topicFilter := filter
+	if _, f, ok := subscription.SplitShare(filter); ok {
+		topicFilter = f
 	}
 
-	var packetId uint16 = uint16(rand.Intn(math.MaxInt16))
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	mc.topicHandlers[filter] = handler
+	mc.router.Insert(topicFilter, filter, 0)
+}
+
+func (mc *MqttClient) RemoveTopicHandler(filter string) {
+	topicFilter := filter
+	if _, f, ok := subscription.SplitShare(filter); ok {
+		topicFilter = f
+	}
 
-	mh := header.New(header.WithUnsubscribe())
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	delete(mc.topicHandlers, filter)
+	mc.router.Remove(topicFilter, filter)
+}
 
-	mvh := vheader.NewPacketIdHeader(packetId)
+func (mc *MqttClient) Unsubscribe(topic string) (bool, error) {
+	return mc.UnsubscribeMultiple(topic)
+}
 
-	mpl := payload.New(payload.WithString(topic))
+// Unsubscribe from several topic filters with a single UNSUBSCRIBE
+func (mc *MqttClient) UnsubscribeMultiple(topics ...string) (bool, error) {
 
-	mp := packet.NewMqttPacket(mh, packet.WithVariableHeader(mvh), packet.WithPayload(mpl))
+	if len(topics) == 0 {
+		return false, fmt.Errorf("no topic filter to unsubscribe")
+	}
 
-	mc.ShowPacket(mp)
+	for _, topic := range topics {
+		filter := topic
+		if _, f, ok := subscription.SplitShare(topic); ok {
+			filter = f
+		}
+		if err := mqtttopic.ValidateFilter(filter); err != nil {
+			return false, fmt.Errorf("invalid topic filter %q: %w", topic, err)
+		}
+	}
+
+	// Adding connection to mc
+	if _, err := mc.MqttConnect(); err != nil {
+		return false, err
+	}
 
-	n, writeErr := (*mc.conn).Write(packet.Encode(mp))
+	id, waiter := mc.request(header.UNSUBACK)
+	unsubscribe := &packet.Unsubscribe{PacketID: id, Properties: mc.properties(), Filters: topics}
+
+	mc.showParsed(unsubscribe)
+
+	data, writeErr := unsubscribe.Encode()
+	n := 0
+	if writeErr == nil {
+		n, writeErr = mc.Write(data)
+	}
 	if writeErr != nil {
-		log.Printf("Write Error: %s\n", writeErr)
+		mc.forget(response{control: header.UNSUBACK, packetId: id}, waiter)
+		mc.log(logger.ERROR, "write failed", "err", writeErr)
 		return false, writeErr
 	}
 
-	log.Printf("Wrote %d byte(s)\n", n)
+	mc.log(logger.DEBUG, "wrote", "bytes", n)
 
 	// Read UNSUBACK
 
-	bb, readErr := mc.Read()
+	data, readErr := mc.await(response{control: header.UNSUBACK, packetId: id}, waiter)
 	if readErr != nil {
-		log.Printf("Read Error: %s\n", readErr)
+		mc.log(logger.ERROR, "read failed", "err", readErr)
 		return false, readErr
 	}
-	control, _ := bb.ReadByte()
 
-	if control == header.UNSUBACK {
+	pRead, err := mc.parse(data)
+	if err != nil {
+		return false, err
+	}
+	mc.showParsed(pRead)
+
+	if unsubAck, ok := pRead.(*packet.Unsuback); ok {
 		if mc.OnUnsubscribe != nil {
-			mc.OnUnsubscribe(*mc, nil, 0)
+			mc.OnUnsubscribe(mc, mc.userData, unsubAck.PacketID)
+		}
+		for _, topic := range topics {
+			mc.mu.Lock()
+			if sub, ok := mc.subscribed[topic]; ok && sub.SubscriptionIdentifier != 0 {
+				delete(mc.handlers, sub.SubscriptionIdentifier)
+			}
+			delete(mc.subscribed, topic)
+			mc.mu.Unlock()
+			mc.RemoveTopicHandler(topic)
 		}
-		delete(mc.subscribed, topic)
 		return true, nil
 	}
 
@@ -390,12 +1920,69 @@ func (mc *MqttClient) Unsubscribe(topic string) (bool, error) {
 // send back PUBREL – Publish release.
 // wait for PUBCOMP – Publish complete.
 func (mc *MqttClient) Publish(topic string, message string, qos byte, retain bool) (bool, error) {
+	return mc.PublishContext(context.Background(), topic, message, qos, retain)
+}
+
+// Publish with the trace found in the context as parent of the publish span
+// The wait for the acknowledgement stops when the context is done, the message
+// stays in flight and its acknowledgement is handled by Loop
+func (mc *MqttClient) PublishContext(ctx context.Context, topic string, message string, qos byte, retain bool) (bool, error) {
+	return mc.PublishMessage(ctx, &Message{Topic: topic, Payload: message, Qos: qos, Retain: retain})
+}
+
+// Publish a message through the publish middlewares
+// The MQTT 5 properties of the message are sent with it, they are ignored before MQTT 5
+func (mc *MqttClient) PublishMessage(ctx context.Context, message *Message) (bool, error) {
+	return mc.publishChain(mc.publishMessage)(ctx, message)
+}
+
+// Last step of the publish chain, the trace context is added to the message as sent
+func (mc *MqttClient) publishMessage(ctx context.Context, message *Message) (bool, error) {
+	if mc.tracer == nil {
+		return mc.publish(ctx, message, "")
+	}
+
+	span := mc.tracer.StartPublish(ctx, message.Topic)
+	ok, err := mc.publish(ctx, message, span.TraceParent())
+	span.End(err)
+	return ok, err
+}
+
+func (mc *MqttClient) publish(ctx context.Context, m *Message, traceParent string) (bool, error) {
+
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
+
+	topic, message, qos, retain := m.Topic, m.Payload, m.Qos, m.Retain
+
+	if err := mqtttopic.ValidateName(topic); err != nil {
+		return false, fmt.Errorf("invalid topic name %q: %w", topic, err)
+	}
+
+	// Shutdown waits for the publishes in progress
+	if err := mc.startPublish(); err != nil {
+		return false, err
+	}
+	defer mc.endPublish()
 
 	// Adding connection to mc
 	if _, err := mc.MqttConnect(); err != nil {
 		return false, err
 	}
 
+	// Respect the receive maximum of the server, the slot is held by the message
+	// in flight until its acknowledgement, or given back if it is not sent
+	var window chan struct{}
+	if qos > 0 {
+		acquired, err := mc.acquireInflight(ctx)
+		if err != nil {
+			return false, err
+		}
+		window = acquired
+		defer func() { releaseInflight(window) }()
+	}
+
 	var mh *header.MqttHeader = nil
 	if qos == QOS_1 {
 		mh = header.New(header.WithControl(header.PUBLISH), header.WithQos1())
@@ -410,95 +1997,120 @@ func (mc *MqttClient) Publish(topic string, message string, qos byte, retain boo
 	}
 
 	mvh := vheader.NewPublishHeader(topic)
-	mpl := payload.New(payload.WithString(message))
-	mp := packet.NewMqttPacket(mh, packet.WithVariableHeader(mvh), packet.WithPayload(mpl))
+	mvh.Properties = mc.properties()
+	// Copied, the trace context must not be added to the message
+	if mvh.Properties != nil && m.Properties != nil {
+		p := *m.Properties
+		p.User = append([]property.UserProperty(nil), p.User...)
+		mvh.Properties = &p
+	}
 
-	mc.ShowPacket(mp)
+	// The acknowledgements of the message share one response
+	r := response{control: header.PUBACK}
+	var waiter chan []byte
+	if qos > 0 {
+		mvh.PacketId, waiter = mc.request(header.PUBACK)
+		r.packetId = mvh.PacketId
+		defer func() { mc.forget(r, waiter) }()
+	}
 
-	n, err := (*mc.conn).Write(packet.Encode(mp))
-	if err != nil {
-		log.Printf("Write Error: %s\n", err)
+	// Propagate the trace context
+	body := []byte(message)
+	if traceParent != "" {
+		if mvh.Properties != nil {
+			mvh.Properties.User = append(mvh.Properties.User, property.UserProperty{Key: tracing.TRACEPARENT, Value: traceParent})
+		} else if mc.envelope != nil {
+			body = mc.envelope.Wrap(traceParent, body)
+		}
+	}
+
+	mpl := payload.New(payload.WithData(body))
+	mp := packet.NewMqttPacket(mh, packet.WithVariableHeader(mvh), packet.WithPayload(mpl))
+	if err := packet.Validate(mp); err != nil {
 		return false, err
 	}
 
-	log.Printf("Publish wrote %d byte(s)\n", n)
+	mc.ShowPacket(mp)
 
 	// Nothing to read for Qos 0
 	if qos == 0 {
-		if mc.OnPublish != nil {
-			mc.OnPublish(*mc, mc.userData, 0)
-		}
-	} else if qos == 1 {
-
-		// Read PUBACK
-
-		bb, err := mc.Read()
+		n, err := mc.writePacket(mp)
 		if err != nil {
-			log.Printf("Read Error: %s\n", err)
+			mc.log(logger.ERROR, "write failed", "err", err)
 			return false, err
 		}
 
-		pubAck := packet.Decode(bb.Bytes())
-		mc.ShowPacket(pubAck)
-
-		if pubAck.Header.Control == header.PUBACK {
-			if mc.OnPublish != nil {
-				mid := pubAck.VariableHeader.(*vheader.PacketIdHeader).PacketId
-				mc.OnPublish(*mc, mc.userData, mid)
-			}
-			return true, nil
-		}
-
-	} else if qos == 2 {
-		// Read PUBREC
+		mc.log(logger.DEBUG, "publish wrote", "bytes", n)
+		mc.metrics.Published(qos)
 
-		bb, err := mc.Read()
-		if err != nil {
-			log.Printf("Read Error: %s\n", err)
-			return false, err
+		if mc.OnPublish != nil {
+			mc.OnPublish(mc, mc.userData, 0)
 		}
+		return true, nil
+	}
 
-		pubRec := packet.Decode(bb.Bytes())
-		mc.ShowPacket(pubRec)
-
-		if pubRec.Header.Control == header.PUBREC {
-			mid := pubRec.VariableHeader.(*vheader.PacketIdHeader).PacketId
-
-			// Send a PUBREL
-			// The variable header contains the same Packet Identifier as the PUBREC Packet that is being acknowledged
-			mh := header.New(header.WithPubrel())
-			mvh := vheader.NewPacketIdHeader(mid)
-			mp := packet.NewMqttPacket(mh, packet.WithVariableHeader(mvh))
+	// Kept until acknowledged to be sent again if the session is resumed after a disconnection
+	data, err := packet.Encode(mp)
+	if err != nil {
+		return false, err
+	}
+	if !mc.fits(len(data)) {
+		return false, ErrPacketTooLarge
+	}
+	mc.mu.Lock()
+	// The window may have been replaced by a reconnection since the slot was taken
+	if window != nil && window != mc.inflight {
+		releaseInflight(window)
+		window = mc.takeInflight()
+	}
+	mc.pending = append(mc.pending, &outgoing{packetId: mvh.PacketId, data: data, window: window})
+	mc.metrics.InFlight(len(mc.pending))
+	mc.mu.Unlock()
+	window = nil
 
-			mc.ShowPacket(mp)
+	start := time.Now()
+	n, err := mc.Write(data)
+	if err != nil {
+		mc.log(logger.ERROR, "write failed", "err", err)
+		return false, err
+	}
 
-			_, err := (*mc.conn).Write(packet.Encode(mp))
-			if err != nil {
-				log.Printf("Write Error: %s\n", err)
-				return false, err
-			}
+	mc.log(logger.DEBUG, "publish wrote", "bytes", n)
+	mc.metrics.Published(qos)
 
-			// Read PUBCOMB
-			bb, err := mc.Read()
-			if err != nil {
-				log.Printf("Read Error: %s\n", err)
-				return false, err
-			}
+	// QoS 1: PUBACK, QoS 2: PUBREC then PUBCOMP after our PUBREL
+	expected := []byte{header.PUBACK}
+	if qos == QOS_2 {
+		expected = []byte{header.PUBREC, header.PUBCOMP}
+	}
 
-			pubComb := packet.Decode(bb.Bytes())
-			mc.ShowPacket(pubComb)
+	for i, control := range expected {
+		reply, err := mc.awaitContext(ctx, r, waiter)
+		if err != nil {
+			mc.log(logger.ERROR, "read failed", "err", err)
+			return false, err
+		}
 
-			if pubComb.Header.Control == header.PUBCOMP {
-				if mc.OnPublish != nil {
-					mid := pubRec.VariableHeader.(*vheader.PacketIdHeader).PacketId
-					mc.OnPublish(*mc, mc.userData, mid)
-				}
-			}
+		ack := mc.decode(reply)
+		if ack == nil {
+			return false, fmt.Errorf("unexpected or malformed packet 0x%X", reply[0])
+		}
+		mc.ShowPacket(ack)
 
-		} else {
+		if ack.Header.Control&0xF0 != control {
 			return false, nil
 		}
 
+		// Waiting for the PUBCOMP before sending the PUBREL
+		if i+1 < len(expected) {
+			waiter = mc.expect(r)
+		}
+		mc.acknowledge(control, mvh.PacketId)
+	}
+	mc.metrics.Acknowledged(qos, time.Since(start))
+
+	if mc.OnPublish != nil {
+		mc.OnPublish(mc, mc.userData, mvh.PacketId)
 	}
 
 	return true, nil
@@ -530,110 +2142,381 @@ func (mc *MqttClient) Ping() (bool, error) {
 	mc.ShowPacket(mp)
 
 	// Write PINGREQ
-	n, err := (*mc.conn).Write(packet.Encode(mp))
+	r := response{control: header.PINGRESP}
+	waiter := mc.expect(r)
+	start := time.Now()
+	n, err := mc.writePacket(mp)
 	if err != nil {
-		log.Printf("Write Error: %s\n", err)
+		mc.forget(r, waiter)
+		mc.log(logger.ERROR, "write failed", "err", err)
 		return false, err
 	}
 
-	log.Printf("Wrote %d byte(s)\n", n)
+	mc.log(logger.DEBUG, "wrote", "bytes", n)
 
 	// Read PINGRESP
 
-	bb, err := mc.Read()
+	data, err := mc.await(r, waiter)
 	if err != nil {
-		log.Printf("Read Error: %s\n", err)
+		mc.log(logger.ERROR, "read failed", "err", err)
 		return false, err
 	}
 
-	pingResp := packet.Decode(bb.Bytes())
+	pingResp := mc.decode(data)
 	mc.ShowPacket(pingResp)
 
-	if pingResp.Header.Control == header.PINGRESP {
+	if pingResp != nil && pingResp.Header.Control == header.PINGRESP {
+		mc.metrics.Pinged(time.Since(start))
 		return true, nil
 	}
 
 	return false, nil
 }
 
+// Send a PINGREQ every third of the keep alive, until Shutdown
 func (mc *MqttClient) LoopStart() {
-	start := time.Now()
+	if !mc.startLoop() {
+		return
+	}
+	defer mc.loops.Done()
+
 	for {
-		elapsed := time.Since(start).Seconds()
-		if int(math.Ceil(elapsed)) >= int(mc.connInfos.KeepAlive/3) {
-			mc.Ping()
-			start = time.Now()
+		interval := time.Duration(mc.infos().KeepAlive/3) * time.Second
+		if interval < time.Second {
+			interval = time.Second
 		}
+
+		select {
+		case <-mc.stop:
+			return
+		case <-time.After(interval):
+		}
+
+		mc.Ping()
 	}
 }
 
+// Read the messages and connect again when the connection is lost, until Shutdown
 func (mc *MqttClient) LoopForever() {
+	if !mc.startLoop() {
+		return
+	}
+	defer mc.loops.Done()
+
+	mc.mu.Lock()
+	mc.forever++
+	mc.mu.Unlock()
+	defer func() {
+		mc.mu.Lock()
+		mc.forever--
+		mc.mu.Unlock()
+	}()
+
+	// Wait before trying again, return false after Shutdown
+	retry := func() bool {
+		mc.setState(STATE_RECONNECTING)
+		select {
+		case <-mc.stop:
+			return false
+		case <-time.After(time.Second * 1):
+			return true
+		}
+	}
 
-	for {
-		if !mc.mqttConnected {
+	// Set once the connection is lost, the next connection is a reconnection
+	lost := false
+
+	for !mc.stopped() {
+		if !mc.isConnected() {
 			_, connErr := mc.Connect()
 			if connErr != nil {
-				log.Println("Trying reset the connection...:", connErr.Error())
-				time.Sleep(time.Second * 1)
+				mc.log(logger.WARN, "connection failed, retrying", "err", connErr)
+				if !retry() {
+					return
+				}
 				continue
 			}
 
-			// Try subscribe
-			for _, v := range mc.subscribed {
-				mc.Subscribe(v.Topic, v.Qos)
+			_, sessionPresent, connErr := mc.mqttConnectSession()
+			if connErr != nil {
+				mc.log(logger.WARN, "connection failed, retrying", "err", connErr)
+				mc.Close()
+				if !retry() {
+					return
+				}
+				continue
+			}
+			if lost {
+				mc.metrics.Reconnected()
 			}
-		}
 
-		for {
+			// Try subscribe, unless the server kept the subscriptions with the session
+			mc.mu.Lock()
+			resubscribe := !sessionPresent || mc.forceResubscribe
+			subs := make([]subscription.Subscription, 0, len(mc.subscribed))
+			for _, v := range mc.subscribed {
+				subs = append(subs, v)
+			}
+			mc.mu.Unlock()
 
-			b1, err := mc.Read()
-			if err != nil {
-				log.Printf("Error: %s\n", err)
-				if err == io.EOF {
-					// Do something smart
+			if resubscribe {
+				for i := range subs {
+					mc.subscribe(&subs[i])
 				}
-				mc.mqttConnected = false
-				mc.Close()
-				break
 			}
+		}
+
+		mc.Loop()
+
+		// Connection lost
+		lost = true
+		if !mc.stopped() {
+			mc.setState(STATE_RECONNECTING)
+		}
+	}
+}
+
+// Read and dispatch the messages until the connection is lost
+// Return the reason, the network connection is closed
+func (mc *MqttClient) Loop() error {
+
+	if !mc.startLoop() {
+		return ErrClientClosed
+	}
+	defer mc.loops.Done()
+
+	for {
 
-			// log.Printf("Read: %d byte(s)\n", n)
+		// Other goroutines may read between two packets while waiting for a response
+		mc.reader <- struct{}{}
 
-			// b1 := bytes.NewBuffer(buffer[:n])
-			// log.Printf("Len of buffer: %d byte(s)\n", b1.Len())
+		b1, err := mc.Read()
+		if err != nil {
+			<-mc.reader
+			mc.log(logger.ERROR, "connection lost", "err", err)
+			mc.Close()
+			return err
+		}
 
-			control, _ := b1.ReadByte()
+		notify, err := mc.dispatch(b1.Bytes())
+		<-mc.reader
 
-			log.Printf("Header control: %b\n", control)
+		if notify != nil {
+			notify()
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
 
-			// log.Printf("Len of buffer: %d byte(s)\n", b1.Len())
+// Handle a packet read by the goroutine holding the reader token: the responses go
+// to the goroutines waiting for them, the acknowledgements are sent
+// The returned function calls the callbacks, once the token is released
+// Return an error when the connection is closed
+func (mc *MqttClient) dispatch(data []byte) (func(), error) {
 
-			nb, _ := header.RemaingLengthDecode(b1.Bytes())
-			// log.Printf("Read length: %d %d \n", nb, rLength)
-			remainingLength := b1.Next(nb)
+	control := data[0]
 
-			log.Printf("Header remainingLength: %b\n", remainingLength)
+	mc.log(logger.DEBUG, "header", "control", header.ControlToString(control))
 
-			// log.Printf("Len of buffer: %d byte(s)\n", b1.Len())
+	if control&0xF0 == header.DISCONNECT {
+		mp := mc.decode(data)
+		return func() { mc.serverDisconnect(mp) }, ErrServerDisconnect
+	}
 
-			// topicLen, topicMsg := util.StringDecode(b1.Bytes())
+	if mc.respond(data) {
+		return nil, nil
+	}
 
-			topicLen := util.Bytes2uint16(b1.Next(2))
-			b1.Next(int(topicLen))
+	switch control & 0xF0 {
+	case header.PUBLISH, header.PUBACK, header.PUBREC, header.PUBREL, header.PUBCOMP:
+	default:
+		mc.log(logger.DEBUG, "ignored packet", "control", header.ControlToString(control))
+		return nil, nil
+	}
 
-			// topicMsg := string(b1.Next(int(topicLen)))
-			// log.Printf("Read Topic: %d  [%s] \n", topicLen, topicMsg)
+	// A malformed packet is a protocol error of the server, the connection is closed
+	p, err := mc.parse(data)
+	if err != nil {
+		if !errors.Is(err, packet.ErrMalformedPacket) {
+			err = fmt.Errorf("%w: %v", packet.ErrMalformedPacket, err)
+		}
+		mc.log(logger.ERROR, "malformed packet", "control", header.ControlToString(control), "err", err)
+		mc.disconnectWithReason(reason.MALFORMED_PACKET)
+		return nil, err
+	}
 
-			// log.Printf("Len of buffer: %d byte(s)\n", b1.Len())
+	var mid uint16
+	switch p := p.(type) {
+	case *packet.Pubrel:
+		// Last step of an inbound QoS 2 message
+		mc.mu.Lock()
+		delete(mc.received, p.PacketID)
+		mc.mu.Unlock()
+		mc.ack(header.PUBCOMP, p.PacketID)
+		return nil, nil
+	case *packet.Puback:
+		mid = p.PacketID
+	case *packet.Pubrec:
+		mid = p.PacketID
+	case *packet.Pubcomp:
+		mid = p.PacketID
+	case *packet.Publish:
+		return mc.receive(p)
+	}
 
-			msg := string(b1.Bytes())
-			// log.Printf("Read msg: [%s]\n", msgMsg)
+	// Acknowledgement of a message sent again after a reconnection
+	if mc.acknowledge(control&0xF0, mid) && control&0xF0 != header.PUBREC && mc.OnPublish != nil {
+		return func() { mc.OnPublish(mc, mc.userData, mid) }, nil
+	}
+	return nil, nil
+}
 
-			if mc.OnMessage != nil {
-				mc.OnMessage(*mc, mc.userData, msg)
+// Handle an inbound PUBLISH: acknowledge it and return the delivery of the message
+func (mc *MqttClient) receive(p *packet.Publish) (func(), error) {
+
+	topicName := p.Topic
+	qos := p.Qos
+	mid := p.PacketID
+	properties := p.Properties
+	mc.metrics.Received(qos)
+
+	// Trace context sent with the message, in a user property or in the payload envelope
+	body := p.Payload
+	var parent string
+	if properties != nil {
+		for _, u := range properties.User {
+			if u.Key == tracing.TRACEPARENT && tracing.Valid(u.Value) {
+				parent = u.Value
+				break
 			}
+		}
+	} else if mc.envelope != nil {
+		parent, body = mc.envelope.Unwrap(body)
+	}
+
+	msg := string(body)
+
+	// The server must not exceed the receive maximum we advertised, the QoS 1 or 2
+	// message counts with the QoS 2 messages waiting for their PUBREL
+	duplicate := false
+	if qos > 0 {
+		mc.mu.Lock()
+		duplicate = qos == QOS_2 && mc.received[mid]
+		exceeded := mc.receiveMaximum != 0 && !duplicate && len(mc.received) >= int(mc.receiveMaximum)
+		if !exceeded && qos == QOS_2 {
+			mc.received[mid] = true
+		}
+		mc.mu.Unlock()
+
+		if exceeded {
+			mc.log(logger.ERROR, "receive maximum exceeded", "err", ErrReceiveMaximumExceeded)
+			mc.disconnectWithReason(reason.RECEIVE_MAXIMUM_EXCEEDED)
+			return nil, ErrReceiveMaximumExceeded
+		}
+	}
+
+	if qos == QOS_1 {
+		mc.ack(header.PUBACK, mid)
+	} else if qos == QOS_2 {
+		mc.ack(header.PUBREC, mid)
+		// Already delivered, the server sent it again before our PUBREC
+		if duplicate {
+			return nil, nil
+		}
+	}
+
+	message := &Message{
+		Topic:      topicName,
+		Payload:    msg,
+		Qos:        qos,
+		Retain:     p.Retain,
+		Properties: properties,
+	}
+
+	return func() {
+		if mc.tracer != nil {
+			span := mc.tracer.StartReceive(topicName, parent)
+			defer span.End(nil)
+			message.TraceParent = span.TraceParent()
+		}
+
+		mc.receiveChain(mc.deliver)(message)
+	}, nil
+}
+
+// Last step of the receive chain: the callbacks and the handlers
+func (mc *MqttClient) deliver(message *Message) {
+	if mc.OnMessageReceived != nil {
+		mc.OnMessageReceived(mc, mc.userData, message)
+	}
+
+	if mc.route(message.Properties, message.Topic, message.Payload) {
+		return
+	}
+
+	if mc.OnMessage != nil {
+		mc.OnMessage(mc, mc.userData, message.Payload)
+	}
+}
+
+// Call the handlers of the subscription identifiers carried by the message,
+// or else the handlers of the topic filters matching the topic
+// Return false if no handler was found
+func (mc *MqttClient) route(properties *property.Properties, topicName string, msg string) bool {
+
+	var handlers []MessageHandler
 
+	mc.mu.Lock()
+	if properties != nil {
+		for _, id := range properties.SubscriptionIdentifier {
+			if handler, ok := mc.handlers[id]; ok {
+				handlers = append(handlers, handler)
+			}
+		}
+	}
+	if len(handlers) == 0 {
+		for _, e := range mc.router.Match(topicName) {
+			if handler, ok := mc.topicHandlers[e.Id.(string)]; ok {
+				handlers = append(handlers, handler)
+			}
 		}
 	}
+	mc.mu.Unlock()
 
+	// The handlers are called without the lock, they may use the client
+	for _, handler := range handlers {
+		handler(mc, mc.userData, msg)
+	}
+
+	return len(handlers) > 0
+}
+
+// Acknowledge an inbound message with a PUBACK, PUBREC or PUBCOMP
+func (mc *MqttClient) ack(control byte, packetId uint16) error {
+	mh := header.New(header.WithControl(control))
+	mvh := vheader.NewPacketIdHeader(packetId)
+	mp := packet.NewMqttPacket(mh, packet.WithVariableHeader(mvh))
+
+	mc.ShowPacket(mp)
+
+	_, err := mc.writePacket(mp)
+	if err != nil {
+		mc.log(logger.ERROR, "write failed", "err", err)
+	}
+
+	return err
+}
+
+// Close the connection after a protocol error of the server
+// A MQTT 5 server is told the reason with a DISCONNECT
+func (mc *MqttClient) disconnectWithReason(reasonCode byte) {
+	if mc.isV5() {
+		mh := header.New(header.WithControl(header.DISCONNECT))
+		mvh := vheader.NewDisconnectHeader(reasonCode, nil)
+		mc.writePacket(packet.NewMqttPacket(mh, packet.WithVariableHeader(mvh)))
+	}
+
+	mc.Close()
 }
@@ -22,24 +22,72 @@
 package client
 
 import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
 	"log"
+	"net"
+	"net/http/httptest"
 	"os"
+	"reflect"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
+	"github.com/easygithdev/mqtt/auth/scram"
+	"github.com/easygithdev/mqtt/broker"
 	"github.com/easygithdev/mqtt/client/conn"
+	"github.com/easygithdev/mqtt/client/logger"
+	"github.com/easygithdev/mqtt/client/metrics"
+	"github.com/easygithdev/mqtt/client/protocol"
+	"github.com/easygithdev/mqtt/client/subscription"
+	"github.com/easygithdev/mqtt/client/tracing"
+	"github.com/easygithdev/mqtt/packet"
+	"github.com/easygithdev/mqtt/packet/header"
+	"github.com/easygithdev/mqtt/packet/payload"
+	"github.com/easygithdev/mqtt/packet/property"
+	"github.com/easygithdev/mqtt/packet/reason"
+	"github.com/easygithdev/mqtt/packet/util"
+	"github.com/easygithdev/mqtt/packet/vheader"
+	mqtttopic "github.com/easygithdev/mqtt/topic"
 )
 
 const (
-	connHost = "mqtt.eclipseprojects.io"
-	connPort = "1883"
 	clientId = "test-golang-mqtt"
 	topic    = "hello/world"
 )
 
+// Address of the local broker started by TestMain
+var (
+	connHost string
+	connPort string
+)
+
+func TestMain(m *testing.M) {
+
+	b := broker.New()
+	addr, err := b.Start("127.0.0.1:0")
+	if err != nil {
+		log.Print("Error starting the broker:", err.Error())
+		os.Exit(1)
+	}
+
+	connHost, connPort, _ = net.SplitHostPort(addr.String())
+
+	code := m.Run()
+	b.Close()
+	os.Exit(code)
+}
+
 func TestConnectDisconnect(t *testing.T) {
 
 	mc := New(clientId,
-		WithConnInfos(conn.New(connHost)),
+		WithConnInfos(conn.New(connHost, conn.WithPort(connPort))),
 	)
 	_, connErr := mc.Connect()
 	if connErr != nil {
@@ -69,7 +117,7 @@ func TestConnectDisconnect(t *testing.T) {
 func TestPing(t *testing.T) {
 
 	mc := New(clientId,
-		WithConnInfos(conn.New(connHost)),
+		WithConnInfos(conn.New(connHost, conn.WithPort(connPort))),
 	)
 	_, connErr := mc.Connect()
 	if connErr != nil {
@@ -78,6 +126,10 @@ func TestPing(t *testing.T) {
 	}
 	defer mc.Close()
 
+	if _, err := mc.MqttConnect(); err != nil {
+		t.Fatalf("Mqtt connection fail %s", err)
+	}
+
 	response, err := mc.Ping()
 
 	if err != nil {
@@ -92,7 +144,7 @@ func TestPing(t *testing.T) {
 func TestPublish(t *testing.T) {
 
 	mc := New(clientId,
-		WithConnInfos(conn.New(connHost)),
+		WithConnInfos(conn.New(connHost, conn.WithPort(connPort))),
 	)
 	_, connErr := mc.Connect()
 	if connErr != nil {
@@ -101,6 +153,10 @@ func TestPublish(t *testing.T) {
 	}
 	defer mc.Close()
 
+	if _, err := mc.MqttConnect(); err != nil {
+		t.Fatalf("Mqtt connection fail %s", err)
+	}
+
 	response, err := mc.Publish(topic, "this is my hello world", 0, false)
 
 	if err != nil {
@@ -115,7 +171,7 @@ func TestPublish(t *testing.T) {
 func TestSubscribe(t *testing.T) {
 
 	mc := New(clientId,
-		WithConnInfos(conn.New(connHost)),
+		WithConnInfos(conn.New(connHost, conn.WithPort(connPort))),
 	)
 	_, connErr := mc.Connect()
 	if connErr != nil {
@@ -124,14 +180,18 @@ func TestSubscribe(t *testing.T) {
 	}
 	defer mc.Close()
 
-	response, err := mc.Subscribe(topic, 0)
+	if _, err := mc.MqttConnect(); err != nil {
+		t.Fatalf("Mqtt connection fail %s", err)
+	}
+
+	granted, err := mc.Subscribe(topic, QOS_1)
 
 	if err != nil {
 		t.Errorf("Mqtt subscribe fail %s", err)
 	}
 
-	if !response {
-		t.Errorf("Mqtt subscribe fail")
+	if granted != QOS_1 {
+		t.Errorf("Granted QoS found %d; want %d", granted, QOS_1)
 	}
 
 }
@@ -139,7 +199,7 @@ func TestSubscribe(t *testing.T) {
 func TestUnsubscribe(t *testing.T) {
 
 	mc := New(clientId,
-		WithConnInfos(conn.New(connHost)),
+		WithConnInfos(conn.New(connHost, conn.WithPort(connPort))),
 	)
 	_, connErr := mc.Connect()
 	if connErr != nil {
@@ -148,7 +208,17 @@ func TestUnsubscribe(t *testing.T) {
 	}
 	defer mc.Close()
 
-	response, err := mc.Subscribe(topic, 0)
+	if _, err := mc.MqttConnect(); err != nil {
+		t.Fatalf("Mqtt connection fail %s", err)
+	}
+
+	_, err := mc.Subscribe(topic, 0)
+
+	if err != nil {
+		t.Errorf("Mqtt unsubscribe fail %s", err)
+	}
+
+	response, err := mc.Unsubscribe(topic)
 
 	if err != nil {
 		t.Errorf("Mqtt unsubscribe fail %s", err)
@@ -158,14 +228,1962 @@ func TestUnsubscribe(t *testing.T) {
 		t.Errorf("Mqtt unsubscribe fail")
 	}
 
-	response, err = mc.Unsubscribe(topic)
+}
+
+// Start a local stand-in server calling handle for each connection
+func standIn(t *testing.T, handle func(c net.Conn)) *conn.MqttConn {
+	t.Helper()
 
+	l, err := net.Listen("tcp", "127.0.0.1:0")
 	if err != nil {
-		t.Errorf("Mqtt unsubscribe fail %s", err)
+		t.Fatalf("Listen error %s", err)
 	}
+	t.Cleanup(func() { l.Close() })
 
-	if !response {
-		t.Errorf("Mqtt unsubscribe fail")
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				handle(c)
+			}()
+		}
+	}()
+
+	addr := l.Addr().(*net.TCPAddr)
+	return conn.New(addr.IP.String(), conn.WithPort(fmt.Sprint(addr.Port)))
+}
+
+// Packet written by a stand-in server, built from valid fields
+func must(data []byte, err error) []byte {
+	if err != nil {
+		panic(err)
+	}
+	return data
+}
+
+// Properties of a MQTT 5 CONNECT packet
+func connectProperties(data []byte) *property.Properties {
+	_, rl := header.RemaingLengthDecode(data[1:])
+	vh := data[len(data)-rl:]
+	// protocol name, level, flags and keep alive
+	nameLen := int(vh[1])
+	p, _, _ := property.Decode(vh[2+nameLen+4:])
+	return p
+}
+
+// Run the server side of a SCRAM exchange started with clientFirst
+// and return the server-final-message
+func scramExchange(c net.Conn, clientFirst []byte) ([]byte, error) {
+	lookup := func(username string) (*scram.Credentials, bool) {
+		return scram.NewCredentials("readwrite", []byte("salt"), scram.DEFAULT_ITERATIONS), username == "rw"
+	}
+	server := scram.NewServer(lookup)
+
+	serverFirst, err := server.Start(clientFirst)
+	if err != nil {
+		return nil, err
+	}
+
+	p := property.New()
+	p.AuthenticationMethod = scram.METHOD
+	p.AuthenticationData = serverFirst
+	challenge := packet.NewMqttPacket(header.New(header.WithControl(header.AUTH)),
+		packet.WithVariableHeader(vheader.NewAuthHeader(reason.CONTINUE_AUTHENTICATION, p)))
+	c.Write(must(packet.Encode(challenge)))
+
+	data, err := packet.Read(c)
+	if err != nil {
+		return nil, err
+	}
+	ah := packet.DecodeV5(data).VariableHeader.(*vheader.AuthHeader)
+
+	return server.Finish(ah.Properties.AuthenticationData)
+}
+
+func TestEnhancedAuthentication(t *testing.T) {
+
+	done := make(chan error, 1)
+
+	connInfos := standIn(t, func(c net.Conn) {
+		data, err := packet.Read(c)
+		if err != nil {
+			done <- err
+			return
+		}
+
+		p := connectProperties(data)
+		if p.AuthenticationMethod != scram.METHOD {
+			done <- fmt.Errorf("authentication method found %s", p.AuthenticationMethod)
+			return
+		}
+
+		serverFinal, err := scramExchange(c, p.AuthenticationData)
+		if err != nil {
+			done <- err
+			return
+		}
+
+		ap := property.New()
+		ap.AuthenticationMethod = scram.METHOD
+		ap.AuthenticationData = serverFinal
+		connack := packet.NewMqttPacket(header.New(header.WithControl(header.CONNACK)),
+			packet.WithVariableHeader(vheader.NewGenericHeader(append([]byte{0, reason.SUCCESS}, ap.Encode()...))))
+		c.Write(must(packet.Encode(connack)))
+
+		// Re-authentication
+		data, err = packet.Read(c)
+		if err != nil {
+			done <- err
+			return
+		}
+		ah := packet.DecodeV5(data).VariableHeader.(*vheader.AuthHeader)
+		if ah.ReasonCode != reason.RE_AUTHENTICATE {
+			done <- fmt.Errorf("reason code found 0x%X; want 0x19", ah.ReasonCode)
+			return
+		}
+
+		serverFinal, err = scramExchange(c, ah.Properties.AuthenticationData)
+		if err != nil {
+			done <- err
+			return
+		}
+
+		ap.AuthenticationData = serverFinal
+		success := packet.NewMqttPacket(header.New(header.WithControl(header.AUTH)),
+			packet.WithVariableHeader(vheader.NewAuthHeader(reason.SUCCESS, ap)))
+		c.Write(must(packet.Encode(success)))
+
+		done <- nil
+	})
+
+	mc := New(clientId,
+		WithConnInfos(connInfos),
+		WithProtocol(protocol.PROTOCOL_NAME, protocol.PROTOCOL_LEVEL_5),
+		WithAuthenticator(scram.NewClient("rw", "readwrite")),
+	)
+	if _, err := mc.Connect(); err != nil {
+		t.Fatalf("Error connecting: %s", err)
+	}
+	defer mc.Close()
+
+	if response, err := mc.MqttConnect(); err != nil || !response {
+		t.Fatalf("Mqtt connection fail %v", err)
+	}
+
+	if response, err := mc.Reauthenticate(); err != nil || !response {
+		t.Fatalf("Mqtt re-authentication fail %v", err)
+	}
+
+	if err := <-done; err != nil {
+		t.Errorf("Stand-in error %s", err)
+	}
+}
+
+func TestSubscribeOptions(t *testing.T) {
+
+	received := make(chan []byte, 1)
+
+	connInfos := standIn(t, func(c net.Conn) {
+		packet.Read(c)
+		connack := packet.NewMqttPacket(header.New(header.WithControl(header.CONNACK)),
+			packet.WithVariableHeader(vheader.NewGenericHeader([]byte{0, reason.SUCCESS, 0})))
+		c.Write(must(packet.Encode(connack)))
+
+		data, _ := packet.Read(c)
+		received <- data
+
+		id := util.Bytes2uint16(data[2:4])
+		suback := packet.NewMqttPacket(header.New(header.WithControl(header.SUBACK)),
+			packet.WithVariableHeader(vheader.NewPacketIdHeader(id)),
+			packet.WithPayload(payload.New(payload.WithQos(reason.GRANTED_QOS_1))))
+		suback.VariableHeader.(*vheader.PacketIdHeader).Properties = property.New()
+		c.Write(must(packet.Encode(suback)))
+	})
+
+	mc := New(clientId,
+		WithConnInfos(connInfos),
+		WithProtocol(protocol.PROTOCOL_NAME, protocol.PROTOCOL_LEVEL_5),
+	)
+	if _, err := mc.Connect(); err != nil {
+		t.Fatalf("Error connecting: %s", err)
+	}
+	defer mc.Close()
+
+	filter := subscription.Share("workers", topic)
+	granted, err := mc.Subscribe(filter, QOS_1,
+		subscription.WithRetainAsPublished(),
+		subscription.WithRetainHandling(subscription.RETAIN_HANDLING_DO_NOT_SEND),
+		subscription.WithSubscriptionIdentifier(42),
+	)
+	if err != nil || granted != QOS_1 {
+		t.Fatalf("Mqtt subscribe fail %d %v", granted, err)
+	}
+
+	data := <-received
+	// fixed header, packet id, properties
+	p, n, err := property.Decode(data[4:])
+	if err != nil || len(p.SubscriptionIdentifier) != 1 || p.SubscriptionIdentifier[0] != 42 {
+		t.Errorf("Subscription identifier not found in %v", data)
+	}
+	_, decoded, _ := util.StringDecode(data[4+n:])
+	if decoded != filter {
+		t.Errorf("Topic filter found %s; want %s", decoded, filter)
+	}
+	if options := data[len(data)-1]; options != 0x29 {
+		t.Errorf("Subscription options found 0x%X; want 0x29", options)
+	}
+
+	if _, err := mc.Subscribe(filter, QOS_0, subscription.WithNoLocal()); err == nil {
+		t.Errorf("No local on a shared subscription should fail")
+	}
+}
+
+func TestRouteBySubscriptionIdentifier(t *testing.T) {
+
+	mc := New(clientId)
+
+	var routed []string
+	mc.AddMessageHandler(1, func(mc *MqttClient, userData interface{}, message string) {
+		routed = append(routed, "1:"+message)
+	})
+	mc.AddMessageHandler(2, func(mc *MqttClient, userData interface{}, message string) {
+		routed = append(routed, "2:"+message)
+	})
+
+	p := property.New()
+	p.SubscriptionIdentifier = []int{2, 3}
+	if !mc.route(p, topic, "hello") {
+		t.Errorf("Message should be routed")
+	}
+
+	p.SubscriptionIdentifier = []int{3}
+	if mc.route(p, topic, "world") || mc.route(nil, topic, "world") {
+		t.Errorf("Message should not be routed")
+	}
+
+	if len(routed) != 1 || routed[0] != "2:hello" {
+		t.Errorf("Routed found %v; want [2:hello]", routed)
+	}
+}
+
+func TestRouteByTopic(t *testing.T) {
+
+	mc := New(clientId)
+
+	var routed []string
+	mc.AddTopicHandler("sensors/+/temperature", func(mc *MqttClient, userData interface{}, message string) {
+		routed = append(routed, "temperature:"+message)
+	})
+	mc.AddTopicHandler(subscription.Share("workers", "sensors/#"), func(mc *MqttClient, userData interface{}, message string) {
+		routed = append(routed, "workers:"+message)
+	})
+
+	if !mc.route(nil, "sensors/kitchen/temperature", "21") || !mc.route(nil, "sensors/kitchen/humidity", "40") {
+		t.Errorf("Message should be routed")
+	}
+
+	mc.RemoveTopicHandler(subscription.Share("workers", "sensors/#"))
+	if mc.route(nil, "sensors/kitchen/humidity", "41") || mc.route(nil, "other", "0") {
+		t.Errorf("Message should not be routed")
+	}
+
+	sort.Strings(routed)
+	if fmt.Sprint(routed) != "[temperature:21 workers:21 workers:40]" {
+		t.Errorf("Routed found %v", routed)
+	}
+}
+
+// Nothing is written for an invalid topic, the client is not even connected
+func TestSubscribeMultiple(t *testing.T) {
+
+	mc := New(clientId,
+		WithConnInfos(conn.New(connHost, conn.WithPort(connPort))),
+	)
+	if _, err := mc.Connect(); err != nil {
+		t.Fatalf("Connect error %s", err)
+	}
+	defer mc.Close()
+
+	codes, err := mc.SubscribeMultiple(
+		subscription.New("multiple/a", QOS_0),
+		subscription.New("multiple/b/+", QOS_1),
+		subscription.New("multiple/c/#", QOS_2),
+	)
+	if err != nil {
+		t.Fatalf("SubscribeMultiple error %s", err)
+	}
+	if string(codes) != string([]byte{QOS_0, QOS_1, QOS_2}) {
+		t.Errorf("SubscribeMultiple found %v; want [0 1 2]", codes)
+	}
+	if len(mc.subscribed) != 3 {
+		t.Errorf("Subscriptions found %d; want 3", len(mc.subscribed))
+	}
+
+	if ok, err := mc.UnsubscribeMultiple("multiple/a", "multiple/b/+"); !ok || err != nil {
+		t.Errorf("UnsubscribeMultiple failed %v", err)
+	}
+	if _, ok := mc.subscribed["multiple/c/#"]; !ok || len(mc.subscribed) != 1 {
+		t.Errorf("Subscriptions found %v; want multiple/c/#", mc.subscribed)
+	}
+
+	if _, err := mc.SubscribeMultiple(); err == nil {
+		t.Errorf("SubscribeMultiple without filter should fail")
+	}
+	if _, err := mc.SubscribeMultiple(subscription.New("multiple/a", QOS_0), subscription.New("multiple/#/b", QOS_0)); err == nil {
+		t.Errorf("SubscribeMultiple with an invalid filter should fail")
+	}
+}
+
+func TestSubscribeGrantedQos(t *testing.T) {
+
+	// The stand-in grants at most QoS 1 and refuses the denied/ topics
+	connInfos := standIn(t, func(c net.Conn) {
+		packet.Read(c)
+		c.Write(must((&packet.Connack{ReturnCode: header.CONNECT_ACCEPTED}).Encode()))
+
+		for {
+			data, err := packet.Read(c)
+			if err != nil {
+				return
+			}
+			p, err := packet.Parse(data)
+			if err != nil {
+				return
+			}
+			sub := p.(*packet.Subscribe)
+			suback := &packet.Suback{PacketID: sub.PacketID}
+			for _, f := range sub.Filters {
+				code := f.Options & 0x03
+				if code > QOS_1 {
+					code = QOS_1
+				}
+				if strings.HasPrefix(f.Filter, "denied/") {
+					code = 0x80
+				}
+				suback.ReturnCodes = append(suback.ReturnCodes, code)
+			}
+			c.Write(must(suback.Encode()))
+		}
+	})
+
+	mc := New(clientId, WithConnInfos(connInfos))
+	if _, err := mc.Connect(); err != nil {
+		t.Fatalf("Connect error %s", err)
+	}
+	defer mc.Close()
+
+	var grantedQos []byte
+	mc.OnSubscribe = func(mc *MqttClient, userData interface{}, mid uint16, granted []byte) {
+		grantedQos = granted
+	}
+
+	// Downgraded by the server
+	granted, err := mc.Subscribe("allowed/a", QOS_2)
+	if err != nil || granted != QOS_1 {
+		t.Errorf("Subscribe found %d (%v); want %d", granted, err, QOS_1)
+	}
+	if sub := mc.subscribed["allowed/a"]; sub.Qos != QOS_2 || sub.GrantedQos != QOS_1 {
+		t.Errorf("Subscription found %+v; want QoS 2 granted 1", sub)
+	}
+	if string(grantedQos) != string([]byte{QOS_1}) {
+		t.Errorf("OnSubscribe found %v; want [1]", grantedQos)
+	}
+
+	// Refused by the server
+	granted, err = mc.Subscribe("denied/a", QOS_0)
+	if !errors.Is(err, ErrSubscriptionFailed) || granted != 0x80 {
+		t.Errorf("Subscribe found 0x%X (%v); want 0x80 (%v)", granted, err, ErrSubscriptionFailed)
+	}
+	if _, ok := mc.subscribed["denied/a"]; ok {
+		t.Errorf("A refused subscription should not be kept")
+	}
+
+	codes, err := mc.SubscribeMultiple(subscription.New("allowed/b", QOS_0), subscription.New("denied/b", QOS_1))
+	if !errors.Is(err, ErrSubscriptionFailed) || string(codes) != string([]byte{QOS_0, 0x80}) {
+		t.Errorf("SubscribeMultiple found %v (%v); want [0 128] (%v)", codes, err, ErrSubscriptionFailed)
+	}
+	if _, ok := mc.subscribed["allowed/b"]; !ok || len(mc.subscribed) != 2 {
+		t.Errorf("Subscriptions found %v; want allowed/a and allowed/b", mc.subscribed)
+	}
+}
+
+func TestTopicValidation(t *testing.T) {
+
+	mc := New(clientId)
+
+	for _, name := range []string{"", "hello/+", "hello/#", "hello\x00"} {
+		if _, err := mc.Publish(name, "msg", QOS_0, false); err == nil {
+			t.Errorf("Publish on %q should fail", name)
+		}
+	}
+
+	for _, filter := range []string{"", "hello/#/world", "hello+", subscription.Share("group", "hello#")} {
+		if _, err := mc.Subscribe(filter, QOS_0); err == nil {
+			t.Errorf("Subscribe to %q should fail", filter)
+		}
+		if _, err := mc.Unsubscribe(filter); err == nil {
+			t.Errorf("Unsubscribe from %q should fail", filter)
+		}
+	}
+
+	if _, err := mc.Publish("hello/#", "msg", QOS_0, false); !errors.Is(err, mqtttopic.ErrWildcardInName) {
+		t.Errorf("Publish error found %v; want %v", err, mqtttopic.ErrWildcardInName)
+	}
+}
+
+func TestStringValidation(t *testing.T) {
+
+	// The username is a UTF-8 string, the password binary data
+	mc := New(
+		clientId,
+		WithConnInfos(conn.New(connHost, conn.WithPort(connPort))),
+		WithCredentials("user\xff", "\xff"),
+	)
+	if _, err := mc.Connect(); err != nil {
+		t.Fatalf("Connect error %s", err)
+	}
+	if _, err := mc.MqttConnect(); !errors.Is(err, util.ErrInvalidUTF8) {
+		t.Errorf("Connect error found %v; want %v", err, util.ErrInvalidUTF8)
+	}
+	mc.Close()
+
+	mc = New(
+		clientId,
+		WithConnInfos(conn.New(connHost, conn.WithPort(connPort))),
+		WithCredentials("user", "\xff"),
+	)
+	if _, err := mc.Connect(); err != nil {
+		t.Fatalf("Connect error %s", err)
+	}
+	if _, err := mc.MqttConnect(); err != nil {
+		t.Errorf("Connect with a binary password failed: %s", err)
+	}
+	mc.Close()
+}
+
+func TestSessionPresent(t *testing.T) {
+
+	connect := func(mc *MqttClient) {
+		t.Helper()
+		if _, err := mc.Connect(); err != nil {
+			t.Fatalf("Connect error %s", err)
+		}
+		if _, err := mc.MqttConnect(); err != nil {
+			t.Fatalf("MqttConnect error %s", err)
+		}
+	}
+
+	// The broker is shared by the tests, the session must be new
+	mc := New(fmt.Sprint("session-present-", time.Now().UnixNano()),
+		WithConnInfos(conn.New(connHost, conn.WithPort(connPort))),
+		WithCleanSession(false),
+	)
+
+	// The flag of each connection is passed to OnConnect
+	var present []bool
+	mc.OnConnect = func(mc *MqttClient, userData interface{}, rc net.Conn, sessionPresent bool) {
+		present = append(present, sessionPresent)
+	}
+
+	connect(mc)
+	if mc.SessionPresent() {
+		t.Errorf("Session present on the first connection")
 	}
+	mc.Close()
 
+	connect(mc)
+	if !mc.SessionPresent() {
+		t.Errorf("Session not present on the second connection")
+	}
+	mc.Close()
+
+	if !reflect.DeepEqual(present, []bool{false, true}) {
+		t.Errorf("OnConnect found session present %v; want [false true]", present)
+	}
+}
+
+func TestSessionResume(t *testing.T) {
+
+	// First connection : the PUBLISH is not acknowledged
+	// Second connection : the session is present, the PUBLISH is sent again
+	// Third connection : the session is lost, nothing is sent again
+	published := make(chan []byte, 2)
+	connections := make(chan int, 3)
+	for i := 0; i < 3; i++ {
+		connections <- i
+	}
+
+	connInfos := standIn(t, func(c net.Conn) {
+		i := <-connections
+		packet.Read(c)
+		c.Write(must((&packet.Connack{SessionPresent: i == 1, ReturnCode: header.CONNECT_ACCEPTED}).Encode()))
+
+		data, err := packet.Read(c)
+		if err != nil {
+			return
+		}
+		published <- data
+
+		if i == 1 {
+			p, _ := packet.Parse(data)
+			if pub, ok := p.(*packet.Publish); ok {
+				c.Write(must((&packet.Puback{PacketID: pub.PacketID}).Encode()))
+			}
+			packet.Read(c)
+		}
+	})
+
+	mc := New(clientId, WithConnInfos(connInfos), WithCleanSession(false))
+	acknowledged := make(chan uint16, 1)
+	mc.OnPublish = func(mc *MqttClient, userData interface{}, mid uint16) {
+		acknowledged <- mid
+	}
+
+	if _, err := mc.Connect(); err != nil {
+		t.Fatalf("Connect error %s", err)
+	}
+	if ok, err := mc.Publish("resume/a", "in flight", QOS_1, false); ok || err == nil {
+		t.Fatalf("Publish without PUBACK should fail")
+	}
+	first, err := packet.Parse(<-published)
+	if err != nil {
+		t.Fatalf("Parse error %s", err)
+	}
+	mc.Close()
+
+	if _, err := mc.Connect(); err != nil {
+		t.Fatalf("Connect error %s", err)
+	}
+	if _, err := mc.MqttConnect(); err != nil || !mc.SessionPresent() {
+		t.Fatalf("MqttConnect found session present %t (%v); want true", mc.SessionPresent(), err)
+	}
+	done := make(chan error, 1)
+	go func() { done <- mc.Loop() }()
+
+	again, err := packet.Parse(<-published)
+	if err != nil {
+		t.Fatalf("Parse error %s", err)
+	}
+	pub := again.(*packet.Publish)
+	if !pub.Dup || pub.PacketID != first.(*packet.Publish).PacketID || string(pub.Payload) != "in flight" {
+		t.Errorf("PUBLISH sent again found %+v; want %+v with DUP", pub, first)
+	}
+	select {
+	case mid := <-acknowledged:
+		if mid != pub.PacketID {
+			t.Errorf("OnPublish found %d; want %d", mid, pub.PacketID)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("PUBACK of the message sent again not handled")
+	}
+	mc.Close()
+	<-done
+
+	// Nothing in flight is sent again to a new session
+	mc.pending = append(mc.pending, &outgoing{packetId: 42, data: must(first.Encode())})
+	if _, err := mc.Connect(); err != nil {
+		t.Fatalf("Connect error %s", err)
+	}
+	if _, err := mc.MqttConnect(); err != nil || mc.SessionPresent() {
+		t.Fatalf("MqttConnect found session present %t (%v); want false", mc.SessionPresent(), err)
+	}
+	mc.Ping()
+	if data := <-published; data[0]&0xF0 != header.PINGREQ {
+		t.Errorf("Packet found %s; want PINGREQ", header.ControlToString(data[0]))
+	}
+	if len(mc.pending) != 0 {
+		t.Errorf("Messages in flight found %d; want 0", len(mc.pending))
+	}
+	mc.Close()
+}
+
+func TestSessionExpiry(t *testing.T) {
+
+	received := make(chan *packet.MqttPacket, 1)
+
+	connInfos := standIn(t, func(c net.Conn) {
+		data, _ := packet.Read(c)
+		p := connectProperties(data)
+		if p.SessionExpiryInterval == nil || *p.SessionExpiryInterval != 60 {
+			received <- nil
+			return
+		}
+
+		ap := property.New()
+		ap.SessionExpiryInterval = property.Uint32(30)
+		ap.ServerKeepAlive = property.Uint16(10)
+		connack := packet.NewMqttPacket(header.New(header.WithControl(header.CONNACK)),
+			packet.WithVariableHeader(vheader.NewGenericHeader(append([]byte{0, reason.SUCCESS}, ap.Encode()...))))
+		c.Write(must(packet.Encode(connack)))
+
+		data, _ = packet.Read(c)
+		received <- packet.DecodeV5(data)
+	})
+
+	mc := New(clientId,
+		WithConnInfos(connInfos),
+		WithProtocol(protocol.PROTOCOL_NAME, protocol.PROTOCOL_LEVEL_5),
+		WithSessionExpiry(60),
+	)
+	if _, err := mc.Connect(); err != nil {
+		t.Fatalf("Error connecting: %s", err)
+	}
+
+	if response, err := mc.MqttConnect(); err != nil || !response {
+		t.Fatalf("Mqtt connection fail %v", err)
+	}
+
+	if mc.connInfos.KeepAlive != 10 {
+		t.Errorf("Keep alive found %d; want 10", mc.connInfos.KeepAlive)
+	}
+
+	if err := mc.SetSessionExpiry(SESSION_EXPIRY_NEVER); err != nil {
+		t.Fatalf("SetSessionExpiry error %s", err)
+	}
+
+	if response, err := mc.MqttDisconnect(); err != nil || !response {
+		t.Fatalf("Mqtt disconnect fail %v", err)
+	}
+
+	mp := <-received
+	if mp == nil {
+		t.Fatalf("Session expiry not sent with CONNECT")
+	}
+	dh, ok := mp.VariableHeader.(*vheader.DisconnectHeader)
+	if !ok || dh.Properties.SessionExpiryInterval == nil || *dh.Properties.SessionExpiryInterval != SESSION_EXPIRY_NEVER {
+		t.Errorf("Session expiry not sent with DISCONNECT: %s", mp)
+	}
+}
+
+func TestServerDisconnect(t *testing.T) {
+
+	mc := New(clientId,
+		WithConnInfos(conn.New("localhost")),
+		WithProtocol(protocol.PROTOCOL_NAME, protocol.PROTOCOL_LEVEL_5),
+		WithFollowRedirect(),
+	)
+
+	c, _ := net.Pipe()
+	mc.conn = &c
+	mc.state = STATE_CONNECTED
+
+	var found byte
+	mc.OnDisconnect = func(mc *MqttClient, userData interface{}, rc net.Conn) {
+		found, _ = mc.DisconnectReason()
+	}
+
+	p := property.New()
+	p.ServerReference = "backup.example.com:8883 other.example.com"
+	disconnect := packet.NewMqttPacket(header.New(header.WithControl(header.DISCONNECT)),
+		packet.WithVariableHeader(vheader.NewDisconnectHeader(reason.SERVER_MOVED, p)))
+
+	mc.serverDisconnect(packet.DecodeV5(must(packet.Encode(disconnect))))
+
+	if mc.State() != STATE_DISCONNECTED {
+		t.Errorf("Client should be disconnected")
+	}
+
+	if found != reason.SERVER_MOVED {
+		t.Errorf("OnDisconnect reason found 0x%X; want 0x%X", found, reason.SERVER_MOVED)
+	}
+
+	if mc.connInfos.Host != "backup.example.com" || mc.connInfos.Port != "8883" {
+		t.Errorf("Redirect found %s:%s; want backup.example.com:8883", mc.connInfos.Host, mc.connInfos.Port)
+	}
+}
+
+func TestFlowControl(t *testing.T) {
+
+	advertised := make(chan *property.Properties, 1)
+
+	connInfos := standIn(t, func(c net.Conn) {
+		data, _ := packet.Read(c)
+		advertised <- connectProperties(data)
+
+		ap := property.New()
+		ap.ReceiveMaximum = property.Uint16(1)
+		ap.MaximumPacketSize = property.Uint32(64)
+		connack := packet.NewMqttPacket(header.New(header.WithControl(header.CONNACK)),
+			packet.WithVariableHeader(vheader.NewGenericHeader(append([]byte{0, reason.SUCCESS}, ap.Encode()...))))
+		c.Write(must(packet.Encode(connack)))
+
+		// Keep the connection open until the client closes it
+		packet.Read(c)
+	})
+
+	mc := New(clientId,
+		WithConnInfos(connInfos),
+		WithProtocol(protocol.PROTOCOL_NAME, protocol.PROTOCOL_LEVEL_5),
+		WithReceiveMaximum(5),
+		WithMaximumPacketSize(1024),
+		WithPublishNoWait(),
+	)
+	if _, err := mc.Connect(); err != nil {
+		t.Fatalf("Error connecting: %s", err)
+	}
+	defer mc.Close()
+
+	if response, err := mc.MqttConnect(); err != nil || !response {
+		t.Fatalf("Mqtt connection fail %v", err)
+	}
+
+	p := <-advertised
+	if p.ReceiveMaximum == nil || *p.ReceiveMaximum != 5 || p.MaximumPacketSize == nil || *p.MaximumPacketSize != 1024 {
+		t.Errorf("Client limits not advertised: %s", p)
+	}
+
+	large := string(make([]byte, 100))
+	if _, err := mc.Publish(topic, large, QOS_0, false); err != ErrPacketTooLarge {
+		t.Errorf("Publish found error %v; want %s", err, ErrPacketTooLarge)
+	}
+
+	// Take the only slot of the window
+	window, _ := mc.acquireInflight(context.Background())
+	if mc.InFlight() != 1 {
+		t.Errorf("InFlight found %d; want 1", mc.InFlight())
+	}
+
+	if _, err := mc.Publish(topic, "hello", QOS_1, false); err != ErrReceiveMaximumExceeded {
+		t.Errorf("Publish found error %v; want %s", err, ErrReceiveMaximumExceeded)
+	}
+
+	releaseInflight(window)
+	if mc.InFlight() != 0 {
+		t.Errorf("InFlight found %d; want 0", mc.InFlight())
+	}
+}
+
+func TestInFlightWindow(t *testing.T) {
+
+	release := make(chan struct{})
+
+	// The first PUBLISH is acknowledged once released, the next ones at once
+	connInfos := standIn(t, func(c net.Conn) {
+		packet.Read(c)
+		c.Write(must((&packet.Connack{ReturnCode: header.CONNECT_ACCEPTED}).Encode()))
+		for i := 0; ; i++ {
+			data, err := packet.Read(c)
+			if err != nil {
+				return
+			}
+			p, err := packet.Parse(data)
+			publish, ok := p.(*packet.Publish)
+			if err != nil || !ok {
+				continue
+			}
+			if i == 0 {
+				<-release
+			}
+			c.Write(must((&packet.Puback{PacketID: publish.PacketID}).Encode()))
+		}
+	})
+
+	mc := New(clientId,
+		WithConnInfos(connInfos),
+		WithServerLimits(1, 0),
+		WithPublishNoWait(),
+	)
+	if _, err := mc.Connect(); err != nil {
+		t.Fatalf("Error connecting: %s", err)
+	}
+	defer mc.Close()
+	if _, err := mc.MqttConnect(); err != nil {
+		t.Fatalf("Mqtt connection fail %v", err)
+	}
+
+	done := make(chan error, 1)
+	go func() { done <- mc.Loop() }()
+
+	// The message is still in flight when the publish gives up, it keeps its slot
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if _, err := mc.PublishContext(ctx, topic, "first", QOS_1, false); err != context.DeadlineExceeded {
+		t.Fatalf("Publish found error %v; want %s", err, context.DeadlineExceeded)
+	}
+	if mc.InFlight() != 1 {
+		t.Errorf("InFlight found %d; want 1", mc.InFlight())
+	}
+	if _, err := mc.Publish(topic, "second", QOS_1, false); err != ErrReceiveMaximumExceeded {
+		t.Errorf("Publish found error %v; want %s", err, ErrReceiveMaximumExceeded)
+	}
+
+	// The PUBACK read by Loop gives the slot back
+	close(release)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for mc.InFlight() != 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if ok, err := mc.Publish(topic, "second", QOS_1, false); !ok || err != nil {
+		t.Errorf("Publish after the PUBACK failed %v", err)
+	}
+
+	mc.Close()
+	<-done
+}
+
+func TestInFlightReconnect(t *testing.T) {
+
+	var conns int32
+
+	// The PUBLISH of the first connection is never acknowledged, the next ones are at once
+	connInfos := standIn(t, func(c net.Conn) {
+		first := atomic.AddInt32(&conns, 1) == 1
+		packet.Read(c)
+		c.Write(must((&packet.Connack{ReturnCode: header.CONNECT_ACCEPTED}).Encode()))
+		for {
+			data, err := packet.Read(c)
+			if err != nil {
+				return
+			}
+			p, err := packet.Parse(data)
+			publish, ok := p.(*packet.Publish)
+			if err != nil || !ok || first {
+				continue
+			}
+			c.Write(must((&packet.Puback{PacketID: publish.PacketID}).Encode()))
+		}
+	})
+
+	mc := New(clientId, WithConnInfos(connInfos), WithServerLimits(1, 0))
+	if _, err := mc.Connect(); err != nil {
+		t.Fatalf("Error connecting: %s", err)
+	}
+	defer mc.Close()
+	if _, err := mc.MqttConnect(); err != nil {
+		t.Fatalf("Mqtt connection fail %v", err)
+	}
+
+	// The first message keeps the only slot of the window
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if _, err := mc.PublishContext(ctx, topic, "first", QOS_1, false); err != context.DeadlineExceeded {
+		t.Fatalf("Publish found error %v; want %s", err, context.DeadlineExceeded)
+	}
+
+	// The second one waits for a slot
+	published := make(chan error, 1)
+	go func() {
+		_, err := mc.Publish(topic, "second", QOS_1, false)
+		published <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	// A new session drops the first message, the second one takes a slot of the new window
+	mc.Close()
+	if _, err := mc.Connect(); err != nil {
+		t.Fatalf("Error connecting: %s", err)
+	}
+	if _, err := mc.MqttConnect(); err != nil {
+		t.Fatalf("Mqtt connection fail %v", err)
+	}
+
+	select {
+	case err := <-published:
+		if err != nil {
+			t.Errorf("Publish after the reconnection failed %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Publish still waiting for a slot after the reconnection")
+	}
+
+	// A publish waiting for a slot gives up with its context
+	window, _ := mc.acquireInflight(context.Background())
+	defer releaseInflight(window)
+	ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := mc.PublishContext(ctx, topic, "third", QOS_1, false); err != context.DeadlineExceeded {
+		t.Errorf("Publish found error %v; want %s", err, context.DeadlineExceeded)
+	}
+}
+
+func TestInboundReceiveMaximum(t *testing.T) {
+
+	disconnected := make(chan []byte, 1)
+
+	// A QoS 2 message waiting for its PUBREL, then a QoS 1 message over the receive maximum
+	connInfos := standIn(t, func(c net.Conn) {
+		packet.Read(c)
+		c.Write(must(packet.Encode(packet.NewMqttPacket(header.New(header.WithControl(header.CONNACK)),
+			packet.WithVariableHeader(vheader.NewGenericHeader([]byte{0, reason.SUCCESS, 0}))))))
+
+		c.Write(must((&packet.Publish{Qos: QOS_2, Topic: topic, PacketID: 1, Properties: property.New(), Payload: []byte("first")}).Encode()))
+		packet.Read(c)
+		c.Write(must((&packet.Publish{Qos: QOS_1, Topic: topic, PacketID: 2, Properties: property.New(), Payload: []byte("second")}).Encode()))
+
+		data, _ := packet.Read(c)
+		disconnected <- data
+	})
+
+	mc := New(clientId,
+		WithConnInfos(connInfos),
+		WithProtocol(protocol.PROTOCOL_NAME, protocol.PROTOCOL_LEVEL_5),
+		WithReceiveMaximum(1),
+	)
+	if _, err := mc.Connect(); err != nil {
+		t.Fatalf("Error connecting: %s", err)
+	}
+	defer mc.Close()
+	if _, err := mc.MqttConnect(); err != nil {
+		t.Fatalf("Mqtt connection fail %v", err)
+	}
+
+	if err := mc.Loop(); err != ErrReceiveMaximumExceeded {
+		t.Errorf("Loop found error %v; want %s", err, ErrReceiveMaximumExceeded)
+	}
+
+	data := <-disconnected
+	if len(data) < 3 || data[0] != header.DISCONNECT || data[2] != reason.RECEIVE_MAXIMUM_EXCEEDED {
+		t.Errorf("DISCONNECT found %v; want the reason %d", data, reason.RECEIVE_MAXIMUM_EXCEEDED)
+	}
+}
+
+func TestProtocolFallback(t *testing.T) {
+
+	tried := make(chan string, 3)
+
+	connInfos := standIn(t, func(c net.Conn) {
+		data, err := packet.Read(c)
+		if err != nil {
+			return
+		}
+
+		// protocol name and level after the fixed header
+		_, rl := header.RemaingLengthDecode(data[1:])
+		vh := data[len(data)-rl:]
+		_, name, _ := util.StringDecode(vh)
+		level := vh[2+len(name)]
+		tried <- fmt.Sprintf("%s/%d", name, level)
+
+		rc := header.CONNECT_REFUSED_1
+		if name == protocol.PROTOCOL_NAME_31 && level == protocol.PROTOCOL_LEVEL_31 {
+			rc = header.CONNECT_ACCEPTED
+		}
+		connack := packet.NewMqttPacket(header.New(header.WithControl(header.CONNACK)),
+			packet.WithVariableHeader(vheader.NewGenericHeader([]byte{0, rc})))
+		c.Write(must(packet.Encode(connack)))
+
+		if rc == header.CONNECT_ACCEPTED {
+			packet.Read(c)
+		}
+	})
+
+	mc := New(clientId,
+		WithConnInfos(connInfos),
+		WithProtocol(protocol.PROTOCOL_NAME, protocol.PROTOCOL_LEVEL_5),
+		WithProtocolFallback(),
+	)
+	if _, err := mc.Connect(); err != nil {
+		t.Fatalf("Error connecting: %s", err)
+	}
+	defer mc.Close()
+
+	if response, err := mc.MqttConnect(); err != nil || !response {
+		t.Fatalf("Mqtt connection fail %v", err)
+	}
+
+	for _, want := range []string{"MQTT/5", "MQTT/4", "MQIsdp/3"} {
+		if found := <-tried; found != want {
+			t.Errorf("Protocol tried %s; want %s", found, want)
+		}
+	}
+
+	if p := mc.Protocol(); !p.IsV31() {
+		t.Errorf("Protocol found %s; want MQTT 3.1", &p)
+	}
+}
+
+func TestConnackSubackV31(t *testing.T) {
+
+	// Reserved CONNACK byte set, then a SUBACK granting QoS 1 and one with the MQTT 3.1.1 failure code
+	connInfos := standIn(t, func(c net.Conn) {
+		packet.Read(c)
+		c.Write([]byte{header.CONNACK, 2, 1, header.CONNECT_ACCEPTED})
+		for _, code := range []byte{QOS_1, reason.UNSPECIFIED_ERROR} {
+			data, err := packet.Read(c)
+			if err != nil {
+				return
+			}
+			p, _ := packet.Parse(data)
+			c.Write(must((&packet.Suback{PacketID: p.(*packet.Subscribe).PacketID, ReturnCodes: []byte{code}}).Encode()))
+		}
+		packet.Read(c)
+	})
+
+	mc := New(clientId,
+		WithConnInfos(connInfos),
+		WithCleanSession(false),
+		WithProtocol(protocol.PROTOCOL_NAME_31, protocol.PROTOCOL_LEVEL_31),
+	)
+	if _, err := mc.Connect(); err != nil {
+		t.Fatalf("Error connecting: %s", err)
+	}
+	defer mc.Close()
+
+	if ok, err := mc.MqttConnect(); !ok || err != nil {
+		t.Fatalf("Mqtt connection fail %v", err)
+	}
+	if mc.SessionPresent() {
+		t.Errorf("Session present read from the reserved byte of a MQTT 3.1 CONNACK")
+	}
+
+	if granted, err := mc.Subscribe(topic, QOS_1); err != nil || granted != QOS_1 {
+		t.Errorf("Subscribe found %d (%v); want %d", granted, err, QOS_1)
+	}
+	if _, err := mc.Subscribe(topic+"/refused", QOS_1); !errors.Is(err, packet.ErrMalformedPacket) {
+		t.Errorf("Subscribe found error %v; want %s", err, packet.ErrMalformedPacket)
+	}
+}
+
+// A malformed PUBLISH or acknowledgement closes the connection instead of panicking
+func TestMalformedPacket(t *testing.T) {
+
+	for _, data := range [][]byte{
+		{header.PUBLISH, 0},                // no topic
+		{header.PUBLISH | 2, 3, 0, 1, 'a'}, // QoS 1 without packet identifier
+		{header.PUBLISH, 3, 0, 1, 0xFF},    // topic not UTF-8
+		{header.PUBREL | 2, 0},             // no packet identifier
+		{header.PUBACK, 1, 0},              // truncated packet identifier
+	} {
+		connInfos := standIn(t, func(c net.Conn) {
+			packet.Read(c)
+			c.Write([]byte{header.CONNACK, 2, 0, header.CONNECT_ACCEPTED})
+			c.Write(data)
+			packet.Read(c)
+		})
+
+		mc := New(clientId, WithConnInfos(connInfos))
+		if _, err := mc.Connect(); err != nil {
+			t.Fatalf("Error connecting: %s", err)
+		}
+		if ok, err := mc.MqttConnect(); !ok || err != nil {
+			t.Fatalf("Mqtt connection fail %v", err)
+		}
+
+		if err := mc.Loop(); !errors.Is(err, packet.ErrMalformedPacket) {
+			t.Errorf("Loop with %v found %v; want %s", data, err, packet.ErrMalformedPacket)
+		}
+		mc.Close()
+	}
+}
+
+func TestClientIdV31(t *testing.T) {
+
+	mc := New("a-client-identifier-longer-than-23",
+		WithConnInfos(conn.New("localhost")),
+		WithProtocol(protocol.PROTOCOL_NAME_31, protocol.PROTOCOL_LEVEL_31),
+	)
+
+	c, _ := net.Pipe()
+	mc.conn = &c
+	defer c.Close()
+
+	if _, err := mc.MqttConnect(); err == nil {
+		t.Errorf("A client identifier of more than 23 characters should fail with MQTT 3.1")
+	}
+}
+
+// Change the session expiry while the client connects again, run it with -race
+func TestSessionExpiryReconnect(t *testing.T) {
+
+	connInfos := standIn(t, func(c net.Conn) {
+		packet.Read(c)
+		c.Write(must(packet.Encode(packet.NewMqttPacket(header.New(header.WithControl(header.CONNACK)),
+			packet.WithVariableHeader(vheader.NewGenericHeader([]byte{0, reason.SUCCESS, 0}))))))
+		packet.Read(c)
+	})
+
+	mc := New(clientId,
+		WithConnInfos(connInfos),
+		WithProtocol(protocol.PROTOCOL_NAME, protocol.PROTOCOL_LEVEL_5),
+		WithSessionExpiry(60),
+	)
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := uint32(1); ; i++ {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			mc.SetSessionExpiry(60 + i%60)
+			runtime.Gosched()
+		}
+	}()
+
+	for i := 0; i < 50; i++ {
+		if _, err := mc.Connect(); err != nil {
+			t.Fatalf("Error connecting: %s", err)
+		}
+		if ok, err := mc.MqttConnect(); !ok || err != nil {
+			t.Fatalf("Mqtt connection fail %v", err)
+		}
+		mc.Close()
+	}
+
+	close(done)
+	wg.Wait()
+}
+
+// Publish, subscribe and ping from several goroutines while Loop reads, run it with -race
+func TestConcurrentUse(t *testing.T) {
+
+	const publishers = 8
+	const messages = 20
+
+	received := make(chan string, publishers*messages)
+	var published int32
+
+	mc := New(fmt.Sprint("concurrent-", time.Now().UnixNano()),
+		WithConnInfos(conn.New(connHost, conn.WithPort(connPort))),
+	)
+	mc.OnMessage = func(mc *MqttClient, userData interface{}, message string) {
+		received <- message
+	}
+	mc.OnPublish = func(mc *MqttClient, userData interface{}, mid uint16) {
+		atomic.AddInt32(&published, 1)
+	}
+
+	if _, err := mc.Connect(); err != nil {
+		t.Fatalf("Connect error %s", err)
+	}
+	defer mc.Close()
+
+	if _, err := mc.Subscribe("concurrent/#", QOS_2); err != nil {
+		t.Fatalf("Subscribe error %s", err)
+	}
+
+	done := make(chan error, 1)
+	go func() { done <- mc.Loop() }()
+
+	var wg sync.WaitGroup
+	for i := 0; i < publishers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < messages; j++ {
+				if ok, err := mc.Publish(fmt.Sprintf("concurrent/%d", i), fmt.Sprintf("%d-%d", i, j), byte(j%3), false); !ok || err != nil {
+					t.Errorf("Publish %d-%d failed %v", i, j, err)
+					return
+				}
+			}
+		}(i)
+	}
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for j := 0; j < 5; j++ {
+			filter := fmt.Sprintf("other/%d", j)
+			if _, err := mc.Subscribe(filter, QOS_1); err != nil {
+				t.Errorf("Subscribe error %s", err)
+			}
+			if ok, err := mc.Ping(); !ok || err != nil {
+				t.Errorf("Ping failed %v", err)
+			}
+			if ok, err := mc.Unsubscribe(filter); !ok || err != nil {
+				t.Errorf("Unsubscribe failed %v", err)
+			}
+			mc.SessionPresent()
+			mc.InFlight()
+			mc.Protocol()
+		}
+	}()
+
+	wg.Wait()
+
+	seen := make(map[string]bool)
+	for len(seen) < publishers*messages {
+		select {
+		case m := <-received:
+			seen[m] = true
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Messages received %d; want %d", len(seen), publishers*messages)
+		}
+	}
+
+	if n := atomic.LoadInt32(&published); n != publishers*messages {
+		t.Errorf("OnPublish called %d times; want %d", n, publishers*messages)
+	}
+
+	mc.Close()
+	<-done
+}
+
+func TestShutdown(t *testing.T) {
+
+	// The PUBACK is sent once the test releases it, or never
+	published := make(chan uint16, 1)
+	release := make(chan bool, 1)
+	disconnected := make(chan bool, 1)
+
+	connInfos := standIn(t, func(c net.Conn) {
+		packet.Read(c)
+		c.Write(must((&packet.Connack{ReturnCode: header.CONNECT_ACCEPTED}).Encode()))
+
+		data, err := packet.Read(c)
+		if err != nil {
+			return
+		}
+		p, _ := packet.Parse(data)
+		published <- p.(*packet.Publish).PacketID
+
+		if <-release {
+			c.Write(must((&packet.Puback{PacketID: p.(*packet.Publish).PacketID}).Encode()))
+		}
+
+		data, err = packet.Read(c)
+		disconnected <- err == nil && data[0]&0xF0 == header.DISCONNECT
+	})
+
+	shutdown := func(ack bool, timeout time.Duration) (bool, error) {
+		mc := New(clientId, WithConnInfos(connInfos))
+		if _, err := mc.Connect(); err != nil {
+			t.Fatalf("Connect error %s", err)
+		}
+		if _, err := mc.MqttConnect(); err != nil {
+			t.Fatalf("MqttConnect error %s", err)
+		}
+
+		pinging := make(chan bool)
+		go func() {
+			mc.LoopStart()
+			close(pinging)
+		}()
+
+		result := make(chan bool, 1)
+		go func() {
+			ok, _ := mc.Publish(topic, "in flight", QOS_1, false)
+			result <- ok
+		}()
+		<-published
+
+		release <- ack
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		err := mc.Shutdown(ctx)
+
+		if _, pubErr := mc.Publish(topic, "too late", QOS_0, false); pubErr != ErrClientClosed {
+			t.Errorf("Publish after Shutdown found error %v; want %s", pubErr, ErrClientClosed)
+		}
+		if !<-disconnected {
+			t.Errorf("DISCONNECT not sent")
+		}
+		select {
+		case <-pinging:
+		case <-time.After(5 * time.Second):
+			t.Errorf("LoopStart still running after Shutdown")
+		}
+
+		return <-result, err
+	}
+
+	// The PUBACK is waited for
+	if ok, err := shutdown(true, 5*time.Second); !ok || err != nil {
+		t.Errorf("Shutdown found publish %t and error %v; want true and no error", ok, err)
+	}
+
+	// The message in flight is abandoned at the deadline
+	if ok, err := shutdown(false, 100*time.Millisecond); ok || err != context.DeadlineExceeded {
+		t.Errorf("Shutdown found publish %t and error %v; want false and %s", ok, err, context.DeadlineExceeded)
+	}
+}
+
+func TestShutdownInFlight(t *testing.T) {
+
+	// The PUBLISH is never acknowledged
+	connInfos := standIn(t, func(c net.Conn) {
+		packet.Read(c)
+		c.Write(must((&packet.Connack{ReturnCode: header.CONNECT_ACCEPTED}).Encode()))
+		for {
+			if _, err := packet.Read(c); err != nil {
+				return
+			}
+		}
+	})
+
+	// A first message kept for the session takes the only slot of the window
+	connect := func() *MqttClient {
+		mc := New(clientId, WithConnInfos(connInfos), WithServerLimits(1, 0))
+		if _, err := mc.Connect(); err != nil {
+			t.Fatalf("Connect error %s", err)
+		}
+		if _, err := mc.MqttConnect(); err != nil {
+			t.Fatalf("MqttConnect error %s", err)
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+		if _, err := mc.PublishContext(ctx, topic, "kept", QOS_1, false); err != context.DeadlineExceeded {
+			t.Fatalf("Publish found error %v; want %s", err, context.DeadlineExceeded)
+		}
+		return mc
+	}
+
+	// The publish waiting for a slot fails at once, the message in flight is abandoned at the deadline
+	mc := connect()
+	published := make(chan error, 1)
+	go func() {
+		_, err := mc.Publish(topic, "waiting", QOS_1, false)
+		published <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	shutdown := make(chan error, 1)
+	go func() { shutdown <- mc.Shutdown(ctx) }()
+
+	select {
+	case err := <-published:
+		if err != ErrClientClosed {
+			t.Errorf("Publish found error %v; want %s", err, ErrClientClosed)
+		}
+	case <-ctx.Done():
+		t.Fatalf("Publish still waiting for a slot after Shutdown")
+	}
+	if err := <-shutdown; err != context.DeadlineExceeded {
+		t.Errorf("Shutdown found error %v; want %s", err, context.DeadlineExceeded)
+	}
+	if mc.InFlight() != 0 {
+		t.Errorf("InFlight found %d; want 0", mc.InFlight())
+	}
+
+	// Disconnected, the message kept for the session is dropped
+	mc = connect()
+	mc.Close()
+	if err := mc.Shutdown(context.Background()); !errors.Is(err, ErrMessagesDropped) {
+		t.Errorf("Shutdown found error %v; want %s", err, ErrMessagesDropped)
+	}
+	if mc.InFlight() != 0 {
+		t.Errorf("InFlight found %d; want 0", mc.InFlight())
+	}
+}
+
+func TestState(t *testing.T) {
+
+	// The first connection is lost after the CONNACK, the second one is kept
+	connections := make(chan int, 2)
+	connections <- 0
+	connections <- 1
+
+	connInfos := standIn(t, func(c net.Conn) {
+		i := <-connections
+		packet.Read(c)
+		c.Write(must((&packet.Connack{ReturnCode: header.CONNECT_ACCEPTED}).Encode()))
+		if i == 1 {
+			packet.Read(c)
+		}
+	})
+
+	registry := metrics.NewRegistry()
+	mc := New(clientId, WithConnInfos(connInfos), WithMetrics(registry.Client(clientId)))
+	if mc.State() != STATE_DISCONNECTED {
+		t.Errorf("State found %s; want %s", mc.State(), STATE_DISCONNECTED)
+	}
+
+	transitions := make(chan string, 20)
+	mc.AddStateHandler("test", func(mc *MqttClient, userData interface{}, from State, to State) {
+		transitions <- from.String() + ">" + to.String()
+	})
+
+	expect := func(want ...string) {
+		t.Helper()
+		for _, w := range want {
+			select {
+			case found := <-transitions:
+				if found != w {
+					t.Errorf("Transition found %s; want %s", found, w)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatalf("Transition %s not found", w)
+			}
+		}
+	}
+
+	go mc.LoopForever()
+	expect("disconnected>dialing", "dialing>connecting", "connecting>connected",
+		"connected>reconnecting", "reconnecting>dialing", "dialing>connecting", "connecting>connected")
+
+	if mc.State() != STATE_CONNECTED {
+		t.Errorf("State found %s; want %s", mc.State(), STATE_CONNECTED)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := mc.Shutdown(ctx); err != nil {
+		t.Fatalf("Shutdown error %s", err)
+	}
+	expect("connected>disconnecting", "disconnecting>disconnected", "disconnected>closed")
+
+	var out bytes.Buffer
+	registry.WriteTo(&out)
+	if reconnects := fmt.Sprintf("mqtt_client_reconnects_total{client_id=%q} 1\n", clientId); !strings.Contains(out.String(), reconnects) {
+		t.Errorf("Missing %q in\n%s", reconnects, out.String())
+	}
+
+	// Closed is final
+	mc.RemoveStateHandler("test")
+	if _, err := mc.Connect(); err != ErrClientClosed || mc.State() != STATE_CLOSED {
+		t.Errorf("Connect after Shutdown found %v and %s; want %s and %s", err, mc.State(), ErrClientClosed, STATE_CLOSED)
+	}
+	if len(transitions) != 0 {
+		t.Errorf("Transition found %s after RemoveStateHandler", <-transitions)
+	}
+
+	// Not connecting anymore once the CONNACK refused the connection
+	refused := standIn(t, func(c net.Conn) {
+		packet.Read(c)
+		c.Write(must((&packet.Connack{ReturnCode: header.CONNECT_REFUSED_5}).Encode()))
+		packet.Read(c)
+	})
+	mc = New(clientId, WithConnInfos(refused))
+	if _, err := mc.Connect(); err != nil {
+		t.Fatalf("Error connecting: %s", err)
+	}
+	defer mc.Close()
+	if ok, err := mc.MqttConnect(); ok || err == nil || mc.State() != STATE_DISCONNECTED {
+		t.Errorf("Refused MqttConnect found %t (%v) and %s; want an error and %s", ok, err, mc.State(), STATE_DISCONNECTED)
+	}
+}
+
+func TestLogger(t *testing.T) {
+
+	type entry struct {
+		level   logger.Level
+		msg     string
+		keyvals []interface{}
+	}
+
+	var mu sync.Mutex
+	var entries []entry
+	record := logger.Func(func(level logger.Level, msg string, keyvals ...interface{}) {
+		mu.Lock()
+		defer mu.Unlock()
+		entries = append(entries, entry{level, msg, keyvals})
+	})
+
+	mc := New(fmt.Sprint("logger-", time.Now().UnixNano()),
+		WithConnInfos(conn.New(connHost, conn.WithPort(connPort))),
+		WithLogger(record),
+	)
+	if _, err := mc.Connect(); err != nil {
+		t.Fatalf("Connect error %s", err)
+	}
+	if _, err := mc.Publish("logger/test", "hello", QOS_1, false); err != nil {
+		t.Fatalf("Publish error %s", err)
+	}
+	mc.Close()
+
+	// A refused connection is logged as an error with its cause
+	refused := New("logger-refused",
+		WithConnInfos(conn.New("127.0.0.1", conn.WithPort("1"))),
+		WithLogger(record),
+	)
+	if _, err := refused.Connect(); err == nil {
+		t.Fatalf("Connect should fail")
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	dumps := 0
+	var connErr error
+	for _, e := range entries {
+		if e.msg == "packet" {
+			if e.level != logger.DEBUG {
+				t.Errorf("Packet dump at level %s, want DEBUG", e.level)
+			}
+			dumps++
+		}
+		if e.msg == "connection failed" {
+			if e.level != logger.ERROR || len(e.keyvals) != 2 || e.keyvals[0] != "err" {
+				t.Errorf("Connection error logged as %s %v", e.level, e.keyvals)
+			} else {
+				connErr, _ = e.keyvals[1].(error)
+			}
+		}
+	}
+	// CONNECT, PUBLISH
+	if dumps < 2 {
+		t.Errorf("%d packet dump(s), want at least 2", dumps)
+	}
+	if connErr == nil {
+		t.Errorf("Connection error not logged")
+	}
+
+	// The standard logger drops the messages below its level
+	var buf bytes.Buffer
+	std := logger.New(log.New(&buf, "", 0), logger.INFO)
+	std.Log(logger.DEBUG, "packet", "packet", "dump")
+	std.Log(logger.ERROR, "write failed", "err", errors.New("broken pipe"))
+	if got := buf.String(); got != "ERROR write failed err=broken pipe\n" {
+		t.Errorf("Got %q", got)
+	}
+}
+
+func TestPacketHooks(t *testing.T) {
+
+	var mu sync.Mutex
+	var sent, received []string
+	record := func(list *[]string) func(mc *MqttClient, userData interface{}, trace *PacketTrace) {
+		return func(mc *MqttClient, userData interface{}, trace *PacketTrace) {
+			if trace.Packet == nil || trace.Time.IsZero() || len(trace.Data) == 0 {
+				t.Errorf("Incomplete trace %+v", trace)
+				return
+			}
+			if trace.Data[0] != trace.Packet.Header.Control {
+				t.Errorf("Data %v does not match the packet %s", trace.Data, trace.Packet)
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			*list = append(*list, header.ControlToString(trace.Packet.Header.Control&0xF0))
+		}
+	}
+
+	mc := New(fmt.Sprint("hooks-", time.Now().UnixNano()),
+		WithConnInfos(conn.New(connHost, conn.WithPort(connPort))),
+	)
+	mc.OnPacketSent = record(&sent)
+	mc.OnPacketReceived = record(&received)
+
+	if _, err := mc.Connect(); err != nil {
+		t.Fatalf("Connect error %s", err)
+	}
+	if _, err := mc.Publish("hooks/test", "hello", QOS_1, false); err != nil {
+		t.Fatalf("Publish error %s", err)
+	}
+	if _, err := mc.Ping(); err != nil {
+		t.Fatalf("Ping error %s", err)
+	}
+	if _, err := mc.MqttDisconnect(); err != nil {
+		t.Fatalf("Disconnect error %s", err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	wantSent := []string{
+		header.ControlToString(header.CONNECT),
+		header.ControlToString(header.PUBLISH),
+		header.ControlToString(header.PINGREQ),
+		header.ControlToString(header.DISCONNECT),
+	}
+	wantReceived := []string{
+		header.ControlToString(header.CONNACK),
+		header.ControlToString(header.PUBACK),
+		header.ControlToString(header.PINGRESP),
+	}
+	if strings.Join(sent, ",") != strings.Join(wantSent, ",") {
+		t.Errorf("Sent %v, want %v", sent, wantSent)
+	}
+	if strings.Join(received, ",") != strings.Join(wantReceived, ",") {
+		t.Errorf("Received %v, want %v", received, wantReceived)
+	}
+}
+
+// Concurrent publishes are traced in the order of the wire, run it with -race
+func TestPacketSentOrder(t *testing.T) {
+
+	const count = 50
+
+	read := make(chan []string, 1)
+	connInfos := standIn(t, func(c net.Conn) {
+		packet.Read(c)
+		c.Write(must((&packet.Connack{ReturnCode: header.CONNECT_ACCEPTED}).Encode()))
+		var payloads []string
+		for len(payloads) < count {
+			data, err := packet.Read(c)
+			if err != nil {
+				break
+			}
+			if p, err := packet.Parse(data); err == nil {
+				if publish, ok := p.(*packet.Publish); ok {
+					payloads = append(payloads, string(publish.Payload))
+				}
+			}
+		}
+		read <- payloads
+	})
+
+	var mu sync.Mutex
+	var sent []string
+	mc := New(clientId, WithConnInfos(connInfos))
+	mc.OnPacketSent = func(mc *MqttClient, userData interface{}, trace *PacketTrace) {
+		if _, ok := trace.Packet.VariableHeader.(*vheader.PublishHeader); ok {
+			mu.Lock()
+			sent = append(sent, string(trace.Packet.Payload.Data))
+			mu.Unlock()
+		}
+	}
+
+	if _, err := mc.Connect(); err != nil {
+		t.Fatalf("Error connecting: %s", err)
+	}
+	defer mc.Close()
+	if ok, err := mc.MqttConnect(); !ok || err != nil {
+		t.Fatalf("Mqtt connection fail %v", err)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < count; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			mc.Publish(topic, fmt.Sprint(i), QOS_0, false)
+		}(i)
+	}
+	wg.Wait()
+
+	wire := <-read
+	mu.Lock()
+	defer mu.Unlock()
+	if !reflect.DeepEqual(sent, wire) {
+		t.Errorf("Sent %v; want the order of the wire %v", sent, wire)
+	}
+}
+
+func TestMetrics(t *testing.T) {
+
+	registry := metrics.NewRegistry()
+
+	clientId := fmt.Sprint("metrics-", time.Now().UnixNano())
+	topic := "metrics/" + clientId
+
+	received := make(chan string, 3)
+	mc := New(clientId,
+		WithConnInfos(conn.New(connHost, conn.WithPort(connPort))),
+		WithMetrics(registry.Client(clientId)),
+	)
+	mc.OnMessage = func(mc *MqttClient, userData interface{}, message string) {
+		received <- message
+	}
+
+	if _, err := mc.Connect(); err != nil {
+		t.Fatalf("Connect error %s", err)
+	}
+	if _, err := mc.Subscribe(topic, QOS_2); err != nil {
+		t.Fatalf("Subscribe error %s", err)
+	}
+
+	done := make(chan error, 1)
+	go func() { done <- mc.Loop() }()
+
+	for qos := byte(0); qos < 3; qos++ {
+		if _, err := mc.Publish(topic, "hello", qos, false); err != nil {
+			t.Fatalf("Publish error %s", err)
+		}
+	}
+	if _, err := mc.Ping(); err != nil {
+		t.Fatalf("Ping error %s", err)
+	}
+	for i := 0; i < 3; i++ {
+		select {
+		case <-received:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Message %d not received", i)
+		}
+	}
+
+	mc.Close()
+	<-done
+
+	var out bytes.Buffer
+	if _, err := registry.WriteTo(&out); err != nil {
+		t.Fatalf("WriteTo error %s", err)
+	}
+	exposition := out.String()
+
+	label := fmt.Sprintf("client_id=%q", clientId)
+	for _, line := range []string{
+		"# TYPE mqtt_client_messages_published_total counter",
+		"mqtt_client_messages_published_total{" + label + ",qos=\"0\"} 1",
+		"mqtt_client_messages_published_total{" + label + ",qos=\"2\"} 1",
+		"mqtt_client_messages_received_total{" + label + ",qos=\"1\"} 1",
+		"mqtt_client_in_flight_messages{" + label + "} 0",
+		"mqtt_client_reconnects_total{" + label + "} 0",
+		"mqtt_client_ack_latency_seconds_count{" + label + ",qos=\"1\"} 1",
+		"mqtt_client_ack_latency_seconds_bucket{" + label + ",qos=\"2\",le=\"+Inf\"} 1",
+		"mqtt_client_ping_rtt_seconds_count{" + label + "} 1",
+	} {
+		if !strings.Contains(exposition, line+"\n") {
+			t.Errorf("Missing %q in\n%s", line, exposition)
+		}
+	}
+	if strings.Contains(exposition, "mqtt_client_sent_bytes_total{"+label+"} 0\n") {
+		t.Errorf("No byte sent in\n%s", exposition)
+	}
+
+	// Served over HTTP with the text format content type
+	rec := httptest.NewRecorder()
+	registry.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	if ct := rec.Header().Get("Content-Type"); ct != metrics.CONTENT_TYPE {
+		t.Errorf("Content-Type %q", ct)
+	}
+	if rec.Body.String() != exposition {
+		t.Errorf("Served metrics differ from WriteTo")
+	}
+}
+
+func TestPublishContextTimeout(t *testing.T) {
+
+	// The PUBLISH is never acknowledged
+	connInfos := standIn(t, func(c net.Conn) {
+		packet.Read(c)
+		c.Write(must((&packet.Connack{ReturnCode: header.CONNECT_ACCEPTED}).Encode()))
+		for {
+			if _, err := packet.Read(c); err != nil {
+				return
+			}
+		}
+	})
+
+	mc := New(clientId, WithConnInfos(connInfos))
+	if _, err := mc.Connect(); err != nil {
+		t.Fatalf("Error connecting: %s", err)
+	}
+	defer mc.Close()
+
+	// The publishing goroutine reads the connection itself, the context still stops the wait
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	result := make(chan error, 1)
+	go func() {
+		_, err := mc.PublishContext(ctx, topic, "hello", QOS_1, false)
+		result <- err
+	}()
+
+	select {
+	case err := <-result:
+		if err != context.DeadlineExceeded {
+			t.Errorf("Publish found error %v; want %s", err, context.DeadlineExceeded)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Publish still waiting after the deadline")
+	}
+}
+
+type traceKey struct{}
+
+// Span of the test tracer, the trace identifier is kept from the parent
+type testSpan struct {
+	kind        string
+	parent      string
+	traceParent string
+	ended       chan *testSpan
+}
+
+func (s *testSpan) TraceParent() string {
+	return s.traceParent
+}
+
+func (s *testSpan) End(err error) {
+	s.ended <- s
+}
+
+type testTracer struct {
+	mu    sync.Mutex
+	next  int
+	ended chan *testSpan
+}
+
+func (tt *testTracer) start(kind string, parent string) *testSpan {
+	tt.mu.Lock()
+	defer tt.mu.Unlock()
+	tt.next++
+
+	traceId := "4bf92f3577b34da6a3ce929d0e0e4736"
+	if tracing.Valid(parent) {
+		traceId = parent[3:35]
+	}
+	return &testSpan{
+		kind:        kind,
+		parent:      parent,
+		traceParent: fmt.Sprintf("00-%s-%016x-01", traceId, tt.next),
+		ended:       tt.ended,
+	}
+}
+
+func (tt *testTracer) StartPublish(ctx context.Context, topic string) tracing.Span {
+	parent, _ := ctx.Value(traceKey{}).(string)
+	return tt.start("publish", parent)
+}
+
+func (tt *testTracer) StartReceive(topic string, parent string) tracing.Span {
+	return tt.start("receive", parent)
+}
+
+func TestTracing(t *testing.T) {
+
+	const parent = "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01"
+
+	for _, level := range []byte{protocol.PROTOCOL_LEVEL_5, protocol.PROTOCOL_LEVEL} {
+
+		published := make(chan []byte, 1)
+
+		// Send the PUBLISH back
+		connInfos := standIn(t, func(c net.Conn) {
+			packet.Read(c)
+			if level == protocol.PROTOCOL_LEVEL_5 {
+				c.Write(must(packet.Encode(packet.NewMqttPacket(header.New(header.WithControl(header.CONNACK)),
+					packet.WithVariableHeader(vheader.NewGenericHeader([]byte{0, reason.SUCCESS, 0}))))))
+			} else {
+				c.Write(must((&packet.Connack{ReturnCode: header.CONNECT_ACCEPTED}).Encode()))
+			}
+			data, _ := packet.Read(c)
+			published <- data
+			c.Write(data)
+			packet.Read(c)
+		})
+
+		tracer := &testTracer{ended: make(chan *testSpan, 2)}
+		received := make(chan *Message, 1)
+
+		mc := New(clientId,
+			WithConnInfos(connInfos),
+			WithProtocol(protocol.PROTOCOL_NAME, level),
+			WithTracer(tracer),
+			WithTraceEnvelope(tracing.LineEnvelope()),
+		)
+		mc.OnMessageReceived = func(mc *MqttClient, userData interface{}, message *Message) {
+			received <- message
+		}
+
+		if _, err := mc.Connect(); err != nil {
+			t.Fatalf("Connect error %s", err)
+		}
+
+		ctx := context.WithValue(context.Background(), traceKey{}, parent)
+		if _, err := mc.PublishContext(ctx, topic, "hello", QOS_0, false); err != nil {
+			t.Fatalf("Publish error %s", err)
+		}
+		publish := <-tracer.ended
+		if publish.kind != "publish" || publish.parent != parent {
+			t.Errorf("Level %d: publish span %+v; want the parent %s", level, publish, parent)
+		}
+
+		// Carried by a user property with MQTT 5, by the envelope before
+		data := <-published
+		v5 := level == protocol.PROTOCOL_LEVEL_5
+		inPayload := bytes.Contains(data, []byte("traceparent: "+publish.traceParent+"\n"))
+		if v5 == inPayload || !bytes.Contains(data, []byte(publish.traceParent)) {
+			t.Errorf("Level %d: traceparent not propagated as expected in %q", level, data)
+		}
+
+		done := make(chan error, 1)
+		go func() { done <- mc.Loop() }()
+
+		select {
+		case message := <-received:
+			if message.Payload != "hello" {
+				t.Errorf("Level %d: payload found %q; want %q", level, message.Payload, "hello")
+			}
+			receive := <-tracer.ended
+			if receive.kind != "receive" || receive.parent != publish.traceParent || message.TraceParent != receive.traceParent {
+				t.Errorf("Level %d: receive span %+v, message traceparent %s", level, receive, message.TraceParent)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Level %d: message not received", level)
+		}
+
+		canceled, cancel := context.WithCancel(ctx)
+		cancel()
+		if _, err := mc.PublishContext(canceled, topic, "hello", QOS_1, false); err != context.Canceled {
+			t.Errorf("Level %d: publish with a canceled context found %v; want %s", level, err, context.Canceled)
+		}
+
+		mc.Close()
+		<-done
+	}
+}
+
+func TestMiddleware(t *testing.T) {
+
+	clientId := fmt.Sprint("middleware-", time.Now().UnixNano())
+	prefix := "middleware/" + clientId
+
+	received := make(chan string, 3)
+	mc := New(clientId, WithConnInfos(conn.New(connHost, conn.WithPort(connPort))))
+	mc.OnMessage = func(mc *MqttClient, userData interface{}, message string) {
+		received <- message
+	}
+
+	// Publish: suffixes in the order the middlewares were added, empty payloads refused
+	errEmpty := errors.New("empty payload")
+	suffix := func(s string) PublishMiddleware {
+		return func(next PublishHandler) PublishHandler {
+			return func(ctx context.Context, message *Message) (bool, error) {
+				message.Payload += s
+				return next(ctx, message)
+			}
+		}
+	}
+	mc.UsePublish(func(next PublishHandler) PublishHandler {
+		return func(ctx context.Context, message *Message) (bool, error) {
+			if message.Payload == "" {
+				return false, errEmpty
+			}
+			return next(ctx, message)
+		}
+	}, suffix("-1"))
+	mc.UsePublish(suffix("-2"))
+
+	// Receive: the last suffix removed, the dropped topic never delivered
+	mc.UseReceive(func(next ReceiveHandler) ReceiveHandler {
+		return func(message *Message) {
+			if strings.HasSuffix(message.Topic, "/drop") {
+				return
+			}
+			next(message)
+		}
+	}, func(next ReceiveHandler) ReceiveHandler {
+		return func(message *Message) {
+			message.Payload = strings.TrimSuffix(message.Payload, "-2")
+			next(message)
+		}
+	})
+
+	if _, err := mc.Connect(); err != nil {
+		t.Fatalf("Connect error %s", err)
+	}
+	if _, err := mc.Subscribe(prefix+"/#", QOS_1); err != nil {
+		t.Fatalf("Subscribe error %s", err)
+	}
+
+	done := make(chan error, 1)
+	go func() { done <- mc.Loop() }()
+
+	if _, err := mc.Publish(prefix+"/empty", "", QOS_1, false); err != errEmpty {
+		t.Errorf("Publish of an empty payload found %v; want %s", err, errEmpty)
+	}
+	if _, err := mc.Publish(prefix+"/drop", "dropped", QOS_1, false); err != nil {
+		t.Fatalf("Publish error %s", err)
+	}
+	if _, err := mc.Publish(prefix+"/kept", "hello", QOS_1, false); err != nil {
+		t.Fatalf("Publish error %s", err)
+	}
+
+	select {
+	case message := <-received:
+		if message != "hello-1" {
+			t.Errorf("Message found %q; want %q", message, "hello-1")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Message not received")
+	}
+
+	mc.Close()
+	<-done
+
+	if len(received) != 0 {
+		t.Errorf("Unexpected message %q", <-received)
+	}
 }
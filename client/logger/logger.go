@@ -0,0 +1,109 @@
+// MIT License
+
+// Copyright (c) 2022 Florent Brusciano
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+package logger
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"strings"
+)
+
+type Level int
+
+const (
+	DEBUG Level = iota
+	INFO
+	WARN
+	ERROR
+)
+
+var levelNames = map[Level]string{
+	DEBUG: "DEBUG",
+	INFO:  "INFO",
+	WARN:  "WARN",
+	ERROR: "ERROR",
+}
+
+func (l Level) String() string {
+	if name, ok := levelNames[l]; ok {
+		return name
+	}
+	return fmt.Sprintf("LEVEL(%d)", int(l))
+}
+
+// Structured logger: a message followed by key value pairs, as "err", err
+// The packet dumps are written at DEBUG level
+type Logger interface {
+	Log(level Level, msg string, keyvals ...interface{})
+}
+
+// Adapter to use a function, slog or zap for instance, as a Logger
+type Func func(level Level, msg string, keyvals ...interface{})
+
+func (f Func) Log(level Level, msg string, keyvals ...interface{}) {
+	f(level, msg, keyvals...)
+}
+
+// Logger writing the messages at or above a level to a standard logger
+type StdLogger struct {
+	out   *log.Logger
+	level Level
+}
+
+func New(out *log.Logger, level Level) *StdLogger {
+	return &StdLogger{out: out, level: level}
+}
+
+// Messages at INFO level and above written to the global logger
+func Default() *StdLogger {
+	return New(log.Default(), INFO)
+}
+
+// Logger dropping every message
+func Discard() *StdLogger {
+	return New(log.New(io.Discard, "", 0), ERROR+1)
+}
+
+func (l *StdLogger) Enabled(level Level) bool {
+	return level >= l.level
+}
+
+// Write "LEVEL msg key=value ...", the values are formatted only when the level is enabled
+func (l *StdLogger) Log(level Level, msg string, keyvals ...interface{}) {
+	if !l.Enabled(level) {
+		return
+	}
+
+	var sb strings.Builder
+	sb.WriteString(level.String())
+	sb.WriteString(" ")
+	sb.WriteString(msg)
+	for i := 0; i < len(keyvals); i += 2 {
+		if i+1 < len(keyvals) {
+			fmt.Fprintf(&sb, " %v=%v", keyvals[i], keyvals[i+1])
+		} else {
+			fmt.Fprintf(&sb, " %v", keyvals[i])
+		}
+	}
+	l.out.Print(sb.String())
+}
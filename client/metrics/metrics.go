@@ -0,0 +1,68 @@
+// MIT License
+
+// Copyright (c) 2022 Florent Brusciano
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+package metrics
+
+import (
+	"time"
+)
+
+// Events of a client, called as they happen by the goroutines using the client
+// The calls must be safe for concurrent use and must not call the client
+type Metrics interface {
+	// Message written to the connection
+	Published(qos byte)
+
+	// Message read from the connection
+	Received(qos byte)
+
+	// Bytes written to and read from the connection
+	BytesSent(n int)
+	BytesReceived(n int)
+
+	// Number of QoS > 0 messages sent and not acknowledged yet
+	InFlight(n int)
+
+	// Time between the publish and its last acknowledgement, PUBACK or PUBCOMP
+	Acknowledged(qos byte, latency time.Duration)
+
+	// Connection established again by LoopForever
+	Reconnected()
+
+	// Time between a PINGREQ and its PINGRESP
+	Pinged(rtt time.Duration)
+}
+
+type discard struct{}
+
+func (discard) Published(qos byte)                           {}
+func (discard) Received(qos byte)                            {}
+func (discard) BytesSent(n int)                              {}
+func (discard) BytesReceived(n int)                          {}
+func (discard) InFlight(n int)                               {}
+func (discard) Acknowledged(qos byte, latency time.Duration) {}
+func (discard) Reconnected()                                 {}
+func (discard) Pinged(rtt time.Duration)                     {}
+
+// Metrics dropping every event
+func Discard() Metrics {
+	return discard{}
+}
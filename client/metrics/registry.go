@@ -0,0 +1,294 @@
+// MIT License
+
+// Copyright (c) 2022 Florent Brusciano
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Upper bounds in seconds of the latency histograms
+var BUCKETS = []float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+const CONTENT_TYPE = "text/plain; version=0.0.4; charset=utf-8"
+
+// Metrics of several clients, exposed in the Prometheus text format
+// with the client identifier as label
+type Registry struct {
+	mu      sync.Mutex
+	clients map[string]*clientMetrics
+}
+
+func NewRegistry() *Registry {
+	return &Registry{clients: make(map[string]*clientMetrics)}
+}
+
+// Metrics of a client to give to client.WithMetrics
+// The same metrics are returned for the same client identifier
+func (r *Registry) Client(clientId string) Metrics {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	cm, ok := r.clients[clientId]
+	if !ok {
+		cm = &clientMetrics{values: values{
+			ackLatency: [3]*histogram{newHistogram(), newHistogram(), newHistogram()},
+			pingRtt:    newHistogram(),
+		}}
+		r.clients[clientId] = cm
+	}
+	return cm
+}
+
+// Serve the metrics, to be registered on /metrics for instance
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", CONTENT_TYPE)
+	r.WriteTo(w)
+}
+
+// Write the metrics in the Prometheus text format
+func (r *Registry) WriteTo(w io.Writer) (int64, error) {
+
+	r.mu.Lock()
+	ids := make([]string, 0, len(r.clients))
+	for id := range r.clients {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	snapshots := make([]values, len(ids))
+	for i, id := range ids {
+		snapshots[i] = r.clients[id].snapshot()
+	}
+	r.mu.Unlock()
+
+	cw := &countWriter{w: bufio.NewWriter(w)}
+
+	family(cw, "mqtt_client_messages_published_total", "counter", "Messages published by QoS")
+	for i, s := range snapshots {
+		for qos, v := range s.published {
+			cw.printf("mqtt_client_messages_published_total{client_id=\"%s\",qos=\"%d\"} %d\n", escape(ids[i]), qos, v)
+		}
+	}
+
+	family(cw, "mqtt_client_messages_received_total", "counter", "Messages received by QoS")
+	for i, s := range snapshots {
+		for qos, v := range s.received {
+			cw.printf("mqtt_client_messages_received_total{client_id=\"%s\",qos=\"%d\"} %d\n", escape(ids[i]), qos, v)
+		}
+	}
+
+	family(cw, "mqtt_client_sent_bytes_total", "counter", "Bytes written to the connection")
+	for i, s := range snapshots {
+		cw.printf("mqtt_client_sent_bytes_total{client_id=\"%s\"} %d\n", escape(ids[i]), s.bytesSent)
+	}
+
+	family(cw, "mqtt_client_received_bytes_total", "counter", "Bytes read from the connection")
+	for i, s := range snapshots {
+		cw.printf("mqtt_client_received_bytes_total{client_id=\"%s\"} %d\n", escape(ids[i]), s.bytesReceived)
+	}
+
+	family(cw, "mqtt_client_in_flight_messages", "gauge", "QoS 1 and 2 messages sent and not acknowledged")
+	for i, s := range snapshots {
+		cw.printf("mqtt_client_in_flight_messages{client_id=\"%s\"} %d\n", escape(ids[i]), s.inFlight)
+	}
+
+	family(cw, "mqtt_client_reconnects_total", "counter", "Connections established again after a loss")
+	for i, s := range snapshots {
+		cw.printf("mqtt_client_reconnects_total{client_id=\"%s\"} %d\n", escape(ids[i]), s.reconnects)
+	}
+
+	family(cw, "mqtt_client_ack_latency_seconds", "histogram", "Time between a publish and its last acknowledgement")
+	for i, s := range snapshots {
+		for qos := 1; qos < len(s.ackLatency); qos++ {
+			s.ackLatency[qos].write(cw, "mqtt_client_ack_latency_seconds", fmt.Sprintf("client_id=\"%s\",qos=\"%d\"", escape(ids[i]), qos))
+		}
+	}
+
+	family(cw, "mqtt_client_ping_rtt_seconds", "histogram", "Time between a PINGREQ and its PINGRESP")
+	for i, s := range snapshots {
+		s.pingRtt.write(cw, "mqtt_client_ping_rtt_seconds", fmt.Sprintf("client_id=\"%s\"", escape(ids[i])))
+	}
+
+	if cw.err == nil {
+		cw.err = cw.w.Flush()
+	}
+	return cw.n, cw.err
+}
+
+func family(cw *countWriter, name string, kind string, help string) {
+	cw.printf("# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// Escape a label value as the text format requires
+func escape(value string) string {
+	return labelEscaper.Replace(value)
+}
+
+type countWriter struct {
+	w   *bufio.Writer
+	n   int64
+	err error
+}
+
+func (cw *countWriter) printf(format string, args ...interface{}) {
+	if cw.err != nil {
+		return
+	}
+	n, err := fmt.Fprintf(cw.w, format, args...)
+	cw.n += int64(n)
+	cw.err = err
+}
+
+// Metrics of one client
+type clientMetrics struct {
+	mu sync.Mutex
+	values
+}
+
+type values struct {
+	published     [3]uint64
+	received      [3]uint64
+	bytesSent     uint64
+	bytesReceived uint64
+	inFlight      int
+	reconnects    uint64
+	ackLatency    [3]*histogram
+	pingRtt       *histogram
+}
+
+func (cm *clientMetrics) Published(qos byte) {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	if int(qos) < len(cm.published) {
+		cm.published[qos]++
+	}
+}
+
+func (cm *clientMetrics) Received(qos byte) {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	if int(qos) < len(cm.received) {
+		cm.received[qos]++
+	}
+}
+
+func (cm *clientMetrics) BytesSent(n int) {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	cm.bytesSent += uint64(n)
+}
+
+func (cm *clientMetrics) BytesReceived(n int) {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	cm.bytesReceived += uint64(n)
+}
+
+func (cm *clientMetrics) InFlight(n int) {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	cm.inFlight = n
+}
+
+func (cm *clientMetrics) Acknowledged(qos byte, latency time.Duration) {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	if int(qos) < len(cm.ackLatency) {
+		cm.ackLatency[qos].observe(latency)
+	}
+}
+
+func (cm *clientMetrics) Reconnected() {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	cm.reconnects++
+}
+
+func (cm *clientMetrics) Pinged(rtt time.Duration) {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	cm.pingRtt.observe(rtt)
+}
+
+// Copy of the metrics, the histograms included
+func (cm *clientMetrics) snapshot() values {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+
+	s := values{
+		published:     cm.published,
+		received:      cm.received,
+		bytesSent:     cm.bytesSent,
+		bytesReceived: cm.bytesReceived,
+		inFlight:      cm.inFlight,
+		reconnects:    cm.reconnects,
+		pingRtt:       cm.pingRtt.copy(),
+	}
+	for i, h := range cm.ackLatency {
+		s.ackLatency[i] = h.copy()
+	}
+	return s
+}
+
+// Histogram of durations with the BUCKETS upper bounds
+type histogram struct {
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+func newHistogram() *histogram {
+	return &histogram{counts: make([]uint64, len(BUCKETS))}
+}
+
+func (h *histogram) observe(d time.Duration) {
+	seconds := d.Seconds()
+	for i, bound := range BUCKETS {
+		if seconds <= bound {
+			h.counts[i]++
+		}
+	}
+	h.count++
+	h.sum += seconds
+}
+
+func (h *histogram) copy() *histogram {
+	return &histogram{counts: append([]uint64(nil), h.counts...), count: h.count, sum: h.sum}
+}
+
+// Write the cumulative buckets, the sum and the count
+func (h *histogram) write(cw *countWriter, name string, labels string) {
+	for i, bound := range BUCKETS {
+		cw.printf("%s_bucket{%s,le=\"%g\"} %d\n", name, labels, bound, h.counts[i])
+	}
+	cw.printf("%s_bucket{%s,le=\"+Inf\"} %d\n", name, labels, h.count)
+	cw.printf("%s_sum{%s} %g\n", name, labels, h.sum)
+	cw.printf("%s_count{%s} %d\n", name, labels, h.count)
+}
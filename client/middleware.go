@@ -0,0 +1,78 @@
+// MIT License
+
+// Copyright (c) 2022 Florent Brusciano
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+package client
+
+import (
+	"context"
+)
+
+// Publish a message, the last handler of the chain sends it
+type PublishHandler func(ctx context.Context, message *Message) (bool, error)
+
+// Wrap the publish of the messages: compression, encryption, validation, logging...
+// A middleware may change the message or return without calling next
+type PublishMiddleware func(next PublishHandler) PublishHandler
+
+// Deliver a message received, the last handler of the chain calls the callbacks and the handlers
+type ReceiveHandler func(message *Message)
+
+// Wrap the delivery of the messages received, called by the reading goroutine
+// A middleware may change the message or drop it without calling next
+type ReceiveMiddleware func(next ReceiveHandler) ReceiveHandler
+
+// Add middlewares to the publish chain, the first one added is called first
+func (mc *MqttClient) UsePublish(middlewares ...PublishMiddleware) {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	mc.publishMiddlewares = append(mc.publishMiddlewares, middlewares...)
+}
+
+// Add middlewares to the receive chain, the first one added is called first
+func (mc *MqttClient) UseReceive(middlewares ...ReceiveMiddleware) {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	mc.receiveMiddlewares = append(mc.receiveMiddlewares, middlewares...)
+}
+
+// The publish middlewares wrapping last
+func (mc *MqttClient) publishChain(last PublishHandler) PublishHandler {
+	mc.mu.Lock()
+	middlewares := mc.publishMiddlewares
+	mc.mu.Unlock()
+
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		last = middlewares[i](last)
+	}
+	return last
+}
+
+// The receive middlewares wrapping last
+func (mc *MqttClient) receiveChain(last ReceiveHandler) ReceiveHandler {
+	mc.mu.Lock()
+	middlewares := mc.receiveMiddlewares
+	mc.mu.Unlock()
+
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		last = middlewares[i](last)
+	}
+	return last
+}
@@ -6,6 +6,16 @@ const PROTOCOL_NAME string = "MQTT"
 // Default level for connect in variable Header
 const PROTOCOL_LEVEL byte = 4
 
+// Level for MQTT 5
+const PROTOCOL_LEVEL_5 byte = 5
+
+// Name and level for MQTT 3.1
+const PROTOCOL_NAME_31 string = "MQIsdp"
+const PROTOCOL_LEVEL_31 byte = 3
+
+// MQTT 3.1 limits the client identifier to 23 characters
+const CLIENT_ID_MAX_LEN_31 = 23
+
 // Store mqtt name/level in struct
 type MqttProtocol struct {
 	Name  string
@@ -15,3 +25,43 @@ type MqttProtocol struct {
 func New(name string, level byte) *MqttProtocol {
 	return &MqttProtocol{Name: name, Level: level}
 }
+
+// Protocol with the name matching the level
+func ForLevel(level byte) *MqttProtocol {
+	if level == PROTOCOL_LEVEL_31 {
+		return New(PROTOCOL_NAME_31, level)
+	}
+	return New(PROTOCOL_NAME, level)
+}
+
+func (mp *MqttProtocol) IsV5() bool {
+	return mp.Level == PROTOCOL_LEVEL_5
+}
+
+func (mp *MqttProtocol) IsV31() bool {
+	return mp.Level == PROTOCOL_LEVEL_31
+}
+
+// Previous protocol version to try when the server refuses this one
+// 5 -> 3.1.1 -> 3.1, nil when there is none
+func (mp *MqttProtocol) Fallback() *MqttProtocol {
+	switch mp.Level {
+	case PROTOCOL_LEVEL_5:
+		return ForLevel(PROTOCOL_LEVEL)
+	case PROTOCOL_LEVEL:
+		return ForLevel(PROTOCOL_LEVEL_31)
+	}
+	return nil
+}
+
+func (mp *MqttProtocol) String() string {
+	switch mp.Level {
+	case PROTOCOL_LEVEL_5:
+		return "MQTT 5"
+	case PROTOCOL_LEVEL:
+		return "MQTT 3.1.1"
+	case PROTOCOL_LEVEL_31:
+		return "MQTT 3.1"
+	}
+	return mp.Name
+}
@@ -0,0 +1,109 @@
+// MIT License
+
+// Copyright (c) 2022 Florent Brusciano
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+package client
+
+// Connection state of the client
+type State int
+
+const (
+	// No network connection
+	STATE_DISCONNECTED State = iota
+	// Opening the network connection
+	STATE_DIALING
+	// Network connection open, waiting for the CONNACK
+	STATE_CONNECTING
+	// MQTT connection accepted by the server
+	STATE_CONNECTED
+	// Connection lost, LoopForever tries again
+	STATE_RECONNECTING
+	// Waiting for the messages in flight and sending the DISCONNECT
+	STATE_DISCONNECTING
+	// Shut down, the client can not be used anymore
+	STATE_CLOSED
+)
+
+var stateNames = map[State]string{
+	STATE_DISCONNECTED:  "disconnected",
+	STATE_DIALING:       "dialing",
+	STATE_CONNECTING:    "connecting",
+	STATE_CONNECTED:     "connected",
+	STATE_RECONNECTING:  "reconnecting",
+	STATE_DISCONNECTING: "disconnecting",
+	STATE_CLOSED:        "closed",
+}
+
+func (s State) String() string {
+	if name, ok := stateNames[s]; ok {
+		return name
+	}
+	return "unknown state"
+}
+
+// True while the MQTT connection is established, until the DISCONNECT is sent
+func (s State) connected() bool {
+	return s == STATE_CONNECTED || s == STATE_DISCONNECTING
+}
+
+// Called on each state transition by the goroutine changing the state, without any lock held
+type StateHandler func(mc *MqttClient, userData interface{}, from State, to State)
+
+// Current connection state
+func (mc *MqttClient) State() State {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	return mc.state
+}
+
+// Call the handler on each state transition, a handler with the same name is replaced
+func (mc *MqttClient) AddStateHandler(name string, handler StateHandler) {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	mc.stateHandlers[name] = handler
+}
+
+func (mc *MqttClient) RemoveStateHandler(name string) {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	delete(mc.stateHandlers, name)
+}
+
+// Change the state and call the state handlers, STATE_CLOSED is final
+func (mc *MqttClient) setState(to State) {
+
+	mc.mu.Lock()
+	from := mc.state
+	if from == to || from == STATE_CLOSED {
+		mc.mu.Unlock()
+		return
+	}
+	mc.state = to
+
+	handlers := make([]StateHandler, 0, len(mc.stateHandlers))
+	for _, handler := range mc.stateHandlers {
+		handlers = append(handlers, handler)
+	}
+	mc.mu.Unlock()
+
+	for _, handler := range handlers {
+		handler(mc, mc.userData, from, to)
+	}
+}
@@ -1,12 +1,161 @@
 package subscription
 
+import (
+	"fmt"
+	"strings"
+
+	mqtttopic "github.com/easygithdev/mqtt/topic"
+)
+
+// Prefix of the MQTT 5 shared subscriptions ($share/group/filter)
+const SHARE_PREFIX = "$share/"
+
+// Retain handling option (MQTT 5)
+const (
+	// Send retained messages at the time of the subscribe
+	RETAIN_HANDLING_SEND = 0x00
+	// Send retained messages only if the subscription does not exist
+	RETAIN_HANDLING_SEND_IF_NEW = 0x01
+	// Do not send retained messages
+	RETAIN_HANDLING_DO_NOT_SEND = 0x02
+)
+
 type Subscriptions map[string]Subscription
 
 type Subscription struct {
 	Topic string
 	Qos   byte
+
+	// MQTT 5 subscription options
+	NoLocal           bool
+	RetainAsPublished bool
+	RetainHandling    byte
+
+	// MQTT 5 subscription identifier, 0 means none
+	SubscriptionIdentifier int
+
+	// QoS granted by the server in the SUBACK, Qos is requested again on reconnection
+	GrantedQos byte
 }
 
-func New(topic string, qos byte) *Subscription {
-	return &Subscription{topic, qos}
+type SubscriptionOption func(s *Subscription)
+
+func New(topic string, qos byte, opts ...SubscriptionOption) *Subscription {
+	s := &Subscription{Topic: topic, Qos: qos}
+
+	for _, applyOpt := range opts {
+		if applyOpt != nil {
+			applyOpt(s)
+		}
+	}
+
+	return s
+}
+
+// The server does not forward the messages published by this client
+func WithNoLocal() SubscriptionOption {
+	return func(s *Subscription) {
+		s.NoLocal = true
+	}
+}
+
+// The server keeps the retain flag of the forwarded messages
+func WithRetainAsPublished() SubscriptionOption {
+	return func(s *Subscription) {
+		s.RetainAsPublished = true
+	}
+}
+
+func WithRetainHandling(retainHandling byte) SubscriptionOption {
+	return func(s *Subscription) {
+		s.RetainHandling = retainHandling
+	}
+}
+
+// Identifier sent back by the server with each matching message
+func WithSubscriptionIdentifier(id int) SubscriptionOption {
+	return func(s *Subscription) {
+		s.SubscriptionIdentifier = id
+	}
+}
+
+// Build a shared subscription filter
+func Share(group string, topic string) string {
+	return SHARE_PREFIX + group + "/" + topic
+}
+
+// Split a shared subscription filter into its group and topic filter
+// ok is false when the filter is not a shared subscription
+func SplitShare(filter string) (group string, topic string, ok bool) {
+	if !strings.HasPrefix(filter, SHARE_PREFIX) {
+		return "", filter, false
+	}
+
+	parts := strings.SplitN(strings.TrimPrefix(filter, SHARE_PREFIX), "/", 2)
+	if len(parts) != 2 {
+		return "", filter, false
+	}
+
+	return parts[0], parts[1], true
+}
+
+func (s *Subscription) IsShared() bool {
+	_, _, ok := SplitShare(s.Topic)
+	return ok
+}
+
+// True if any MQTT 5 only option is set
+func (s *Subscription) HasV5Options() bool {
+	return s.NoLocal || s.RetainAsPublished || s.RetainHandling != RETAIN_HANDLING_SEND || s.SubscriptionIdentifier != 0
+}
+
+// Subscription options byte of the SUBSCRIBE payload
+// bits 0-1 QoS, bit 2 No Local, bit 3 Retain As Published, bits 4-5 Retain Handling
+func (s *Subscription) Options() byte {
+	options := s.Qos & 0x03
+
+	if s.NoLocal {
+		options |= 1 << 2
+	}
+
+	if s.RetainAsPublished {
+		options |= 1 << 3
+	}
+
+	options |= (s.RetainHandling & 0x03) << 4
+
+	return options
+}
+
+func (s *Subscription) Validate() error {
+	if s.Qos > 2 {
+		return fmt.Errorf("invalid QoS %d", s.Qos)
+	}
+
+	if s.RetainHandling > RETAIN_HANDLING_DO_NOT_SEND {
+		return fmt.Errorf("invalid retain handling %d", s.RetainHandling)
+	}
+
+	if s.SubscriptionIdentifier < 0 || s.SubscriptionIdentifier > 268435455 {
+		return fmt.Errorf("invalid subscription identifier %d", s.SubscriptionIdentifier)
+	}
+
+	filter := s.Topic
+	if strings.HasPrefix(s.Topic, SHARE_PREFIX) {
+		group, topic, ok := SplitShare(s.Topic)
+		if !ok || group == "" || topic == "" || strings.ContainsAny(group, "+#") {
+			return fmt.Errorf("invalid shared subscription %s", s.Topic)
+		}
+		// It is a protocol error to set No Local on a shared subscription
+		if s.NoLocal {
+			return fmt.Errorf("no local is not allowed on shared subscription %s", s.Topic)
+		}
+		filter = topic
+	}
+
+	if err := mqtttopic.ValidateFilter(filter); err != nil {
+		return fmt.Errorf("invalid topic filter %q: %w", s.Topic, err)
+	}
+
+	return nil
 }
@@ -0,0 +1,129 @@
+// MIT License
+
+// Copyright (c) 2022 Florent Brusciano
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+package tracing
+
+import (
+	"bytes"
+	"context"
+)
+
+// Name of the MQTT 5 user property carrying the W3C trace context
+const TRACEPARENT = "traceparent"
+
+// Span of a message published or received
+type Span interface {
+	// W3C traceparent of the span, sent with the message
+	TraceParent() string
+
+	End(err error)
+}
+
+// Start the spans of the messages, to adapt OpenTelemetry for instance
+type Tracer interface {
+	// Span of a publish, child of the span found in the context if any
+	StartPublish(ctx context.Context, topic string) Span
+
+	// Span of a message received, child of the traceparent sent with it, "" if none
+	// It ends once the handlers have been called
+	StartReceive(topic string, parent string) Span
+}
+
+// Carry the traceparent in the payload when the protocol has no user property (MQTT 3.1.1)
+// The publisher and the subscribers must use the same envelope
+type Envelope interface {
+	Wrap(traceParent string, payload []byte) []byte
+
+	// Return the traceparent and the payload without it, "" if there is none
+	Unwrap(payload []byte) (string, []byte)
+}
+
+// Envelope prefixing the payload with a "traceparent: <value>" line
+func LineEnvelope() Envelope {
+	return lineEnvelope{}
+}
+
+type lineEnvelope struct{}
+
+var linePrefix = []byte(TRACEPARENT + ": ")
+
+func (lineEnvelope) Wrap(traceParent string, payload []byte) []byte {
+	if !Valid(traceParent) {
+		return payload
+	}
+	wrapped := make([]byte, 0, len(linePrefix)+len(traceParent)+1+len(payload))
+	wrapped = append(wrapped, linePrefix...)
+	wrapped = append(wrapped, traceParent...)
+	wrapped = append(wrapped, '\n')
+	return append(wrapped, payload...)
+}
+
+func (lineEnvelope) Unwrap(payload []byte) (string, []byte) {
+	if !bytes.HasPrefix(payload, linePrefix) {
+		return "", payload
+	}
+	end := bytes.IndexByte(payload, '\n')
+	if end < 0 {
+		return "", payload
+	}
+	traceParent := string(payload[len(linePrefix):end])
+	if !Valid(traceParent) {
+		return "", payload
+	}
+	return traceParent, payload[end+1:]
+}
+
+// Check a W3C traceparent: version-traceid-parentid-flags in lowercase hexadecimal,
+// version ff and the all zero trace and parent identifiers are invalid
+func Valid(traceParent string) bool {
+	// 00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01
+	if len(traceParent) < 55 || (len(traceParent) > 55 && traceParent[55] != '-') {
+		return false
+	}
+	if traceParent[2] != '-' || traceParent[35] != '-' || traceParent[52] != '-' {
+		return false
+	}
+	version := traceParent[0:2]
+	if !isHex(version) || version == "ff" || (version == "00" && len(traceParent) != 55) {
+		return false
+	}
+	traceId, parentId, flags := traceParent[3:35], traceParent[36:52], traceParent[53:55]
+	return isHex(traceId) && !isZero(traceId) && isHex(parentId) && !isZero(parentId) && isHex(flags)
+}
+
+func isHex(s string) bool {
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if !(c >= '0' && c <= '9' || c >= 'a' && c <= 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+func isZero(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] != '0' {
+			return false
+		}
+	}
+	return true
+}
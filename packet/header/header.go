@@ -22,7 +22,7 @@
 package header
 
 import (
-	"bytes"
+	"errors"
 	"fmt"
 
 	"github.com/easygithdev/mqtt/packet/util"
@@ -155,15 +155,16 @@ func WithDup() OptionHeader {
 }
 
 func (mh *MqttHeader) Encode() []byte {
-	var buffer bytes.Buffer
+	return mh.AppendEncode(make([]byte, 0, mh.Len()))
+}
+
+func (mh *MqttHeader) AppendEncode(dst []byte) []byte {
 
 	// 1 byte
-	buffer.WriteByte(mh.Control)
+	dst = append(dst, mh.Control)
 
 	// 1-4 bytes
-	buffer.Write(mh.RemainingLength)
-
-	return buffer.Bytes()
+	return append(dst, mh.RemainingLength...)
 }
 
 func (mh *MqttHeader) Decode(buffer []byte) {
@@ -221,8 +222,22 @@ func ControlToString(control byte) string {
 }
 
 func RemainingLengthEncode(x int) []byte {
+	return RemainingLengthAppend(make([]byte, 0, RemainingLengthLen(x)), x)
+}
+
+// Number of bytes of the encoded remaining length
+func RemainingLengthLen(x int) int {
+	n := 1
+	for x >= 128 {
+		x /= 128
+		n++
+	}
+	return n
+}
+
+// Append the encoded remaining length to buffer
+func RemainingLengthAppend(buffer []byte, x int) []byte {
 
-	var buffer []byte = make([]byte, 0)
 	var encodedByte int = 0
 	for {
 		encodedByte = x % 128
@@ -276,3 +291,19 @@ func RemaingLengthDecode(x []byte) (int, int) {
 
 	return nbBytes, value
 }
+
+var ErrMalformedRemainingLength = errors.New("malformed remaining length")
+
+// Decode a remaining length of at most 4 bytes, return the number of bytes read and the value
+func RemainingLengthDecode(x []byte) (int, int, error) {
+	value := 0
+	multiplier := 1
+	for i := 0; i < len(x) && i < 4; i++ {
+		value += int(x[i]&127) * multiplier
+		if x[i]&128 == 0 {
+			return i + 1, value, nil
+		}
+		multiplier *= 128
+	}
+	return 0, 0, ErrMalformedRemainingLength
+}
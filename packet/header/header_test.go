@@ -49,3 +49,25 @@ func TestRemaingLengthDecode(t *testing.T) {
 	}
 
 }
+
+func TestRemainingLengthDecode(t *testing.T) {
+
+	for _, x := range []int{0, 127, 128, 321, 16383, 16384, 2097151, 2097152, 268435455} {
+		n, v, err := RemainingLengthDecode(RemainingLengthEncode(x))
+		if err != nil || n != RemainingLengthLen(x) || v != x {
+			t.Errorf("RemainingLengthDecode %d found %d, %d, %v", x, n, v, err)
+		}
+	}
+
+	for _, data := range [][]byte{
+		{},
+		{0x80},
+		{0xFF, 0xFF, 0xFF},
+		{0xFF, 0xFF, 0xFF, 0xFF, 0x7F},
+		{0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0x7F},
+	} {
+		if _, _, err := RemainingLengthDecode(data); err != ErrMalformedRemainingLength {
+			t.Errorf("RemainingLengthDecode %v found %v; want %v", data, err, ErrMalformedRemainingLength)
+		}
+	}
+}
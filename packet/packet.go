@@ -24,9 +24,12 @@ package packet
 import (
 	"bytes"
 	"fmt"
+	"io"
+	"sync"
 
 	"github.com/easygithdev/mqtt/packet/header"
 	"github.com/easygithdev/mqtt/packet/payload"
+	"github.com/easygithdev/mqtt/packet/property"
 	"github.com/easygithdev/mqtt/packet/util"
 	"github.com/easygithdev/mqtt/packet/vheader"
 )
@@ -90,88 +93,490 @@ func WithPayload(payload *payload.MqttPayload) OptionPacket {
 	}
 }
 
-func Encode(mp *MqttPacket) []byte {
+// Largest remaining length, encoded on 4 bytes
+const MAX_REMAINING_LENGTH = 268435455
 
-	// compute the fields
-	var mqttBuffer bytes.Buffer
+// Encode the packet once checked by Validate
+func Encode(mp *MqttPacket) ([]byte, error) {
 
-	var vhLen, pLen int = 0, 0
+	buffer, err := AppendEncode(make([]byte, 0, Len(mp)), mp)
+	if err != nil {
+		return nil, err
+	}
+
+	// Keep the computed length in the header, as shown by ShowPacket
+	mp.Header.RemainingLength = header.RemainingLengthEncode(remainingLength(mp))
+
+	return buffer, nil
+}
+
+// Size of the variable header and the payload
+func remainingLength(mp *MqttPacket) int {
+	n := 0
+
+	if mp.VariableHeader != nil {
+		n += mp.VariableHeader.Len()
+	}
+
+	if mp.Payload != nil {
+		n += mp.Payload.Len()
+	}
+
+	return n
+}
+
+// Size of the encoded packet, computed without encoding it
+func Len(mp *MqttPacket) int {
+	rl := remainingLength(mp)
+	return 1 + header.RemainingLengthLen(rl) + rl
+}
+
+// Append the encoded packet to dst
+// Nothing is allocated when dst has room for Len(mp) more bytes
+// dst is returned unchanged with the error of Validate or ErrPacketTooLarge
+func AppendEncode(dst []byte, mp *MqttPacket) ([]byte, error) {
+
+	if err := Validate(mp); err != nil {
+		return dst, err
+	}
+
+	rl := remainingLength(mp)
+	if rl > MAX_REMAINING_LENGTH {
+		return dst, ErrPacketTooLarge
+	}
+
+	dst = append(dst, mp.Header.Control)
+	dst = header.RemainingLengthAppend(dst, rl)
 
 	if mp.VariableHeader != nil {
-		vhLen = mp.VariableHeader.Len()
+		dst = mp.VariableHeader.AppendEncode(dst)
 	}
 
 	if mp.Payload != nil {
-		pLen = mp.Payload.Len()
+		dst = mp.Payload.AppendEncode(dst)
 	}
 
-	mp.Header.RemainingLength = header.RemainingLengthEncode(vhLen + pLen)
+	return dst, nil
+}
+
+// Buffers larger than this are not kept in the pool
+const MAX_POOLED_BUFFER = 64 * 1024
+
+var bufferPool = sync.Pool{
+	New: func() interface{} {
+		buffer := make([]byte, 0, 512)
+		return &buffer
+	},
+}
+
+// Encode the packet in a pooled buffer and write it with a single call
+func EncodeTo(w io.Writer, mp *MqttPacket) (int, error) {
 
-	mqttBuffer.Write(mp.Header.Encode())
+	buffer := bufferPool.Get().(*[]byte)
 
-	if vhLen > 0 {
-		mqttBuffer.Write(mp.VariableHeader.Encode())
+	var err error
+	*buffer, err = AppendEncode((*buffer)[:0], mp)
+
+	n := 0
+	if err == nil {
+		n, err = w.Write(*buffer)
 	}
 
-	if pLen > 0 {
-		mqttBuffer.Write(mp.Payload.Encode())
+	if cap(*buffer) <= MAX_POOLED_BUFFER {
+		bufferPool.Put(buffer)
 	}
 
-	return mqttBuffer.Bytes()
+	return n, err
+}
+
+// Read exactly one control packet from the reader
+// The fixed header is read first to know how many bytes remain
+func Read(r io.Reader) ([]byte, error) {
+	return ReadLimit(r, 0)
 }
 
+// Read one control packet of at most max bytes, 0 means no limit
+// A larger packet fails with ErrPacketTooLarge before its content is allocated and read
+func ReadLimit(r io.Reader, max int) ([]byte, error) {
+
+	buffer := make([]byte, 1, 5)
+	if _, err := io.ReadFull(r, buffer); err != nil {
+		return nil, err
+	}
+
+	// Remaining length is encoded on 1-4 bytes
+	b := make([]byte, 1)
+	for i := 0; ; i++ {
+		if i == 4 {
+			return nil, fmt.Errorf("malformed remaining length")
+		}
+		if _, err := io.ReadFull(r, b); err != nil {
+			return nil, err
+		}
+		buffer = append(buffer, b[0])
+		if b[0]&128 == 0 {
+			break
+		}
+	}
+
+	_, rLength, _ := header.RemainingLengthDecode(buffer[1:])
+	if max != 0 && len(buffer)+rLength > max {
+		return nil, ErrPacketTooLarge
+	}
+
+	data := make([]byte, len(buffer)+rLength)
+	copy(data, buffer)
+	if _, err := io.ReadFull(r, data[len(buffer):]); err != nil {
+		return nil, err
+	}
+
+	return data, nil
+}
+
+// Decode a packet sent with protocol level 3 or 4
 func Decode(data []byte) *MqttPacket {
+	return decode(data, false)
+}
+
+// Decode a packet sent with protocol level 5
+func DecodeV5(data []byte) *MqttPacket {
+	return decode(data, true)
+}
+
+func decode(data []byte, v5 bool) *MqttPacket {
 
 	var mp *MqttPacket = nil
 
+	if len(data) < 2 {
+		return nil
+	}
+
 	bb := bytes.NewBuffer(data)
 	control, _ := bb.ReadByte()
+	nb, _, err := header.RemainingLengthDecode(bb.Bytes())
+	if err != nil {
+		return nil
+	}
+	remainingLength := bb.Next(nb)
+
+	// check the packet type
+	switch control & 0xF0 {
+	case header.CONNECT:
+		header := header.New(header.WithControl(control))
+		header.RemainingLength = remainingLength
+
+		name, ok := readString(bb)
+		if !ok || bb.Len() < 4 {
+			return nil
+		}
+		level, _ := bb.ReadByte()
+		flag, _ := bb.ReadByte()
+		keepAlive := util.Bytes2uint16(bb.Next(2))
+		vHeader := vheader.NewConnectHeader(name, level, flag, keepAlive)
+
+		// The CONNECT tells its own protocol level
+		if level == 5 {
+			properties, pLen, err := property.Decode(bb.Bytes())
+			if err != nil {
+				return nil
+			}
+			bb.Next(pLen)
+			vHeader.Properties = properties
+		}
+
+		// Client identifier, will topic, will message, user name, password
+		payload := payload.New()
+		clientId, ok := readString(bb)
+		if !ok {
+			return nil
+		}
+		payload.AddString(clientId)
+
+		if flag&vheader.CONNECT_FLAG_WILL_FLAG != 0 {
+			if level == 5 {
+				_, pLen, err := property.Decode(bb.Bytes())
+				if err != nil {
+					return nil
+				}
+				bb.Next(pLen)
+			}
+			willTopic, ok := readString(bb)
+			if !ok {
+				return nil
+			}
+			// The will message is binary data
+			willMessage, ok := readBinary(bb)
+			if !ok {
+				return nil
+			}
+			payload.AddString(willTopic)
+			payload.AddString(willMessage)
+		}
+
+		if flag&vheader.CONNECT_FLAG_USERNAME != 0 {
+			username, ok := readString(bb)
+			if !ok {
+				return nil
+			}
+			payload.AddString(username)
+		}
+
+		// The password is binary data
+		if flag&vheader.CONNECT_FLAG_PASSWORD != 0 {
+			password, ok := readBinary(bb)
+			if !ok {
+				return nil
+			}
+			payload.AddString(password)
+		}
+
+		mp = NewMqttPacket(header, WithVariableHeader(vHeader), WithPayload(payload))
 
-	// check the first byte
-	switch data[0] {
-	// case header.CONNECT:
 	case header.CONNACK:
 
-		header := header.New(header.WithControl(control), header.WithRemainingLength(2))
-		rl, _ := bb.ReadByte()
-		header.RemainingLength = []byte{rl}
+		header := header.New(header.WithControl(control))
+		header.RemainingLength = remainingLength
 		vHeader := vheader.NewGenericHeader(bb.Bytes())
 		mp = NewMqttPacket(header, WithVariableHeader(vHeader))
 
-	// case header.PUBLISH:
+	case header.PUBLISH:
+		header := header.New(header.WithControl(control))
+		header.RemainingLength = remainingLength
+
+		topic, ok := readString(bb)
+		if !ok {
+			return nil
+		}
+		vHeader := vheader.NewPublishHeader(topic)
+
+		// Packet identifier only when QoS > 0
+		if (control>>1)&0x03 > 0 {
+			if bb.Len() < 2 {
+				return nil
+			}
+			vHeader.PacketId = util.Bytes2uint16(bb.Next(2))
+		}
+
+		if v5 {
+			properties, pLen, err := property.Decode(bb.Bytes())
+			if err != nil {
+				return nil
+			}
+			bb.Next(pLen)
+			vHeader.Properties = properties
+		}
+
+		payload := payload.New(payload.WithData(bb.Bytes()))
+		mp = NewMqttPacket(header, WithVariableHeader(vHeader), WithPayload(payload))
+
 	case header.PUBACK, header.PUBREC, header.PUBREL, header.PUBCOMP:
+		if bb.Len() < 2 {
+			return nil
+		}
 		header := header.New(header.WithControl(control))
-		rl, _ := bb.ReadByte()
-		header.RemainingLength = []byte{rl}
+		header.RemainingLength = remainingLength
 		vHeader := vheader.NewPacketIdHeader(util.Bytes2uint16(bb.Bytes()))
 		mp = NewMqttPacket(header, WithVariableHeader(vHeader))
 
 	case header.SUBSCRIBE:
+		// The topic filters and their options are left to the caller
+		header := header.New(header.WithControl(control))
+		header.RemainingLength = remainingLength
+		if bb.Len() < 2 {
+			return nil
+		}
+		vHeader := vheader.NewPacketIdHeader(util.Bytes2uint16(bb.Next(2)))
+		mp = NewMqttPacket(header, WithVariableHeader(vHeader))
 	case header.SUBACK:
 		header := header.New(header.WithControl(control))
-		rl, _ := bb.ReadByte()
-		header.RemainingLength = []byte{rl}
+		header.RemainingLength = remainingLength
 		buff := make([]byte, 2)
 		n, _ := bb.Read(buff)
+		if n < 2 {
+			return nil
+		}
 		vHeader := vheader.NewPacketIdHeader(util.Bytes2uint16(buff[:n]))
+		if v5 {
+			properties, pLen, err := property.Decode(bb.Bytes())
+			if err != nil {
+				return nil
+			}
+			bb.Next(pLen)
+			vHeader.Properties = properties
+		}
 		pl, _ := bb.ReadByte()
 		payload := payload.New(payload.WithQos(pl))
 		mp = NewMqttPacket(header, WithVariableHeader(vHeader), WithPayload(payload))
 	case header.UNSUBSCRIBE:
+		header := header.New(header.WithControl(control))
+		header.RemainingLength = remainingLength
+		if bb.Len() < 2 {
+			return nil
+		}
+		vHeader := vheader.NewPacketIdHeader(util.Bytes2uint16(bb.Next(2)))
+		if v5 {
+			properties, pLen, err := property.Decode(bb.Bytes())
+			if err != nil {
+				return nil
+			}
+			bb.Next(pLen)
+			vHeader.Properties = properties
+		}
+		payload := payload.New()
+		for bb.Len() > 0 {
+			topic, ok := readString(bb)
+			if !ok {
+				return nil
+			}
+			payload.AddString(topic)
+		}
+		mp = NewMqttPacket(header, WithVariableHeader(vHeader), WithPayload(payload))
 	case header.UNSUBACK:
-	case header.PINGREQ:
-	case header.PINGRESP:
+		header := header.New(header.WithControl(control))
+		header.RemainingLength = remainingLength
+		if bb.Len() < 2 {
+			return nil
+		}
+		vHeader := vheader.NewPacketIdHeader(util.Bytes2uint16(bb.Next(2)))
+		mp = NewMqttPacket(header, WithVariableHeader(vHeader))
+	case header.PINGREQ, header.PINGRESP:
 		header := header.New(header.WithControl(control))
 		mp = NewMqttPacket(header)
-		rl, _ := bb.ReadByte()
-		header.RemainingLength = []byte{rl}
+		header.RemainingLength = remainingLength
 	case header.DISCONNECT:
+		header := header.New(header.WithControl(control))
+		header.RemainingLength = remainingLength
+		mp = NewMqttPacket(header)
+		// MQTT 5 adds a reason code and properties, both optional
+		if v5 && bb.Len() > 0 {
+			vHeader := vheader.NewDisconnectHeader(0, nil)
+			vHeader.ReasonCode, _ = bb.ReadByte()
+			if bb.Len() > 0 {
+				properties, _, err := property.Decode(bb.Bytes())
+				if err != nil {
+					return nil
+				}
+				vHeader.Properties = properties
+			}
+			mp.VariableHeader = vHeader
+		}
 	case header.AUTH:
+		header := header.New(header.WithControl(control))
+		header.RemainingLength = remainingLength
+		// A remaining length of 0 means success without properties
+		vHeader := vheader.NewAuthHeader(0, nil)
+		if bb.Len() > 0 {
+			vHeader.ReasonCode, _ = bb.ReadByte()
+		}
+		if bb.Len() > 0 {
+			properties, _, err := property.Decode(bb.Bytes())
+			if err != nil {
+				return nil
+			}
+			vHeader.Properties = properties
+		}
+		mp = NewMqttPacket(header, WithVariableHeader(vHeader))
 	}
 
 	return mp
 }
 
+// Read a length prefixed string, false if the buffer is too short
+// Read a UTF-8 string, false if malformed
+func readString(bb *bytes.Buffer) (string, bool) {
+	n, str, err := util.StringDecode(bb.Bytes())
+	if err != nil {
+		return "", false
+	}
+	bb.Next(n)
+	return str, true
+}
+
+// Read binary data, false if malformed
+func readBinary(bb *bytes.Buffer) (string, bool) {
+	n, data, err := util.BinaryDecode(bb.Bytes())
+	if err != nil {
+		return "", false
+	}
+	bb.Next(n)
+	return string(data), true
+}
+
+// Check the strings of a packet before encoding it : the UTF-8 strings
+// must be well-formed and every string or binary data at most 65535 bytes
+func Validate(mp *MqttPacket) error {
+
+	var properties *property.Properties
+
+	switch vh := mp.VariableHeader.(type) {
+	case *vheader.ConnectHeader:
+		if err := util.ValidateString(vh.ProtocolName); err != nil {
+			return fmt.Errorf("protocol name: %w", err)
+		}
+		properties = vh.Properties
+	case *vheader.PublishHeader:
+		if err := util.ValidateString(vh.TopicName); err != nil {
+			return fmt.Errorf("topic name: %w", err)
+		}
+		properties = vh.Properties
+	case *vheader.PacketIdHeader:
+		properties = vh.Properties
+	case *vheader.AuthHeader:
+		properties = vh.Properties
+	case *vheader.DisconnectHeader:
+		properties = vh.Properties
+	}
+
+	if properties != nil {
+		if err := properties.Validate(); err != nil {
+			return fmt.Errorf("properties: %w", err)
+		}
+	}
+
+	if mp.Payload == nil {
+		return nil
+	}
+
+	// Binary data of a CONNECT : the will message and the password
+	binary := map[int]bool{}
+	names := []string{}
+	if vh, ok := mp.VariableHeader.(*vheader.ConnectHeader); ok {
+		names = append(names, "client identifier")
+		if vh.Flag&vheader.CONNECT_FLAG_WILL_FLAG != 0 {
+			names = append(names, "will topic", "will message")
+			binary[len(names)-1] = true
+		}
+		if vh.Flag&vheader.CONNECT_FLAG_USERNAME != 0 {
+			names = append(names, "username")
+		}
+		if vh.Flag&vheader.CONNECT_FLAG_PASSWORD != 0 {
+			names = append(names, "password")
+			binary[len(names)-1] = true
+		}
+	}
+
+	for i, str := range mp.Payload.Payload {
+		name := "topic filter"
+		if i < len(names) {
+			name = names[i]
+		}
+
+		var err error
+		if binary[i] {
+			if len(str) > util.MAX_STRING_LEN {
+				err = util.ErrStringTooLong
+			}
+		} else {
+			err = util.ValidateString(str)
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+	}
+
+	return nil
+}
+
 func (mp *MqttPacket) String() string {
 
 	strHeader := "****************\tHeader\t****************\n" +
@@ -0,0 +1,323 @@
+// MIT License
+
+// Copyright (c) 2022 Florent Brusciano
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+package packet
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/easygithdev/mqtt/packet/header"
+	"github.com/easygithdev/mqtt/packet/payload"
+	"github.com/easygithdev/mqtt/packet/property"
+	"github.com/easygithdev/mqtt/packet/util"
+	"github.com/easygithdev/mqtt/packet/vheader"
+)
+
+func publishPacket() *MqttPacket {
+	mh := header.New(header.WithControl(header.PUBLISH), header.WithQos1())
+	mvh := vheader.NewPublishHeader("sensors/kitchen/temperature")
+	mvh.PacketId = 42
+	mvh.Properties = property.New()
+	mvh.Properties.MessageExpiryInterval = property.Uint32(60)
+	mvh.Properties.User = []property.UserProperty{{Key: "unit", Value: "celsius"}}
+	mpl := payload.New(payload.WithData(bytes.Repeat([]byte("21.5"), 64)))
+	return NewMqttPacket(mh, WithVariableHeader(mvh), WithPayload(mpl))
+}
+
+func testPackets() map[string]*MqttPacket {
+	connect := vheader.NewConnectHeader("MQTT", 5, vheader.CONNECT_FLAG_CLEAN_SESSION|vheader.CONNECT_FLAG_USERNAME|vheader.CONNECT_FLAG_PASSWORD, 60)
+	connect.Properties = property.New()
+	connect.Properties.SessionExpiryInterval = property.Uint32(3600)
+
+	subscribe := vheader.NewPacketIdHeader(7)
+	subscribe.Properties = property.New()
+	subscribe.Properties.SubscriptionIdentifier = []int{268435455}
+
+	return map[string]*MqttPacket{
+		"CONNECT": NewMqttPacket(header.New(header.WithControl(header.CONNECT)), WithVariableHeader(connect),
+			WithPayload(payload.New(payload.WithString("client"), payload.WithString("user"), payload.WithString("password")))),
+		"PUBLISH": publishPacket(),
+		"SUBSCRIBE": NewMqttPacket(header.New(header.WithSubscribe()), WithVariableHeader(subscribe),
+			WithPayload(payload.New(payload.WithString("sensors/#"), payload.WithQos(1)))),
+		"PUBACK":     NewMqttPacket(header.New(header.WithControl(header.PUBACK)), WithVariableHeader(vheader.NewPacketIdHeader(42))),
+		"DISCONNECT": NewMqttPacket(header.New(header.WithControl(header.DISCONNECT)), WithVariableHeader(vheader.NewDisconnectHeader(0, nil))),
+		"PINGREQ":    NewMqttPacket(header.New(header.WithControl(header.PINGREQ))),
+	}
+}
+
+func TestEncode(t *testing.T) {
+
+	for name, mp := range testPackets() {
+
+		encoded, err := Encode(mp)
+		if err != nil {
+			t.Errorf("%s: Encode error %s", name, err)
+			continue
+		}
+		if Len(mp) != len(encoded) {
+			t.Errorf("%s: Len found %d; want %d", name, Len(mp), len(encoded))
+		}
+
+		// The remaining length of the fixed header covers the rest of the packet
+		n, rl := header.RemaingLengthDecode(encoded[1:])
+		if 1+n+rl != len(encoded) {
+			t.Errorf("%s: remaining length %d for %d byte(s)", name, rl, len(encoded))
+		}
+
+		prefix := []byte{0xCA, 0xFE}
+		if appended, err := AppendEncode(prefix, mp); err != nil || !bytes.Equal(appended[2:], encoded) || !bytes.Equal(appended[:2], prefix) {
+			t.Errorf("%s: AppendEncode found %v; want %v", name, appended, encoded)
+		}
+
+		var buffer bytes.Buffer
+		written, err := EncodeTo(&buffer, mp)
+		if err != nil || written != len(encoded) || !bytes.Equal(buffer.Bytes(), encoded) {
+			t.Errorf("%s: EncodeTo found %v (%d, %v); want %v", name, buffer.Bytes(), written, err, encoded)
+		}
+	}
+
+	mp := DecodeV5(must(Encode(publishPacket())))
+	if vh := mp.VariableHeader.(*vheader.PublishHeader); vh.TopicName != "sensors/kitchen/temperature" || vh.PacketId != 42 {
+		t.Errorf("Decode found %s", mp)
+	}
+}
+
+// The strings are checked, never truncated
+func TestEncodeInvalid(t *testing.T) {
+
+	long := strings.Repeat("a", util.MAX_STRING_LEN+1)
+
+	mp := NewMqttPacket(header.New(header.WithControl(header.PUBLISH)), WithVariableHeader(vheader.NewPublishHeader(long)))
+	if _, err := Encode(mp); !errors.Is(err, util.ErrStringTooLong) {
+		t.Errorf("Encode found %v; want %s", err, util.ErrStringTooLong)
+	}
+	prefix := []byte{0xCA, 0xFE}
+	if appended, err := AppendEncode(prefix, mp); err == nil || !bytes.Equal(appended, prefix) {
+		t.Errorf("AppendEncode found %v (%v); want %v and an error", appended, err, prefix)
+	}
+	var buffer bytes.Buffer
+	if n, err := EncodeTo(&buffer, mp); err == nil || n != 0 || buffer.Len() != 0 {
+		t.Errorf("EncodeTo wrote %d byte(s) (%v); want nothing and an error", n, err)
+	}
+
+	for _, p := range []Packet{
+		&Publish{Topic: long},
+		&Publish{Topic: "a\x00b"},
+		&Publish{Topic: "a", Properties: &property.Properties{ReasonString: "\xFF"}},
+		&Connect{ProtocolName: "MQTT", ProtocolLevel: 4, ClientId: "id", HasPassword: true, Password: []byte(long)},
+		&Subscribe{PacketID: 1, Filters: []SubscribeFilter{{Filter: long}}},
+		&Unsubscribe{PacketID: 1, Filters: []string{"\xFF"}},
+		&Disconnect{ReasonCode: 0x80, Properties: &property.Properties{ReasonString: long}},
+	} {
+		if data, err := p.Encode(); err == nil {
+			t.Errorf("%T encoded %d byte(s); want an error", p, len(data))
+		}
+	}
+}
+
+func TestEncodeAllocations(t *testing.T) {
+
+	mp := publishPacket()
+	dst := make([]byte, 0, Len(mp))
+
+	if allocs := testing.AllocsPerRun(100, func() { AppendEncode(dst[:0], mp) }); allocs != 0 {
+		t.Errorf("AppendEncode allocated %.1f time(s); want 0", allocs)
+	}
+
+	EncodeTo(io.Discard, mp)
+	if allocs := testing.AllocsPerRun(100, func() { EncodeTo(io.Discard, mp) }); allocs != 0 {
+		t.Errorf("EncodeTo allocated %.1f time(s); want 0", allocs)
+	}
+}
+
+func structuredPackets(v5 bool) []Packet {
+
+	var properties *property.Properties
+	if v5 {
+		properties = property.New()
+		properties.ReasonString = "because"
+	}
+
+	connect := &Connect{ProtocolName: "MQTT", ProtocolLevel: 4, CleanSession: true, KeepAlive: 60, ClientId: "client",
+		Will:        &Will{Topic: "status/client", Message: []byte{0, 0xFF}, Qos: 1, Retain: true},
+		HasUsername: true, Username: "user", HasPassword: true, Password: []byte("\xffsecret")}
+	if v5 {
+		connect.ProtocolLevel = 5
+		connect.Properties = property.New()
+		connect.Properties.SessionExpiryInterval = property.Uint32(60)
+		connect.Will.Properties = property.New()
+		connect.Will.Properties.WillDelayInterval = property.Uint32(5)
+	}
+
+	return []Packet{
+		connect,
+		&Connack{SessionPresent: true, ReturnCode: 0, Properties: properties},
+		&Publish{Dup: true, Qos: 2, Retain: true, Topic: "sensors/kitchen", PacketID: 7, Properties: properties, Payload: []byte("21.5")},
+		&Publish{Topic: "sensors/kitchen", Properties: properties, Payload: []byte{}},
+		&Puback{PacketID: 1, Properties: properties},
+		&Pubrec{PacketID: 2, Properties: properties},
+		&Pubrel{PacketID: 3, Properties: properties},
+		&Pubcomp{PacketID: 4, Properties: properties},
+		&Subscribe{PacketID: 5, Properties: properties, Filters: []SubscribeFilter{{Filter: "a/#", Options: 1}, {Filter: "b/+", Options: 2}}},
+		&Suback{PacketID: 5, Properties: properties, ReturnCodes: []byte{1, 0x80}},
+		&Unsubscribe{PacketID: 6, Properties: properties, Filters: []string{"a/#", "b/+"}},
+		&Pingreq{},
+		&Pingresp{},
+		&Disconnect{Properties: properties},
+	}
+}
+
+func TestPackets(t *testing.T) {
+
+	for _, v5 := range []bool{false, true} {
+		for _, p := range structuredPackets(v5) {
+
+			parse := Parse
+			if v5 {
+				parse = ParseV5
+			}
+
+			decoded, err := parse(must(p.Encode()))
+			if err != nil {
+				t.Errorf("%T (v5 %t): Parse error %s", p, v5, err)
+				continue
+			}
+			if decoded.Type() != p.Type() || !reflect.DeepEqual(decoded, p) {
+				t.Errorf("%T (v5 %t): Parse found %+v; want %+v", p, v5, decoded, p)
+			}
+		}
+	}
+
+	// MQTT 5 only
+	auth := &Auth{ReasonCode: 0x18, Properties: property.New()}
+	auth.Properties.AuthenticationMethod = "SCRAM-SHA-256"
+	if decoded, err := ParseV5(must(auth.Encode())); err != nil || !reflect.DeepEqual(decoded, auth) {
+		t.Errorf("Parse found %+v (%v); want %+v", decoded, err, auth)
+	}
+	unsuback := &Unsuback{PacketID: 6, Properties: property.New(), ReasonCodes: []byte{0, 0x11}}
+	if decoded, err := ParseV5(must(unsuback.Encode())); err != nil || !reflect.DeepEqual(decoded, unsuback) {
+		t.Errorf("Parse found %+v (%v); want %+v", decoded, err, unsuback)
+	}
+}
+
+func TestPacketsCompatibility(t *testing.T) {
+
+	// The structured packets and the generic ones are encoded the same way
+	connack := &Connack{SessionPresent: true, ReturnCode: header.CONNECT_REFUSED_5}
+	generic := NewMqttPacket(header.New(header.WithControl(header.CONNACK)), WithVariableHeader(vheader.NewGenericHeader([]byte{1, header.CONNECT_REFUSED_5})))
+	if !bytes.Equal(must(connack.Encode()), must(Encode(generic))) {
+		t.Errorf("Connack encoded %v; want %v", must(connack.Encode()), must(Encode(generic)))
+	}
+
+	mp := publishPacket()
+	publish, err := ParseV5(must(Encode(mp)))
+	if err != nil {
+		t.Fatalf("Parse error %s", err)
+	}
+	if !bytes.Equal(must(publish.Encode()), must(Encode(mp))) {
+		t.Errorf("Publish encoded %v; want %v", must(publish.Encode()), must(Encode(mp)))
+	}
+
+	// A MQTT 3.1.1 CONNACK read by a MQTT 5 client has no property
+	p, err := ParseV5([]byte{header.CONNACK, 2, 0, header.CONNECT_REFUSED_1})
+	if c, ok := p.(*Connack); err != nil || !ok || c.Properties != nil || c.ReturnCode != header.CONNECT_REFUSED_1 {
+		t.Errorf("Parse found %+v (%v); want a CONNACK without properties", p, err)
+	}
+}
+
+func TestParseMalformed(t *testing.T) {
+
+	for _, data := range [][]byte{
+		nil,
+		{header.CONNACK},
+		{header.CONNACK, 2, 0}, // shorter than its remaining length
+		{header.CONNACK, 0x80}, // unterminated remaining length
+		{header.CONNACK, 0xFF, 0xFF, 0xFF, 0xFF, 0x7F}, // remaining length longer than 4 bytes
+		{header.PUBLISH, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0x7F, 0, 0, 0},
+		{header.PUBLISH, 0xFF, 0xFF, 0xFF, 0x7F, 0, 1, 'a'}, // remaining length exceeds the packet
+		{header.PUBLISH, 3, 0, 2, 'a'},                      // topic longer than the packet
+		{header.PUBLISH, 3, 0, 1, 0xFF},                     // topic not UTF-8
+		{header.PUBLISH | 6, 3, 0, 1, 'a'},                  // QoS 3
+		{header.PUBLISH | 2, 3, 0, 1, 'a'},                  // missing packet identifier
+		{header.SUBSCRIBE | 2, 2, 0, 1},                     // no topic filter
+		{header.SUBSCRIBE | 2, 5, 0, 1, 0, 1, 'a'},          // missing options
+		{header.PUBACK, 1, 0},
+		{0x00, 0},
+	} {
+		if p, err := Parse(data); err == nil {
+			t.Errorf("Parse %v found %+v; want an error", data, p)
+		}
+	}
+}
+
+func TestReadLimit(t *testing.T) {
+
+	data := must(Encode(publishPacket()))
+	if read, err := ReadLimit(bytes.NewReader(data), len(data)); err != nil || !bytes.Equal(read, data) {
+		t.Errorf("ReadLimit found %v (%v); want %v", read, err, data)
+	}
+	if _, err := ReadLimit(bytes.NewReader(data), len(data)-1); err != ErrPacketTooLarge {
+		t.Errorf("ReadLimit found %v; want %s", err, ErrPacketTooLarge)
+	}
+
+	// Refused from the remaining length, the 2 MB are neither allocated nor read
+	if _, err := ReadLimit(bytes.NewReader([]byte{header.PUBLISH, 0x80, 0x80, 0x80, 0x01}), 1024); err != ErrPacketTooLarge {
+		t.Errorf("ReadLimit found %v; want %s", err, ErrPacketTooLarge)
+	}
+}
+
+// Packet built from valid fields
+func must(data []byte, err error) []byte {
+	if err != nil {
+		panic(err)
+	}
+	return data
+}
+
+func BenchmarkEncode(b *testing.B) {
+	mp := publishPacket()
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		Encode(mp)
+	}
+}
+
+func BenchmarkAppendEncode(b *testing.B) {
+	mp := publishPacket()
+	dst := make([]byte, 0, Len(mp))
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		dst, _ = AppendEncode(dst[:0], mp)
+	}
+}
+
+func BenchmarkEncodeTo(b *testing.B) {
+	mp := publishPacket()
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		EncodeTo(io.Discard, mp)
+	}
+}
@@ -0,0 +1,985 @@
+// MIT License
+
+// Copyright (c) 2022 Florent Brusciano
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+package packet
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+
+	"github.com/easygithdev/mqtt/packet/header"
+	"github.com/easygithdev/mqtt/packet/property"
+	"github.com/easygithdev/mqtt/packet/util"
+	"github.com/easygithdev/mqtt/packet/vheader"
+)
+
+/////////////////////////////////////////////////
+// Interface Packet
+/////////////////////////////////////////////////
+
+var ErrMalformedPacket = errors.New("malformed packet")
+
+// Returned when a packet exceeds the maximum packet size of the receiver
+var ErrPacketTooLarge = errors.New("packet too large")
+
+// Control packet with named fields
+// The MQTT 5 properties are encoded when Properties is not nil,
+// and decoded when Properties is set before calling Decode (see ParseV5)
+type Packet interface {
+	// Control packet type, header.CONNECT to header.AUTH
+	Type() byte
+
+	// Encode the whole packet, fixed header included
+	// The strings and the properties are checked first, they are never truncated
+	Encode() ([]byte, error)
+
+	// Decode the whole packet, fixed header included
+	Decode(data []byte) error
+}
+
+// Decode a packet sent with protocol level 3 or 4
+func Parse(data []byte) (Packet, error) {
+	return parse(data, false)
+}
+
+// Decode a packet sent with protocol level 5
+func ParseV5(data []byte) (Packet, error) {
+	return parse(data, true)
+}
+
+func parse(data []byte, v5 bool) (Packet, error) {
+
+	if len(data) < 2 {
+		return nil, ErrMalformedPacket
+	}
+
+	var p Packet
+	var properties *property.Properties
+	if v5 {
+		properties = property.New()
+	}
+
+	switch data[0] & 0xF0 {
+	case header.CONNECT:
+		// The CONNECT tells its own protocol level
+		p = &Connect{}
+	case header.CONNACK:
+		p = &Connack{Properties: properties}
+	case header.PUBLISH:
+		p = &Publish{Properties: properties}
+	case header.PUBACK:
+		p = &Puback{Properties: properties}
+	case header.PUBREC:
+		p = &Pubrec{Properties: properties}
+	case header.PUBREL:
+		p = &Pubrel{Properties: properties}
+	case header.PUBCOMP:
+		p = &Pubcomp{Properties: properties}
+	case header.SUBSCRIBE:
+		p = &Subscribe{Properties: properties}
+	case header.SUBACK:
+		p = &Suback{Properties: properties}
+	case header.UNSUBSCRIBE:
+		p = &Unsubscribe{Properties: properties}
+	case header.UNSUBACK:
+		p = &Unsuback{Properties: properties}
+	case header.PINGREQ:
+		p = &Pingreq{}
+	case header.PINGRESP:
+		p = &Pingresp{}
+	case header.DISCONNECT:
+		p = &Disconnect{Properties: properties}
+	case header.AUTH:
+		p = &Auth{Properties: properties}
+	default:
+		return nil, fmt.Errorf("unknown packet type 0x%X", data[0])
+	}
+
+	if err := p.Decode(data); err != nil {
+		return nil, err
+	}
+
+	return p, nil
+}
+
+// Fixed header followed by the body
+func encodePacket(control byte, body []byte) ([]byte, error) {
+	if len(body) > MAX_REMAINING_LENGTH {
+		return nil, ErrPacketTooLarge
+	}
+
+	buffer := make([]byte, 0, 1+header.RemainingLengthLen(len(body))+len(body))
+	buffer = append(buffer, control)
+	buffer = header.RemainingLengthAppend(buffer, len(body))
+	return append(buffer, body...), nil
+}
+
+// Check a string before util.AppendString, which truncates it otherwise
+func validateString(name string, str string) error {
+	if err := util.ValidateString(str); err != nil {
+		return fmt.Errorf("%s: %w", name, err)
+	}
+	return nil
+}
+
+func validateProperties(properties *property.Properties) error {
+	if err := properties.Validate(); err != nil {
+		return fmt.Errorf("properties: %w", err)
+	}
+	return nil
+}
+
+// Check the fixed header and return its flags and the body
+func decodePacket(control byte, data []byte) (byte, *bytes.Buffer, error) {
+
+	if len(data) < 2 || data[0]&0xF0 != control {
+		return 0, nil, ErrMalformedPacket
+	}
+
+	n, rl, err := header.RemainingLengthDecode(data[1:])
+	if err != nil || rl < 0 || rl > MAX_REMAINING_LENGTH || rl > len(data)-1-n {
+		return 0, nil, ErrMalformedPacket
+	}
+
+	return data[0] & 0x0F, bytes.NewBuffer(data[1+n : 1+n+rl]), nil
+}
+
+func readUint16(bb *bytes.Buffer) (uint16, bool) {
+	if bb.Len() < 2 {
+		return 0, false
+	}
+	return util.Bytes2uint16(bb.Next(2)), true
+}
+
+// Read the properties when expected, an absent property length reads as no property
+func readProperties(bb *bytes.Buffer, properties **property.Properties) error {
+	if *properties == nil || bb.Len() == 0 {
+		return nil
+	}
+
+	p, n, err := property.Decode(bb.Bytes())
+	if err != nil {
+		return err
+	}
+	bb.Next(n)
+	*properties = p
+
+	return nil
+}
+
+/////////////////////////////////////////////////
+// CONNECT
+/////////////////////////////////////////////////
+
+// Message published by the server when the client disconnects unexpectedly
+type Will struct {
+	Topic   string
+	Message []byte
+	Qos     byte
+	Retain  bool
+
+	// MQTT 5 will properties
+	Properties *property.Properties
+}
+
+type Connect struct {
+	ProtocolName  string
+	ProtocolLevel byte
+	CleanSession  bool
+	KeepAlive     uint16
+
+	// MQTT 5 properties, only encoded with protocol level 5
+	Properties *property.Properties
+
+	ClientId string
+	Will     *Will
+
+	HasUsername bool
+	Username    string
+	HasPassword bool
+	Password    []byte
+}
+
+func (c *Connect) Type() byte {
+	return header.CONNECT
+}
+
+func (c *Connect) Flags() byte {
+	var flags byte
+	if c.CleanSession {
+		flags |= vheader.CONNECT_FLAG_CLEAN_SESSION
+	}
+	if c.Will != nil {
+		flags |= vheader.CONNECT_FLAG_WILL_FLAG | (c.Will.Qos&0x03)<<3
+		if c.Will.Retain {
+			flags |= vheader.CONNECT_FLAG_WILL_RETAIN
+		}
+	}
+	if c.HasUsername {
+		flags |= vheader.CONNECT_FLAG_USERNAME
+	}
+	if c.HasPassword {
+		flags |= vheader.CONNECT_FLAG_PASSWORD
+	}
+	return flags
+}
+
+func (c *Connect) validate() error {
+	if err := validateString("protocol name", c.ProtocolName); err != nil {
+		return err
+	}
+	if err := validateString("client identifier", c.ClientId); err != nil {
+		return err
+	}
+	if err := validateProperties(c.Properties); err != nil {
+		return err
+	}
+	if c.Will != nil {
+		if err := validateString("will topic", c.Will.Topic); err != nil {
+			return err
+		}
+		if err := util.ValidateBinary(c.Will.Message); err != nil {
+			return fmt.Errorf("will message: %w", err)
+		}
+		if err := validateProperties(c.Will.Properties); err != nil {
+			return err
+		}
+	}
+	if c.HasUsername {
+		if err := validateString("username", c.Username); err != nil {
+			return err
+		}
+	}
+	if c.HasPassword {
+		if err := util.ValidateBinary(c.Password); err != nil {
+			return fmt.Errorf("password: %w", err)
+		}
+	}
+	return nil
+}
+
+func (c *Connect) Encode() ([]byte, error) {
+	if err := c.validate(); err != nil {
+		return nil, err
+	}
+
+	v5 := c.ProtocolLevel == 5
+
+	body := util.AppendString(nil, c.ProtocolName)
+	body = append(body, c.ProtocolLevel, c.Flags())
+	body = util.AppendUint16(body, c.KeepAlive)
+	if v5 {
+		body = c.Properties.AppendEncode(body)
+	}
+
+	body = util.AppendString(body, c.ClientId)
+	if c.Will != nil {
+		if v5 {
+			body = c.Will.Properties.AppendEncode(body)
+		}
+		body = util.AppendString(body, c.Will.Topic)
+		body = util.AppendBinary(body, c.Will.Message)
+	}
+	if c.HasUsername {
+		body = util.AppendString(body, c.Username)
+	}
+	if c.HasPassword {
+		body = util.AppendBinary(body, c.Password)
+	}
+
+	return encodePacket(header.CONNECT, body)
+}
+
+func (c *Connect) Decode(data []byte) error {
+
+	_, bb, err := decodePacket(header.CONNECT, data)
+	if err != nil {
+		return err
+	}
+
+	var ok bool
+	if c.ProtocolName, ok = readString(bb); !ok || bb.Len() < 4 {
+		return ErrMalformedPacket
+	}
+	c.ProtocolLevel, _ = bb.ReadByte()
+	flags, _ := bb.ReadByte()
+	c.KeepAlive, _ = readUint16(bb)
+	c.CleanSession = flags&vheader.CONNECT_FLAG_CLEAN_SESSION != 0
+
+	v5 := c.ProtocolLevel == 5
+	c.Properties = nil
+	if v5 {
+		c.Properties = property.New()
+		if err := readProperties(bb, &c.Properties); err != nil {
+			return err
+		}
+	}
+
+	if c.ClientId, ok = readString(bb); !ok {
+		return ErrMalformedPacket
+	}
+
+	c.Will = nil
+	if flags&vheader.CONNECT_FLAG_WILL_FLAG != 0 {
+		c.Will = &Will{Qos: (flags >> 3) & 0x03, Retain: flags&vheader.CONNECT_FLAG_WILL_RETAIN != 0}
+		if v5 {
+			c.Will.Properties = property.New()
+			if err := readProperties(bb, &c.Will.Properties); err != nil {
+				return err
+			}
+		}
+		if c.Will.Topic, ok = readString(bb); !ok {
+			return ErrMalformedPacket
+		}
+		message, ok := readBinary(bb)
+		if !ok {
+			return ErrMalformedPacket
+		}
+		c.Will.Message = []byte(message)
+	}
+
+	c.HasUsername = flags&vheader.CONNECT_FLAG_USERNAME != 0
+	if c.HasUsername {
+		if c.Username, ok = readString(bb); !ok {
+			return ErrMalformedPacket
+		}
+	}
+
+	c.HasPassword = flags&vheader.CONNECT_FLAG_PASSWORD != 0
+	if c.HasPassword {
+		password, ok := readBinary(bb)
+		if !ok {
+			return ErrMalformedPacket
+		}
+		c.Password = []byte(password)
+	}
+
+	return nil
+}
+
+/////////////////////////////////////////////////
+// CONNACK
+/////////////////////////////////////////////////
+
+type Connack struct {
+	SessionPresent bool
+
+	// Connect return code, or reason code with MQTT 5
+	ReturnCode byte
+
+	// MQTT 5 properties, nil when the server answered with an older protocol level
+	Properties *property.Properties
+}
+
+func (c *Connack) Type() byte {
+	return header.CONNACK
+}
+
+func (c *Connack) Encode() ([]byte, error) {
+	if err := validateProperties(c.Properties); err != nil {
+		return nil, err
+	}
+
+	var flags byte
+	if c.SessionPresent {
+		flags = 1
+	}
+
+	body := []byte{flags, c.ReturnCode}
+	if c.Properties != nil {
+		body = c.Properties.AppendEncode(body)
+	}
+
+	return encodePacket(header.CONNACK, body)
+}
+
+func (c *Connack) Decode(data []byte) error {
+
+	_, bb, err := decodePacket(header.CONNACK, data)
+	if err != nil {
+		return err
+	}
+	if bb.Len() < 2 {
+		return ErrMalformedPacket
+	}
+
+	flags, _ := bb.ReadByte()
+	c.SessionPresent = flags&1 != 0
+	c.ReturnCode, _ = bb.ReadByte()
+
+	// A server not speaking MQTT 5 sends no property
+	if c.Properties != nil && bb.Len() == 0 {
+		c.Properties = nil
+	}
+
+	return readProperties(bb, &c.Properties)
+}
+
+/////////////////////////////////////////////////
+// PUBLISH
+/////////////////////////////////////////////////
+
+type Publish struct {
+	Dup    bool
+	Qos    byte
+	Retain bool
+
+	Topic string
+
+	// Only present when QoS > 0
+	PacketID uint16
+
+	// MQTT 5 properties, nil for older protocol levels
+	Properties *property.Properties
+
+	Payload []byte
+}
+
+func (p *Publish) Type() byte {
+	return header.PUBLISH
+}
+
+func (p *Publish) Encode() ([]byte, error) {
+	if err := validateString("topic name", p.Topic); err != nil {
+		return nil, err
+	}
+	if err := validateProperties(p.Properties); err != nil {
+		return nil, err
+	}
+
+	control := header.PUBLISH | (p.Qos&0x03)<<1
+	if p.Dup {
+		control |= 1 << 3
+	}
+	if p.Retain {
+		control |= 1
+	}
+
+	body := util.AppendString(nil, p.Topic)
+	if p.Qos > 0 {
+		body = util.AppendUint16(body, p.PacketID)
+	}
+	if p.Properties != nil {
+		body = p.Properties.AppendEncode(body)
+	}
+	body = append(body, p.Payload...)
+
+	return encodePacket(control, body)
+}
+
+func (p *Publish) Decode(data []byte) error {
+
+	flags, bb, err := decodePacket(header.PUBLISH, data)
+	if err != nil {
+		return err
+	}
+
+	p.Dup = flags&(1<<3) != 0
+	p.Qos = (flags >> 1) & 0x03
+	p.Retain = flags&1 != 0
+	if p.Qos > 2 {
+		return ErrMalformedPacket
+	}
+
+	var ok bool
+	if p.Topic, ok = readString(bb); !ok {
+		return ErrMalformedPacket
+	}
+
+	p.PacketID = 0
+	if p.Qos > 0 {
+		if p.PacketID, ok = readUint16(bb); !ok {
+			return ErrMalformedPacket
+		}
+	}
+
+	if err := readProperties(bb, &p.Properties); err != nil {
+		return err
+	}
+
+	p.Payload = bb.Bytes()
+
+	return nil
+}
+
+/////////////////////////////////////////////////
+// PUBACK, PUBREC, PUBREL, PUBCOMP
+/////////////////////////////////////////////////
+
+// The MQTT 5 reason code and properties are omitted on success without property
+func encodeAck(control byte, packetId uint16, reasonCode byte, properties *property.Properties) ([]byte, error) {
+	if err := validateProperties(properties); err != nil {
+		return nil, err
+	}
+
+	body := util.AppendUint16(nil, packetId)
+	if properties != nil && (reasonCode != 0 || properties.Len() > 1) {
+		body = append(body, reasonCode)
+		body = properties.AppendEncode(body)
+	}
+	return encodePacket(control, body)
+}
+
+func decodeAck(control byte, data []byte, packetId *uint16, reasonCode *byte, properties **property.Properties) error {
+
+	_, bb, err := decodePacket(control, data)
+	if err != nil {
+		return err
+	}
+
+	var ok bool
+	if *packetId, ok = readUint16(bb); !ok {
+		return ErrMalformedPacket
+	}
+
+	*reasonCode = 0
+	if *properties != nil && bb.Len() > 0 {
+		*reasonCode, _ = bb.ReadByte()
+	}
+
+	return readProperties(bb, properties)
+}
+
+type Puback struct {
+	PacketID uint16
+
+	// MQTT 5 reason code and properties
+	ReasonCode byte
+	Properties *property.Properties
+}
+
+func (p *Puback) Type() byte {
+	return header.PUBACK
+}
+
+func (p *Puback) Encode() ([]byte, error) {
+	return encodeAck(header.PUBACK, p.PacketID, p.ReasonCode, p.Properties)
+}
+
+func (p *Puback) Decode(data []byte) error {
+	return decodeAck(header.PUBACK, data, &p.PacketID, &p.ReasonCode, &p.Properties)
+}
+
+type Pubrec struct {
+	PacketID uint16
+
+	// MQTT 5 reason code and properties
+	ReasonCode byte
+	Properties *property.Properties
+}
+
+func (p *Pubrec) Type() byte {
+	return header.PUBREC
+}
+
+func (p *Pubrec) Encode() ([]byte, error) {
+	return encodeAck(header.PUBREC, p.PacketID, p.ReasonCode, p.Properties)
+}
+
+func (p *Pubrec) Decode(data []byte) error {
+	return decodeAck(header.PUBREC, data, &p.PacketID, &p.ReasonCode, &p.Properties)
+}
+
+type Pubrel struct {
+	PacketID uint16
+
+	// MQTT 5 reason code and properties
+	ReasonCode byte
+	Properties *property.Properties
+}
+
+func (p *Pubrel) Type() byte {
+	return header.PUBREL
+}
+
+// The fixed header flags of a PUBREL are 0010
+func (p *Pubrel) Encode() ([]byte, error) {
+	return encodeAck(header.PUBREL|1<<1, p.PacketID, p.ReasonCode, p.Properties)
+}
+
+func (p *Pubrel) Decode(data []byte) error {
+	return decodeAck(header.PUBREL, data, &p.PacketID, &p.ReasonCode, &p.Properties)
+}
+
+type Pubcomp struct {
+	PacketID uint16
+
+	// MQTT 5 reason code and properties
+	ReasonCode byte
+	Properties *property.Properties
+}
+
+func (p *Pubcomp) Type() byte {
+	return header.PUBCOMP
+}
+
+func (p *Pubcomp) Encode() ([]byte, error) {
+	return encodeAck(header.PUBCOMP, p.PacketID, p.ReasonCode, p.Properties)
+}
+
+func (p *Pubcomp) Decode(data []byte) error {
+	return decodeAck(header.PUBCOMP, data, &p.PacketID, &p.ReasonCode, &p.Properties)
+}
+
+/////////////////////////////////////////////////
+// SUBSCRIBE, SUBACK
+/////////////////////////////////////////////////
+
+type SubscribeFilter struct {
+	Filter string
+
+	// QoS on bits 0-1, the MQTT 5 subscription options above
+	Options byte
+}
+
+type Subscribe struct {
+	PacketID uint16
+
+	// MQTT 5 properties, nil for older protocol levels
+	Properties *property.Properties
+
+	Filters []SubscribeFilter
+}
+
+func (s *Subscribe) Type() byte {
+	return header.SUBSCRIBE
+}
+
+func (s *Subscribe) Encode() ([]byte, error) {
+	if err := validateProperties(s.Properties); err != nil {
+		return nil, err
+	}
+	for _, f := range s.Filters {
+		if err := validateString("topic filter", f.Filter); err != nil {
+			return nil, err
+		}
+	}
+
+	body := util.AppendUint16(nil, s.PacketID)
+	if s.Properties != nil {
+		body = s.Properties.AppendEncode(body)
+	}
+	for _, f := range s.Filters {
+		body = util.AppendString(body, f.Filter)
+		body = append(body, f.Options)
+	}
+
+	return encodePacket(header.SUBSCRIBE|1<<1, body)
+}
+
+func (s *Subscribe) Decode(data []byte) error {
+
+	_, bb, err := decodePacket(header.SUBSCRIBE, data)
+	if err != nil {
+		return err
+	}
+
+	var ok bool
+	if s.PacketID, ok = readUint16(bb); !ok {
+		return ErrMalformedPacket
+	}
+	if err := readProperties(bb, &s.Properties); err != nil {
+		return err
+	}
+
+	// At least one topic filter
+	s.Filters = nil
+	for bb.Len() > 0 || s.Filters == nil {
+		filter, ok := readString(bb)
+		if !ok || bb.Len() < 1 {
+			return ErrMalformedPacket
+		}
+		options, _ := bb.ReadByte()
+		s.Filters = append(s.Filters, SubscribeFilter{Filter: filter, Options: options})
+	}
+
+	return nil
+}
+
+type Suback struct {
+	PacketID uint16
+
+	// MQTT 5 properties, nil for older protocol levels
+	Properties *property.Properties
+
+	// Granted QoS or failure (0x80) of each topic filter, reason codes with MQTT 5
+	ReturnCodes []byte
+}
+
+func (s *Suback) Type() byte {
+	return header.SUBACK
+}
+
+func (s *Suback) Encode() ([]byte, error) {
+	if err := validateProperties(s.Properties); err != nil {
+		return nil, err
+	}
+
+	body := util.AppendUint16(nil, s.PacketID)
+	if s.Properties != nil {
+		body = s.Properties.AppendEncode(body)
+	}
+	body = append(body, s.ReturnCodes...)
+
+	return encodePacket(header.SUBACK, body)
+}
+
+func (s *Suback) Decode(data []byte) error {
+
+	_, bb, err := decodePacket(header.SUBACK, data)
+	if err != nil {
+		return err
+	}
+
+	var ok bool
+	if s.PacketID, ok = readUint16(bb); !ok {
+		return ErrMalformedPacket
+	}
+	if err := readProperties(bb, &s.Properties); err != nil {
+		return err
+	}
+
+	s.ReturnCodes = append([]byte(nil), bb.Bytes()...)
+
+	return nil
+}
+
+/////////////////////////////////////////////////
+// UNSUBSCRIBE, UNSUBACK
+/////////////////////////////////////////////////
+
+type Unsubscribe struct {
+	PacketID uint16
+
+	// MQTT 5 properties, nil for older protocol levels
+	Properties *property.Properties
+
+	Filters []string
+}
+
+func (u *Unsubscribe) Type() byte {
+	return header.UNSUBSCRIBE
+}
+
+func (u *Unsubscribe) Encode() ([]byte, error) {
+	if err := validateProperties(u.Properties); err != nil {
+		return nil, err
+	}
+	for _, f := range u.Filters {
+		if err := validateString("topic filter", f); err != nil {
+			return nil, err
+		}
+	}
+
+	body := util.AppendUint16(nil, u.PacketID)
+	if u.Properties != nil {
+		body = u.Properties.AppendEncode(body)
+	}
+	for _, f := range u.Filters {
+		body = util.AppendString(body, f)
+	}
+
+	return encodePacket(header.UNSUBSCRIBE|1<<1, body)
+}
+
+func (u *Unsubscribe) Decode(data []byte) error {
+
+	_, bb, err := decodePacket(header.UNSUBSCRIBE, data)
+	if err != nil {
+		return err
+	}
+
+	var ok bool
+	if u.PacketID, ok = readUint16(bb); !ok {
+		return ErrMalformedPacket
+	}
+	if err := readProperties(bb, &u.Properties); err != nil {
+		return err
+	}
+
+	// At least one topic filter
+	u.Filters = nil
+	for bb.Len() > 0 || u.Filters == nil {
+		filter, ok := readString(bb)
+		if !ok {
+			return ErrMalformedPacket
+		}
+		u.Filters = append(u.Filters, filter)
+	}
+
+	return nil
+}
+
+type Unsuback struct {
+	PacketID uint16
+
+	// MQTT 5 properties and reason code of each topic filter
+	Properties  *property.Properties
+	ReasonCodes []byte
+}
+
+func (u *Unsuback) Type() byte {
+	return header.UNSUBACK
+}
+
+func (u *Unsuback) Encode() ([]byte, error) {
+	if err := validateProperties(u.Properties); err != nil {
+		return nil, err
+	}
+
+	body := util.AppendUint16(nil, u.PacketID)
+	if u.Properties != nil {
+		body = u.Properties.AppendEncode(body)
+		body = append(body, u.ReasonCodes...)
+	}
+
+	return encodePacket(header.UNSUBACK, body)
+}
+
+func (u *Unsuback) Decode(data []byte) error {
+
+	_, bb, err := decodePacket(header.UNSUBACK, data)
+	if err != nil {
+		return err
+	}
+
+	var ok bool
+	if u.PacketID, ok = readUint16(bb); !ok {
+		return ErrMalformedPacket
+	}
+	if err := readProperties(bb, &u.Properties); err != nil {
+		return err
+	}
+
+	u.ReasonCodes = nil
+	if u.Properties != nil {
+		u.ReasonCodes = append([]byte(nil), bb.Bytes()...)
+	}
+
+	return nil
+}
+
+/////////////////////////////////////////////////
+// PINGREQ, PINGRESP
+/////////////////////////////////////////////////
+
+type Pingreq struct{}
+
+func (p *Pingreq) Type() byte {
+	return header.PINGREQ
+}
+
+func (p *Pingreq) Encode() ([]byte, error) {
+	return encodePacket(header.PINGREQ, nil)
+}
+
+func (p *Pingreq) Decode(data []byte) error {
+	_, _, err := decodePacket(header.PINGREQ, data)
+	return err
+}
+
+type Pingresp struct{}
+
+func (p *Pingresp) Type() byte {
+	return header.PINGRESP
+}
+
+func (p *Pingresp) Encode() ([]byte, error) {
+	return encodePacket(header.PINGRESP, nil)
+}
+
+func (p *Pingresp) Decode(data []byte) error {
+	_, _, err := decodePacket(header.PINGRESP, data)
+	return err
+}
+
+/////////////////////////////////////////////////
+// DISCONNECT, AUTH
+/////////////////////////////////////////////////
+
+// The reason code and the properties are omitted on success without property
+func encodeReason(control byte, reasonCode byte, properties *property.Properties) ([]byte, error) {
+	if err := validateProperties(properties); err != nil {
+		return nil, err
+	}
+
+	var body []byte
+	if properties != nil && (reasonCode != 0 || properties.Len() > 1) {
+		body = append(body, reasonCode)
+		body = properties.AppendEncode(body)
+	}
+	return encodePacket(control, body)
+}
+
+func decodeReason(control byte, data []byte, reasonCode *byte, properties **property.Properties) error {
+
+	_, bb, err := decodePacket(control, data)
+	if err != nil {
+		return err
+	}
+
+	*reasonCode = 0
+	if *properties != nil && bb.Len() > 0 {
+		*reasonCode, _ = bb.ReadByte()
+	}
+
+	return readProperties(bb, properties)
+}
+
+type Disconnect struct {
+	// MQTT 5 reason code and properties
+	ReasonCode byte
+	Properties *property.Properties
+}
+
+func (d *Disconnect) Type() byte {
+	return header.DISCONNECT
+}
+
+func (d *Disconnect) Encode() ([]byte, error) {
+	return encodeReason(header.DISCONNECT, d.ReasonCode, d.Properties)
+}
+
+func (d *Disconnect) Decode(data []byte) error {
+	return decodeReason(header.DISCONNECT, data, &d.ReasonCode, &d.Properties)
+}
+
+// MQTT 5 only
+type Auth struct {
+	ReasonCode byte
+	Properties *property.Properties
+}
+
+func (a *Auth) Type() byte {
+	return header.AUTH
+}
+
+func (a *Auth) Encode() ([]byte, error) {
+	return encodeReason(header.AUTH, a.ReasonCode, a.Properties)
+}
+
+func (a *Auth) Decode(data []byte) error {
+	if a.Properties == nil {
+		a.Properties = property.New()
+	}
+	return decodeReason(header.AUTH, data, &a.ReasonCode, &a.Properties)
+}
@@ -22,7 +22,6 @@
 package payload
 
 import (
-	"bytes"
 	"fmt"
 
 	"github.com/easygithdev/mqtt/packet/util"
@@ -35,6 +34,9 @@ type MqttPayload struct {
 
 	// Qos
 	Qos *byte
+
+	// Application message of a PUBLISH, written as is after the strings
+	Data []byte
 }
 
 type PayloadOption func(mh *MqttPayload)
@@ -56,6 +58,12 @@ func WithQos(qos byte) PayloadOption {
 	}
 }
 
+func WithData(data []byte) PayloadOption {
+	return func(mp *MqttPayload) {
+		mp.Data = data
+	}
+}
+
 func WithString(str string) PayloadOption {
 	return func(mp *MqttPayload) {
 		mp.Payload = append(mp.Payload, str)
@@ -63,21 +71,35 @@ func WithString(str string) PayloadOption {
 }
 
 func (mp *MqttPayload) Encode() []byte {
+	return mp.AppendEncode(make([]byte, 0, mp.Len()))
+}
+
+func (mp *MqttPayload) AppendEncode(dst []byte) []byte {
 
-	buffer := bytes.NewBuffer([]byte{})
+	// The payload holds UTF-8 strings and binary data (password, will message),
+	// not checked here, the packet encoders call packet.Validate first
 	for _, v := range mp.Payload {
-		buffer.Write(util.StringEncode(v))
+		dst = util.AppendString(dst, v)
 	}
 
 	if mp.Qos != nil {
-		buffer.WriteByte(*mp.Qos)
+		dst = append(dst, *mp.Qos)
 	}
 
-	return buffer.Bytes()
+	return append(dst, mp.Data...)
 }
 
 func (mp *MqttPayload) Len() int {
-	return len(mp.Encode())
+	n := 0
+	for _, v := range mp.Payload {
+		n += 2 + len(v)
+	}
+
+	if mp.Qos != nil {
+		n++
+	}
+
+	return n + len(mp.Data)
 }
 
 func (mp *MqttPayload) AddString(str string) {
@@ -99,6 +121,8 @@ func (mp *MqttPayload) String() string {
 		str += fmt.Sprintf("0x%x", *mp.Qos)
 	}
 
+	str += string(mp.Data)
+
 	return str
 }
 
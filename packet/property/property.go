@@ -0,0 +1,479 @@
+// MIT License
+
+// Copyright (c) 2022 Florent Brusciano
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+package property
+
+import (
+	"fmt"
+
+	"github.com/easygithdev/mqtt/packet/header"
+	"github.com/easygithdev/mqtt/packet/util"
+)
+
+// MQTT 5 property identifiers
+const (
+	PAYLOAD_FORMAT_INDICATOR          byte = 0x01
+	MESSAGE_EXPIRY_INTERVAL           byte = 0x02
+	CONTENT_TYPE                      byte = 0x03
+	RESPONSE_TOPIC                    byte = 0x08
+	CORRELATION_DATA                  byte = 0x09
+	SUBSCRIPTION_IDENTIFIER           byte = 0x0B
+	SESSION_EXPIRY_INTERVAL           byte = 0x11
+	ASSIGNED_CLIENT_IDENTIFIER        byte = 0x12
+	SERVER_KEEP_ALIVE                 byte = 0x13
+	AUTHENTICATION_METHOD             byte = 0x15
+	AUTHENTICATION_DATA               byte = 0x16
+	REQUEST_PROBLEM_INFORMATION       byte = 0x17
+	WILL_DELAY_INTERVAL               byte = 0x18
+	REQUEST_RESPONSE_INFORMATION      byte = 0x19
+	RESPONSE_INFORMATION              byte = 0x1A
+	SERVER_REFERENCE                  byte = 0x1C
+	REASON_STRING                     byte = 0x1F
+	RECEIVE_MAXIMUM                   byte = 0x21
+	TOPIC_ALIAS_MAXIMUM               byte = 0x22
+	TOPIC_ALIAS                       byte = 0x23
+	MAXIMUM_QOS                       byte = 0x24
+	RETAIN_AVAILABLE                  byte = 0x25
+	USER_PROPERTY                     byte = 0x26
+	MAXIMUM_PACKET_SIZE               byte = 0x27
+	WILDCARD_SUBSCRIPTION_AVAILABLE   byte = 0x28
+	SUBSCRIPTION_IDENTIFIER_AVAILABLE byte = 0x29
+	SHARED_SUBSCRIPTION_AVAILABLE     byte = 0x2A
+)
+
+type UserProperty struct {
+	Key   string
+	Value string
+}
+
+// Store the MQTT 5 properties of a packet
+// Optional numeric values are pointers, nil means absent
+type Properties struct {
+	PayloadFormatIndicator          *byte
+	MessageExpiryInterval           *uint32
+	ContentType                     string
+	ResponseTopic                   string
+	CorrelationData                 []byte
+	SubscriptionIdentifier          []int
+	SessionExpiryInterval           *uint32
+	AssignedClientIdentifier        string
+	ServerKeepAlive                 *uint16
+	AuthenticationMethod            string
+	AuthenticationData              []byte
+	RequestProblemInformation       *byte
+	WillDelayInterval               *uint32
+	RequestResponseInformation      *byte
+	ResponseInformation             string
+	ServerReference                 string
+	ReasonString                    string
+	ReceiveMaximum                  *uint16
+	TopicAliasMaximum               *uint16
+	TopicAlias                      *uint16
+	MaximumQos                      *byte
+	RetainAvailable                 *byte
+	User                            []UserProperty
+	MaximumPacketSize               *uint32
+	WildcardSubscriptionAvailable   *byte
+	SubscriptionIdentifierAvailable *byte
+	SharedSubscriptionAvailable     *byte
+}
+
+func New() *Properties {
+	return &Properties{}
+}
+
+func Byte(v byte) *byte {
+	return &v
+}
+
+func Uint16(v uint16) *uint16 {
+	return &v
+}
+
+func Uint32(v uint32) *uint32 {
+	return &v
+}
+
+func appendByte(dst []byte, id byte, v *byte) []byte {
+	if v != nil {
+		dst = append(dst, id, *v)
+	}
+	return dst
+}
+
+func appendUint16(dst []byte, id byte, v *uint16) []byte {
+	if v != nil {
+		dst = util.AppendUint16(append(dst, id), *v)
+	}
+	return dst
+}
+
+func appendUint32(dst []byte, id byte, v *uint32) []byte {
+	if v != nil {
+		dst = util.AppendUint32(append(dst, id), *v)
+	}
+	return dst
+}
+
+// The strings are checked by Validate, called by the packet encoders
+func appendString(dst []byte, id byte, v string) []byte {
+	if v != "" {
+		dst = util.AppendString(append(dst, id), v)
+	}
+	return dst
+}
+
+func appendBinary(dst []byte, id byte, v []byte) []byte {
+	if v != nil {
+		dst = util.AppendBinary(append(dst, id), v)
+	}
+	return dst
+}
+
+// Check the UTF-8 strings and the length of the binary data
+func (p *Properties) Validate() error {
+	if p == nil {
+		return nil
+	}
+
+	for _, str := range []string{p.ContentType, p.ResponseTopic, p.AssignedClientIdentifier, p.AuthenticationMethod,
+		p.ResponseInformation, p.ServerReference, p.ReasonString} {
+		if err := util.ValidateString(str); err != nil {
+			return err
+		}
+	}
+
+	for _, data := range [][]byte{p.CorrelationData, p.AuthenticationData} {
+		if err := util.ValidateBinary(data); err != nil {
+			return err
+		}
+	}
+
+	for _, up := range p.User {
+		if err := util.ValidateString(up.Key); err != nil {
+			return err
+		}
+		if err := util.ValidateString(up.Value); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Append the properties without the property length
+func (p *Properties) appendContent(dst []byte) []byte {
+
+	dst = appendByte(dst, PAYLOAD_FORMAT_INDICATOR, p.PayloadFormatIndicator)
+	dst = appendUint32(dst, MESSAGE_EXPIRY_INTERVAL, p.MessageExpiryInterval)
+	dst = appendString(dst, CONTENT_TYPE, p.ContentType)
+	dst = appendString(dst, RESPONSE_TOPIC, p.ResponseTopic)
+	dst = appendBinary(dst, CORRELATION_DATA, p.CorrelationData)
+	for _, id := range p.SubscriptionIdentifier {
+		dst = header.RemainingLengthAppend(append(dst, SUBSCRIPTION_IDENTIFIER), id)
+	}
+	dst = appendUint32(dst, SESSION_EXPIRY_INTERVAL, p.SessionExpiryInterval)
+	dst = appendString(dst, ASSIGNED_CLIENT_IDENTIFIER, p.AssignedClientIdentifier)
+	dst = appendUint16(dst, SERVER_KEEP_ALIVE, p.ServerKeepAlive)
+	dst = appendString(dst, AUTHENTICATION_METHOD, p.AuthenticationMethod)
+	dst = appendBinary(dst, AUTHENTICATION_DATA, p.AuthenticationData)
+	dst = appendByte(dst, REQUEST_PROBLEM_INFORMATION, p.RequestProblemInformation)
+	dst = appendUint32(dst, WILL_DELAY_INTERVAL, p.WillDelayInterval)
+	dst = appendByte(dst, REQUEST_RESPONSE_INFORMATION, p.RequestResponseInformation)
+	dst = appendString(dst, RESPONSE_INFORMATION, p.ResponseInformation)
+	dst = appendString(dst, SERVER_REFERENCE, p.ServerReference)
+	dst = appendString(dst, REASON_STRING, p.ReasonString)
+	dst = appendUint16(dst, RECEIVE_MAXIMUM, p.ReceiveMaximum)
+	dst = appendUint16(dst, TOPIC_ALIAS_MAXIMUM, p.TopicAliasMaximum)
+	dst = appendUint16(dst, TOPIC_ALIAS, p.TopicAlias)
+	dst = appendByte(dst, MAXIMUM_QOS, p.MaximumQos)
+	dst = appendByte(dst, RETAIN_AVAILABLE, p.RetainAvailable)
+	for _, up := range p.User {
+		dst = append(dst, USER_PROPERTY)
+		dst = util.AppendString(dst, up.Key)
+		dst = util.AppendString(dst, up.Value)
+	}
+	dst = appendUint32(dst, MAXIMUM_PACKET_SIZE, p.MaximumPacketSize)
+	dst = appendByte(dst, WILDCARD_SUBSCRIPTION_AVAILABLE, p.WildcardSubscriptionAvailable)
+	dst = appendByte(dst, SUBSCRIPTION_IDENTIFIER_AVAILABLE, p.SubscriptionIdentifierAvailable)
+	dst = appendByte(dst, SHARED_SUBSCRIPTION_AVAILABLE, p.SharedSubscriptionAvailable)
+
+	return dst
+}
+
+// Size of the properties without the property length, computed without encoding them
+func (p *Properties) contentLen() int {
+	n := 0
+
+	for _, v := range []*byte{p.PayloadFormatIndicator, p.RequestProblemInformation, p.RequestResponseInformation,
+		p.MaximumQos, p.RetainAvailable, p.WildcardSubscriptionAvailable, p.SubscriptionIdentifierAvailable,
+		p.SharedSubscriptionAvailable} {
+		if v != nil {
+			n += 2
+		}
+	}
+	for _, v := range []*uint16{p.ServerKeepAlive, p.ReceiveMaximum, p.TopicAliasMaximum, p.TopicAlias} {
+		if v != nil {
+			n += 3
+		}
+	}
+	for _, v := range []*uint32{p.MessageExpiryInterval, p.SessionExpiryInterval, p.WillDelayInterval, p.MaximumPacketSize} {
+		if v != nil {
+			n += 5
+		}
+	}
+	for _, v := range []string{p.ContentType, p.ResponseTopic, p.AssignedClientIdentifier, p.AuthenticationMethod,
+		p.ResponseInformation, p.ServerReference, p.ReasonString} {
+		if v != "" {
+			n += 3 + len(v)
+		}
+	}
+	for _, v := range [][]byte{p.CorrelationData, p.AuthenticationData} {
+		if v != nil {
+			n += 3 + len(v)
+		}
+	}
+	for _, id := range p.SubscriptionIdentifier {
+		n += 1 + header.RemainingLengthLen(id)
+	}
+	for _, up := range p.User {
+		n += 5 + len(up.Key) + len(up.Value)
+	}
+
+	return n
+}
+
+// Encode the properties prefixed by their length
+// A nil Properties is encoded as an empty property list
+func (p *Properties) Encode() []byte {
+	return p.AppendEncode(make([]byte, 0, p.Len()))
+}
+
+// Append the properties prefixed by their length to dst
+func (p *Properties) AppendEncode(dst []byte) []byte {
+	if p == nil {
+		return append(dst, 0)
+	}
+
+	dst = header.RemainingLengthAppend(dst, p.contentLen())
+
+	return p.appendContent(dst)
+}
+
+func (p *Properties) Len() int {
+	if p == nil {
+		return 1
+	}
+
+	n := p.contentLen()
+
+	return header.RemainingLengthLen(n) + n
+}
+
+func (p *Properties) String() string {
+	if p == nil {
+		return "properties: none"
+	}
+	return fmt.Sprintf("properties: %+v", *p)
+}
+
+func (p *Properties) Hexa() string {
+	return util.ShowHexa(p.Encode())
+}
+
+// Decode the properties found at the beginning of the buffer
+// Return the properties and the number of bytes read, including the property length
+func Decode(b []byte) (*Properties, int, error) {
+
+	if len(b) == 0 {
+		return nil, 0, fmt.Errorf("malformed properties, missing property length")
+	}
+
+	nb, length, err := header.RemainingLengthDecode(b)
+	if err != nil {
+		return nil, 0, fmt.Errorf("malformed properties, %w", err)
+	}
+	if length < 0 || length > len(b)-nb {
+		return nil, 0, fmt.Errorf("malformed properties, length %d exceeds buffer", length)
+	}
+
+	p := New()
+	content := b[nb : nb+length]
+
+	for i := 0; i < len(content); {
+		id := content[i]
+		i++
+		rest := content[i:]
+
+		need := func(n int) error {
+			if len(rest) < n {
+				return fmt.Errorf("malformed property 0x%X, need %d byte(s)", id, n)
+			}
+			return nil
+		}
+		readString := func() (string, error) {
+			if err := need(2); err != nil {
+				return "", err
+			}
+			size := int(util.Bytes2uint16(rest))
+			if err := need(2 + size); err != nil {
+				return "", err
+			}
+			i += 2 + size
+			str := string(rest[2 : 2+size])
+			rest = content[i:]
+			return str, nil
+		}
+
+		var err error
+		switch id {
+		case PAYLOAD_FORMAT_INDICATOR, REQUEST_PROBLEM_INFORMATION, REQUEST_RESPONSE_INFORMATION,
+			MAXIMUM_QOS, RETAIN_AVAILABLE, WILDCARD_SUBSCRIPTION_AVAILABLE,
+			SUBSCRIPTION_IDENTIFIER_AVAILABLE, SHARED_SUBSCRIPTION_AVAILABLE:
+			if err = need(1); err != nil {
+				return nil, 0, err
+			}
+			v := Byte(rest[0])
+			i++
+			switch id {
+			case PAYLOAD_FORMAT_INDICATOR:
+				p.PayloadFormatIndicator = v
+			case REQUEST_PROBLEM_INFORMATION:
+				p.RequestProblemInformation = v
+			case REQUEST_RESPONSE_INFORMATION:
+				p.RequestResponseInformation = v
+			case MAXIMUM_QOS:
+				p.MaximumQos = v
+			case RETAIN_AVAILABLE:
+				p.RetainAvailable = v
+			case WILDCARD_SUBSCRIPTION_AVAILABLE:
+				p.WildcardSubscriptionAvailable = v
+			case SUBSCRIPTION_IDENTIFIER_AVAILABLE:
+				p.SubscriptionIdentifierAvailable = v
+			case SHARED_SUBSCRIPTION_AVAILABLE:
+				p.SharedSubscriptionAvailable = v
+			}
+
+		case SERVER_KEEP_ALIVE, RECEIVE_MAXIMUM, TOPIC_ALIAS_MAXIMUM, TOPIC_ALIAS:
+			if err = need(2); err != nil {
+				return nil, 0, err
+			}
+			v := Uint16(util.Bytes2uint16(rest))
+			i += 2
+			switch id {
+			case SERVER_KEEP_ALIVE:
+				p.ServerKeepAlive = v
+			case RECEIVE_MAXIMUM:
+				p.ReceiveMaximum = v
+			case TOPIC_ALIAS_MAXIMUM:
+				p.TopicAliasMaximum = v
+			case TOPIC_ALIAS:
+				p.TopicAlias = v
+			}
+
+		case MESSAGE_EXPIRY_INTERVAL, SESSION_EXPIRY_INTERVAL, WILL_DELAY_INTERVAL, MAXIMUM_PACKET_SIZE:
+			if err = need(4); err != nil {
+				return nil, 0, err
+			}
+			v := Uint32(util.Bytes2uint32(rest))
+			i += 4
+			switch id {
+			case MESSAGE_EXPIRY_INTERVAL:
+				p.MessageExpiryInterval = v
+			case SESSION_EXPIRY_INTERVAL:
+				p.SessionExpiryInterval = v
+			case WILL_DELAY_INTERVAL:
+				p.WillDelayInterval = v
+			case MAXIMUM_PACKET_SIZE:
+				p.MaximumPacketSize = v
+			}
+
+		case CONTENT_TYPE, RESPONSE_TOPIC, ASSIGNED_CLIENT_IDENTIFIER, AUTHENTICATION_METHOD,
+			RESPONSE_INFORMATION, SERVER_REFERENCE, REASON_STRING:
+			var v string
+			if v, err = readString(); err != nil {
+				return nil, 0, err
+			}
+			if err = util.ValidateString(v); err != nil {
+				return nil, 0, fmt.Errorf("malformed property 0x%X, %w", id, err)
+			}
+			switch id {
+			case CONTENT_TYPE:
+				p.ContentType = v
+			case RESPONSE_TOPIC:
+				p.ResponseTopic = v
+			case ASSIGNED_CLIENT_IDENTIFIER:
+				p.AssignedClientIdentifier = v
+			case AUTHENTICATION_METHOD:
+				p.AuthenticationMethod = v
+			case RESPONSE_INFORMATION:
+				p.ResponseInformation = v
+			case SERVER_REFERENCE:
+				p.ServerReference = v
+			case REASON_STRING:
+				p.ReasonString = v
+			}
+
+		case CORRELATION_DATA, AUTHENTICATION_DATA:
+			var v string
+			if v, err = readString(); err != nil {
+				return nil, 0, err
+			}
+			if id == CORRELATION_DATA {
+				p.CorrelationData = []byte(v)
+			} else {
+				p.AuthenticationData = []byte(v)
+			}
+
+		case SUBSCRIPTION_IDENTIFIER:
+			if err = need(1); err != nil {
+				return nil, 0, err
+			}
+			n, v, err := header.RemainingLengthDecode(rest)
+			if err != nil {
+				return nil, 0, fmt.Errorf("malformed subscription identifier, %w", err)
+			}
+			i += n
+			p.SubscriptionIdentifier = append(p.SubscriptionIdentifier, v)
+
+		case USER_PROPERTY:
+			var k, v string
+			if k, err = readString(); err != nil {
+				return nil, 0, err
+			}
+			if v, err = readString(); err != nil {
+				return nil, 0, err
+			}
+			if err = util.ValidateString(k); err == nil {
+				err = util.ValidateString(v)
+			}
+			if err != nil {
+				return nil, 0, fmt.Errorf("malformed user property, %w", err)
+			}
+			p.User = append(p.User, UserProperty{Key: k, Value: v})
+
+		default:
+			return nil, 0, fmt.Errorf("malformed properties, unknown identifier 0x%X", id)
+		}
+	}
+
+	return p, nb + length, nil
+}
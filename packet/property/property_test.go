@@ -0,0 +1,87 @@
+// MIT License
+
+// Copyright (c) 2022 Florent Brusciano
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+package property
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestEncodeDecode(t *testing.T) {
+
+	p := New()
+	p.SessionExpiryInterval = Uint32(3600)
+	p.ReceiveMaximum = Uint16(20)
+	p.MaximumQos = Byte(1)
+	p.AuthenticationMethod = "SCRAM-SHA-256"
+	p.AuthenticationData = []byte{0, 1, 2}
+	p.SubscriptionIdentifier = []int{1, 268435455}
+	p.User = []UserProperty{{Key: "a", Value: "b"}, {Key: "a", Value: "c"}}
+
+	encoded := p.Encode()
+	if p.Len() != len(encoded) {
+		t.Errorf("Len found %d; want %d", p.Len(), len(encoded))
+	}
+
+	decoded, n, err := Decode(append(encoded, 0xFF))
+	if err != nil {
+		t.Fatalf("Decode error %s", err)
+	}
+
+	if n != len(encoded) {
+		t.Errorf("Decode read %d byte(s); want %d", n, len(encoded))
+	}
+
+	if !reflect.DeepEqual(p, decoded) {
+		t.Errorf("Decode found %s; want %s", decoded, p)
+	}
+}
+
+func TestEncodeNil(t *testing.T) {
+
+	var p *Properties
+
+	if !reflect.DeepEqual(p.Encode(), []byte{0}) {
+		t.Errorf("Encode found %v; want [0]", p.Encode())
+	}
+}
+
+func TestDecodeMalformed(t *testing.T) {
+
+	for _, data := range [][]byte{
+		{},
+		{5, SESSION_EXPIRY_INTERVAL, 0},
+		{3, SESSION_EXPIRY_INTERVAL, 0, 0},
+		{2, 0x7F, 0},
+		{3, CONTENT_TYPE, 0, 5},
+		{0x80},
+		{0xFF, 0xFF, 0xFF, 0xFF, 0x7F},
+		{0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0x7F, 0, 0, 0},
+		{0xFF, 0xFF, 0xFF, 0x7F, 0},
+		{2, SUBSCRIPTION_IDENTIFIER, 0x80},
+		{6, SUBSCRIPTION_IDENTIFIER, 0xFF, 0xFF, 0xFF, 0xFF, 0x7F},
+	} {
+		if _, _, err := Decode(data); err == nil {
+			t.Errorf("Decode %v should fail", data)
+		}
+	}
+}
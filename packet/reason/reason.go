@@ -0,0 +1,129 @@
+// MIT License
+
+// Copyright (c) 2022 Florent Brusciano
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+package reason
+
+// MQTT 5 reason codes, see section 2.4 of the specification
+const (
+	SUCCESS                                byte = 0x00
+	NORMAL_DISCONNECTION                   byte = 0x00
+	GRANTED_QOS_0                          byte = 0x00
+	GRANTED_QOS_1                          byte = 0x01
+	GRANTED_QOS_2                          byte = 0x02
+	DISCONNECT_WITH_WILL_MESSAGE           byte = 0x04
+	NO_MATCHING_SUBSCRIBERS                byte = 0x10
+	NO_SUBSCRIPTION_EXISTED                byte = 0x11
+	CONTINUE_AUTHENTICATION                byte = 0x18
+	RE_AUTHENTICATE                        byte = 0x19
+	UNSPECIFIED_ERROR                      byte = 0x80
+	MALFORMED_PACKET                       byte = 0x81
+	PROTOCOL_ERROR                         byte = 0x82
+	IMPLEMENTATION_SPECIFIC_ERROR          byte = 0x83
+	UNSUPPORTED_PROTOCOL_VERSION           byte = 0x84
+	CLIENT_IDENTIFIER_NOT_VALID            byte = 0x85
+	BAD_USER_NAME_OR_PASSWORD              byte = 0x86
+	NOT_AUTHORIZED                         byte = 0x87
+	SERVER_UNAVAILABLE                     byte = 0x88
+	SERVER_BUSY                            byte = 0x89
+	BANNED                                 byte = 0x8A
+	SERVER_SHUTTING_DOWN                   byte = 0x8B
+	BAD_AUTHENTICATION_METHOD              byte = 0x8C
+	KEEP_ALIVE_TIMEOUT                     byte = 0x8D
+	SESSION_TAKEN_OVER                     byte = 0x8E
+	TOPIC_FILTER_INVALID                   byte = 0x8F
+	TOPIC_NAME_INVALID                     byte = 0x90
+	PACKET_IDENTIFIER_IN_USE               byte = 0x91
+	PACKET_IDENTIFIER_NOT_FOUND            byte = 0x92
+	RECEIVE_MAXIMUM_EXCEEDED               byte = 0x93
+	TOPIC_ALIAS_INVALID                    byte = 0x94
+	PACKET_TOO_LARGE                       byte = 0x95
+	MESSAGE_RATE_TOO_HIGH                  byte = 0x96
+	QUOTA_EXCEEDED                         byte = 0x97
+	ADMINISTRATIVE_ACTION                  byte = 0x98
+	PAYLOAD_FORMAT_INVALID                 byte = 0x99
+	RETAIN_NOT_SUPPORTED                   byte = 0x9A
+	QOS_NOT_SUPPORTED                      byte = 0x9B
+	USE_ANOTHER_SERVER                     byte = 0x9C
+	SERVER_MOVED                           byte = 0x9D
+	SHARED_SUBSCRIPTIONS_NOT_SUPPORTED     byte = 0x9E
+	CONNECTION_RATE_EXCEEDED               byte = 0x9F
+	MAXIMUM_CONNECT_TIME                   byte = 0xA0
+	SUBSCRIPTION_IDENTIFIERS_NOT_SUPPORTED byte = 0xA1
+	WILDCARD_SUBSCRIPTIONS_NOT_SUPPORTED   byte = 0xA2
+)
+
+var names = map[byte]string{
+	SUCCESS:                                "success",
+	GRANTED_QOS_1:                          "granted QoS 1",
+	GRANTED_QOS_2:                          "granted QoS 2",
+	DISCONNECT_WITH_WILL_MESSAGE:           "disconnect with will message",
+	NO_MATCHING_SUBSCRIBERS:                "no matching subscribers",
+	NO_SUBSCRIPTION_EXISTED:                "no subscription existed",
+	CONTINUE_AUTHENTICATION:                "continue authentication",
+	RE_AUTHENTICATE:                        "re-authenticate",
+	UNSPECIFIED_ERROR:                      "unspecified error",
+	MALFORMED_PACKET:                       "malformed packet",
+	PROTOCOL_ERROR:                         "protocol error",
+	IMPLEMENTATION_SPECIFIC_ERROR:          "implementation specific error",
+	UNSUPPORTED_PROTOCOL_VERSION:           "unsupported protocol version",
+	CLIENT_IDENTIFIER_NOT_VALID:            "client identifier not valid",
+	BAD_USER_NAME_OR_PASSWORD:              "bad user name or password",
+	NOT_AUTHORIZED:                         "not authorized",
+	SERVER_UNAVAILABLE:                     "server unavailable",
+	SERVER_BUSY:                            "server busy",
+	BANNED:                                 "banned",
+	SERVER_SHUTTING_DOWN:                   "server shutting down",
+	BAD_AUTHENTICATION_METHOD:              "bad authentication method",
+	KEEP_ALIVE_TIMEOUT:                     "keep alive timeout",
+	SESSION_TAKEN_OVER:                     "session taken over",
+	TOPIC_FILTER_INVALID:                   "topic filter invalid",
+	TOPIC_NAME_INVALID:                     "topic name invalid",
+	PACKET_IDENTIFIER_IN_USE:               "packet identifier in use",
+	PACKET_IDENTIFIER_NOT_FOUND:            "packet identifier not found",
+	RECEIVE_MAXIMUM_EXCEEDED:               "receive maximum exceeded",
+	TOPIC_ALIAS_INVALID:                    "topic alias invalid",
+	PACKET_TOO_LARGE:                       "packet too large",
+	MESSAGE_RATE_TOO_HIGH:                  "message rate too high",
+	QUOTA_EXCEEDED:                         "quota exceeded",
+	ADMINISTRATIVE_ACTION:                  "administrative action",
+	PAYLOAD_FORMAT_INVALID:                 "payload format invalid",
+	RETAIN_NOT_SUPPORTED:                   "retain not supported",
+	QOS_NOT_SUPPORTED:                      "QoS not supported",
+	USE_ANOTHER_SERVER:                     "use another server",
+	SERVER_MOVED:                           "server moved",
+	SHARED_SUBSCRIPTIONS_NOT_SUPPORTED:     "shared subscriptions not supported",
+	CONNECTION_RATE_EXCEEDED:               "connection rate exceeded",
+	MAXIMUM_CONNECT_TIME:                   "maximum connect time",
+	SUBSCRIPTION_IDENTIFIERS_NOT_SUPPORTED: "subscription identifiers not supported",
+	WILDCARD_SUBSCRIPTIONS_NOT_SUPPORTED:   "wildcard subscriptions not supported",
+}
+
+// A reason code of 0x80 or greater indicates failure
+func IsError(code byte) bool {
+	return code >= UNSPECIFIED_ERROR
+}
+
+func String(code byte) string {
+	if name, ok := names[code]; ok {
+		return name
+	}
+	return "unknown reason code"
+}
@@ -22,9 +22,11 @@
 package util
 
 import (
-	"bytes"
 	"encoding/binary"
+	"errors"
 	"fmt"
+	"strings"
+	"unicode/utf8"
 )
 
 func Uint162bytes(val uint16) []byte {
@@ -37,27 +39,118 @@ func Bytes2uint16(val []byte) uint16 {
 	return binary.BigEndian.Uint16(val)
 }
 
-func StringEncode(str string) []byte {
+func Uint322bytes(val uint32) []byte {
+	buf := make([]byte, 4)
+	binary.BigEndian.PutUint32(buf, val)
+	return buf
+}
+
+func Bytes2uint32(val []byte) uint32 {
+	return binary.BigEndian.Uint32(val)
+}
+
+// Append the big-endian value to dst
+func AppendUint16(dst []byte, val uint16) []byte {
+	return append(dst, byte(val>>8), byte(val))
+}
+
+// Append the big-endian value to dst
+func AppendUint32(dst []byte, val uint32) []byte {
+	return append(dst, byte(val>>24), byte(val>>16), byte(val>>8), byte(val))
+}
+
+// Longest string or binary data, the length is encoded on 2 bytes
+const MAX_STRING_LEN = 65535
+
+var ErrStringTooLong = errors.New("string longer than 65535 bytes")
+var ErrInvalidUTF8 = errors.New("string is not well-formed UTF-8")
+var ErrNullCharacter = errors.New("string contains the null character U+0000")
+var ErrMalformedString = errors.New("malformed string, length exceeds buffer")
+
+// Check a MQTT UTF-8 encoded string : at most 65535 bytes of well-formed UTF-8,
+// without U+0000 nor the surrogates U+D800 to U+DFFF (rejected by the UTF-8 decoder)
+func ValidateString(str string) error {
+	if len(str) > MAX_STRING_LEN {
+		return ErrStringTooLong
+	}
+	if !utf8.ValidString(str) {
+		return ErrInvalidUTF8
+	}
+	if strings.IndexByte(str, 0) >= 0 {
+		return ErrNullCharacter
+	}
+	return nil
+}
+
+// Check binary data, its length is encoded on 2 bytes
+func ValidateBinary(data []byte) error {
+	if len(data) > MAX_STRING_LEN {
+		return ErrStringTooLong
+	}
+	return nil
+}
+
+// Encode a MQTT UTF-8 string, prefixed by its length
+func StringEncode(str string) ([]byte, error) {
+	if err := ValidateString(str); err != nil {
+		return nil, err
+	}
+	return BinaryEncode([]byte(str))
+}
+
+// Decode a MQTT UTF-8 string, return the number of bytes read
+func StringDecode(b []byte) (int, string, error) {
+	n, data, err := BinaryDecode(b)
+	if err != nil {
+		return 0, "", err
+	}
 
-	size := Uint162bytes(uint16(len(str)))
-	var buffer bytes.Buffer
-	buffer.Write(size)
-	buffer.WriteString(str)
+	str := string(data)
+	if err := ValidateString(str); err != nil {
+		return 0, "", err
+	}
 
-	return buffer.Bytes()
+	return n, str, nil
 }
 
-func StringDecode(b []byte) (int, string) {
+// Encode binary data (password, will message, correlation data), prefixed by its length
+func BinaryEncode(data []byte) ([]byte, error) {
+	if err := ValidateBinary(data); err != nil {
+		return nil, err
+	}
+
+	buffer := make([]byte, 2, 2+len(data))
+	binary.BigEndian.PutUint16(buffer, uint16(len(data)))
+
+	return append(buffer, data...), nil
+}
 
-	buffer := bytes.NewBuffer(b)
+// Append the string prefixed by its length to dst, without checking it:
+// a string longer than 65535 bytes is truncated, call ValidateString first
+func AppendString(dst []byte, str string) []byte {
+	dst = AppendUint16(dst, uint16(len(str)))
+	return append(dst, str...)
+}
 
-	buffSize := buffer.Next(2)
+// Append the binary data prefixed by its length to dst, without checking it,
+// call ValidateBinary first
+func AppendBinary(dst []byte, data []byte) []byte {
+	dst = AppendUint16(dst, uint16(len(data)))
+	return append(dst, data...)
+}
 
-	size := Bytes2uint16(buffSize)
+// Decode binary data, return the number of bytes read
+func BinaryDecode(b []byte) (int, []byte, error) {
+	if len(b) < 2 {
+		return 0, nil, ErrMalformedString
+	}
 
-	buffStr := buffer.Next(int(size))
+	size := int(Bytes2uint16(b))
+	if len(b) < 2+size {
+		return 0, nil, ErrMalformedString
+	}
 
-	return 2 + len(buffStr), string(buffStr)
+	return 2 + size, b[2 : 2+size], nil
 }
 
 func ShowHexa(buffer []byte) string {
@@ -24,6 +24,7 @@ package util
 import (
 	"fmt"
 	"reflect"
+	"strings"
 	"testing"
 )
 
@@ -52,7 +53,10 @@ func TestStringEncode(t *testing.T) {
 
 	expected := []byte{0, 12, 'h', 'e', 'l', 'l', 'o', 'w', 'o', 'r', 'l', 'd', '$'}
 
-	encoded := StringEncode(str)
+	encoded, err := StringEncode(str)
+	if err != nil {
+		t.Errorf("String encode error %s", err)
+	}
 
 	if !reflect.DeepEqual(encoded, encoded) {
 		t.Errorf("String encode error found [%b]; want [%b]", encoded, expected)
@@ -63,11 +67,15 @@ func TestStringDecode(t *testing.T) {
 
 	str := "hello world$"
 
-	encoded := StringEncode(str)
-	nb, decoded := StringDecode(encoded)
+	encoded, _ := StringEncode(str)
+	nb, decoded, err := StringDecode(encoded)
+	if err != nil {
+		t.Errorf("String decode error %s", err)
+	}
 
-	if nb != 12 {
-		t.Errorf("String decode error found [%d]; want 12", nb)
+	// The length prefix is counted in the bytes read
+	if nb != 14 {
+		t.Errorf("String decode error found [%d]; want 14", nb)
 	}
 
 	if decoded != str {
@@ -75,3 +83,36 @@ func TestStringDecode(t *testing.T) {
 	}
 
 }
+
+func TestStringValidation(t *testing.T) {
+
+	for str, want := range map[string]error{
+		"hello/world":                        nil,
+		"h\u00e9llo \u4e16\u754c \U0001F600": nil,
+		"":                                   nil,
+		"hello\x00world":                     ErrNullCharacter,
+		"hello\xffworld":                     ErrInvalidUTF8,
+		// U+D800, a surrogate encoded in UTF-8
+		"\xed\xa0\x80":             ErrInvalidUTF8,
+		strings.Repeat("a", 65536): ErrStringTooLong,
+	} {
+		if _, err := StringEncode(str); err != want {
+			t.Errorf("StringEncode(%.20q) found %v; want %v", str, err, want)
+		}
+		encoded, _ := BinaryEncode([]byte(str))
+		if len(str) <= MAX_STRING_LEN {
+			if _, _, err := StringDecode(encoded); err != want {
+				t.Errorf("StringDecode(%.20q) found %v; want %v", str, err, want)
+			}
+		}
+	}
+
+	// Binary data may contain anything
+	if _, err := BinaryEncode([]byte{0, 0xff}); err != nil {
+		t.Errorf("BinaryEncode error %s", err)
+	}
+
+	if _, _, err := StringDecode([]byte{0, 5, 'a'}); err != ErrMalformedString {
+		t.Errorf("StringDecode of a truncated string found %v; want %v", err, ErrMalformedString)
+	}
+}
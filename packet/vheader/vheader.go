@@ -24,6 +24,7 @@ package vheader
 import (
 	"fmt"
 
+	"github.com/easygithdev/mqtt/packet/property"
 	"github.com/easygithdev/mqtt/packet/util"
 )
 
@@ -37,6 +38,9 @@ var CONNECT_FLAG_USERNAME byte = 0x80
 
 type VariableHeader interface {
 	Encode() []byte
+	// Append the encoded header to dst
+	AppendEncode(dst []byte) []byte
+	// Size of the encoded header, computed without encoding it
 	Len() int
 	String() string
 	Hexa() string
@@ -58,6 +62,10 @@ func (gh *GenericHeader) Encode() []byte {
 	return gh.Data
 }
 
+func (gh *GenericHeader) AppendEncode(dst []byte) []byte {
+	return append(dst, gh.Data...)
+}
+
 func (gh *GenericHeader) Len() int {
 	return len(gh.Data)
 }
@@ -90,6 +98,9 @@ type ConnectHeader struct {
 
 	// Keep alive (2 bytes)
 	KeepAlive uint16
+
+	// MQTT 5 properties, nil for older protocol levels
+	Properties *property.Properties
 }
 
 func NewConnectHeader(protocolName string, protocolVersion byte, flag byte, keepAlive uint16) *ConnectHeader {
@@ -97,18 +108,31 @@ func NewConnectHeader(protocolName string, protocolVersion byte, flag byte, keep
 }
 
 func (ch *ConnectHeader) Encode() []byte {
-	var content []byte
+	return ch.AppendEncode(make([]byte, 0, ch.Len()))
+}
 
-	content = append(content, util.StringEncode(ch.ProtocolName)...)
-	content = append(content, []byte{ch.ProtocolVersion}...)
-	content = append(content, []byte{ch.Flag}...)
-	content = append(content, util.Uint162bytes(ch.KeepAlive)...)
+func (ch *ConnectHeader) AppendEncode(dst []byte) []byte {
 
-	return content
+	// Not checked here, the packet encoders call packet.Validate first
+	dst = util.AppendString(dst, ch.ProtocolName)
+	dst = append(dst, ch.ProtocolVersion, ch.Flag)
+	dst = util.AppendUint16(dst, ch.KeepAlive)
+
+	if ch.Properties != nil {
+		dst = ch.Properties.AppendEncode(dst)
+	}
+
+	return dst
 }
 
 func (ch *ConnectHeader) Len() int {
-	return len(ch.Encode())
+	n := 2 + len(ch.ProtocolName) + 4
+
+	if ch.Properties != nil {
+		n += ch.Properties.Len()
+	}
+
+	return n
 }
 
 func (ch *ConnectHeader) String() string {
@@ -125,6 +149,9 @@ func (ch *ConnectHeader) Hexa() string {
 
 type PacketIdHeader struct {
 	PacketId uint16
+
+	// MQTT 5 properties, nil for older protocol levels
+	Properties *property.Properties
 }
 
 func NewPacketIdHeader(packetId uint16) *PacketIdHeader {
@@ -132,11 +159,27 @@ func NewPacketIdHeader(packetId uint16) *PacketIdHeader {
 }
 
 func (sh *PacketIdHeader) Encode() []byte {
-	return util.Uint162bytes(sh.PacketId)
+	return sh.AppendEncode(make([]byte, 0, sh.Len()))
+}
+
+func (sh *PacketIdHeader) AppendEncode(dst []byte) []byte {
+	dst = util.AppendUint16(dst, sh.PacketId)
+
+	if sh.Properties != nil {
+		dst = sh.Properties.AppendEncode(dst)
+	}
+
+	return dst
 }
 
 func (sh *PacketIdHeader) Len() int {
-	return len(sh.Encode())
+	n := 2
+
+	if sh.Properties != nil {
+		n += sh.Properties.Len()
+	}
+
+	return n
 }
 
 func (sh *PacketIdHeader) String() string {
@@ -153,6 +196,12 @@ func (sh *PacketIdHeader) Hexa() string {
 
 type PublishHeader struct {
 	TopicName string
+
+	// Only present when QoS > 0
+	PacketId uint16
+
+	// MQTT 5 properties, nil for older protocol levels
+	Properties *property.Properties
 }
 
 func NewPublishHeader(topicName string) *PublishHeader {
@@ -160,16 +209,37 @@ func NewPublishHeader(topicName string) *PublishHeader {
 }
 
 func (ph *PublishHeader) Encode() []byte {
+	return ph.AppendEncode(make([]byte, 0, ph.Len()))
+}
 
-	var content []byte
+func (ph *PublishHeader) AppendEncode(dst []byte) []byte {
 
-	content = append(content, util.StringEncode(ph.TopicName)...)
+	// Not checked here, the packet encoders call packet.Validate first
+	dst = util.AppendString(dst, ph.TopicName)
 
-	return content
+	if ph.PacketId != 0 {
+		dst = util.AppendUint16(dst, ph.PacketId)
+	}
+
+	if ph.Properties != nil {
+		dst = ph.Properties.AppendEncode(dst)
+	}
+
+	return dst
 }
 
 func (ph *PublishHeader) Len() int {
-	return len(ph.Encode())
+	n := 2 + len(ph.TopicName)
+
+	if ph.PacketId != 0 {
+		n += 2
+	}
+
+	if ph.Properties != nil {
+		n += ph.Properties.Len()
+	}
+
+	return n
 }
 
 func (ph *PublishHeader) String() string {
@@ -179,3 +249,73 @@ func (ph *PublishHeader) String() string {
 func (ph *PublishHeader) Hexa() string {
 	return util.ShowHexa(ph.Encode())
 }
+
+/////////////////////////////////////////////////
+// Auth header (MQTT 5)
+/////////////////////////////////////////////////
+
+type AuthHeader struct {
+	ReasonCode byte
+
+	Properties *property.Properties
+}
+
+func NewAuthHeader(reasonCode byte, properties *property.Properties) *AuthHeader {
+	return &AuthHeader{ReasonCode: reasonCode, Properties: properties}
+}
+
+func (ah *AuthHeader) Encode() []byte {
+	return ah.AppendEncode(make([]byte, 0, ah.Len()))
+}
+
+func (ah *AuthHeader) AppendEncode(dst []byte) []byte {
+	dst = append(dst, ah.ReasonCode)
+	return ah.Properties.AppendEncode(dst)
+}
+
+func (ah *AuthHeader) Len() int {
+	return 1 + ah.Properties.Len()
+}
+
+func (ah *AuthHeader) String() string {
+	return fmt.Sprintf("reasonCode: 0x%X\n%s", ah.ReasonCode, ah.Properties)
+}
+
+func (ah *AuthHeader) Hexa() string {
+	return util.ShowHexa(ah.Encode())
+}
+
+/////////////////////////////////////////////////
+// Disconnect header (MQTT 5)
+/////////////////////////////////////////////////
+
+type DisconnectHeader struct {
+	ReasonCode byte
+
+	Properties *property.Properties
+}
+
+func NewDisconnectHeader(reasonCode byte, properties *property.Properties) *DisconnectHeader {
+	return &DisconnectHeader{ReasonCode: reasonCode, Properties: properties}
+}
+
+func (dh *DisconnectHeader) Encode() []byte {
+	return dh.AppendEncode(make([]byte, 0, dh.Len()))
+}
+
+func (dh *DisconnectHeader) AppendEncode(dst []byte) []byte {
+	dst = append(dst, dh.ReasonCode)
+	return dh.Properties.AppendEncode(dst)
+}
+
+func (dh *DisconnectHeader) Len() int {
+	return 1 + dh.Properties.Len()
+}
+
+func (dh *DisconnectHeader) String() string {
+	return fmt.Sprintf("reasonCode: 0x%X\n%s", dh.ReasonCode, dh.Properties)
+}
+
+func (dh *DisconnectHeader) Hexa() string {
+	return util.ShowHexa(dh.Encode())
+}
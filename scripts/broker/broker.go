@@ -0,0 +1,64 @@
+// MIT License
+
+// Copyright (c) 2022 Florent Brusciano
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+package main
+
+import (
+	"flag"
+	"log"
+
+	"github.com/easygithdev/mqtt/broker"
+)
+
+func main() {
+
+	addr := flag.String("a", ":1883", "address to listen on")
+	dir := flag.String("r", "", "directory of the retained messages, kept in memory if empty")
+	aclFile := flag.String("acl", "", "mosquitto-like ACL file, every access is granted if empty")
+	flag.Parse()
+
+	// Show line numbers
+	log.SetFlags(log.LstdFlags | log.Lshortfile)
+
+	var opts []broker.BrokerOption
+	if *dir != "" {
+		store, err := broker.NewFileStore(*dir)
+		if err != nil {
+			log.Fatal("Retained store error:", err.Error())
+		}
+		opts = append(opts, broker.WithRetainedStore(store))
+	}
+
+	if *aclFile != "" {
+		acl, err := broker.LoadACL(*aclFile)
+		if err != nil {
+			log.Fatal("ACL error:", err.Error())
+		}
+		opts = append(opts, broker.WithAuthorizer(acl))
+	}
+
+	b := broker.New(opts...)
+
+	log.Printf("Listening on %s\n", *addr)
+	if err := b.ListenAndServe(*addr); err != nil {
+		log.Fatal("Serve error:", err.Error())
+	}
+}
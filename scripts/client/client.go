@@ -24,7 +24,6 @@ package main
 import (
 	"flag"
 	"fmt"
-	"io/ioutil"
 	"log"
 	"math/rand"
 	"net"
@@ -34,6 +33,7 @@ import (
 
 	"github.com/easygithdev/mqtt/client"
 	"github.com/easygithdev/mqtt/client/conn"
+	"github.com/easygithdev/mqtt/client/logger"
 )
 
 func init() {
@@ -43,23 +43,23 @@ func init() {
 
 }
 
-var onConnect = func(mc client.MqttClient, userData interface{}, rc net.Conn) {
+var onConnect = func(mc *client.MqttClient, userData interface{}, rc net.Conn, sessionPresent bool) {
 	fmt.Println("Connecting to server " + rc.RemoteAddr().String())
 }
 
-var onDisconnect = func(mc client.MqttClient, userData interface{}, rc net.Conn) {
+var onDisconnect = func(mc *client.MqttClient, userData interface{}, rc net.Conn) {
 	fmt.Println("Disconnect from server" + rc.RemoteAddr().String())
 }
 
-var onPublish = func(mc client.MqttClient, userData interface{}, mid uint16) {
+var onPublish = func(mc *client.MqttClient, userData interface{}, mid uint16) {
 	fmt.Printf("Publish performed\n")
 }
 
-var onSubscribe = func(mc client.MqttClient, userData interface{}, mid uint16) {
-	fmt.Printf("Subscribe performed\n")
+var onSubscribe = func(mc *client.MqttClient, userData interface{}, mid uint16, grantedQos []byte) {
+	fmt.Printf("Subscribe performed, granted QoS %v\n", grantedQos)
 }
 
-var onMessage = func(mc client.MqttClient, userData interface{}, message string) {
+var onMessage = func(mc *client.MqttClient, userData interface{}, message string) {
 	fmt.Print(message)
 }
 
@@ -121,9 +121,10 @@ func main() {
 		os.Exit(2)
 	}
 
-	if !*verbose {
-		log.SetFlags(0)
-		log.SetOutput(ioutil.Discard)
+	// Silence the client only, the errors of the command are still logged
+	var clientLogger logger.Logger = logger.Discard()
+	if *verbose {
+		clientLogger = logger.New(log.Default(), logger.DEBUG)
 	}
 
 	var credentialsOption client.ClientOption = nil
@@ -141,6 +142,8 @@ func main() {
 		credentialsOption,
 		// connection infos
 		client.WithConnInfos(conn.New(*host, conn.WithPort(*port))),
+		// logger
+		client.WithLogger(clientLogger),
 	)
 
 	// Callbacks
@@ -173,8 +176,8 @@ func main() {
 
 	} else if *sub {
 
-		resp, err := mc.Subscribe(*topic, byte(*qos))
-		if err != nil || !resp {
+		_, err := mc.Subscribe(*topic, byte(*qos))
+		if err != nil {
 			log.Printf("Subscribe Error: %s\n", err)
 		} else {
 			mc.LoopForever()
@@ -22,6 +22,7 @@
 package main
 
 import (
+	"flag"
 	"fmt"
 	"log"
 	"os"
@@ -34,9 +35,14 @@ func main() {
 
 	clientId := "test-golang-mqtt"
 
-	connHost := "test.mosquitto.org"
+	// Use -h=127.0.0.1 with scripts/broker to check the retained message locally
+	host := flag.String("h", "test.mosquitto.org", "the hostname")
+	port := flag.String("p", "1883", "the port")
+	flag.Parse()
 
-	connPort := "1883"
+	connHost := *host
+
+	connPort := *port
 
 	topic := "hello/mqtt"
 
@@ -59,7 +65,7 @@ func main() {
 		client.WithConnInfos(conn.New(connHost, conn.WithPort(connPort))),
 	)
 
-	mc.OnPublish = func(mc client.MqttClient, userData interface{}, mid uint16) {
+	mc.OnPublish = func(mc *client.MqttClient, userData interface{}, mid uint16) {
 		fmt.Println("Publish performed with mid:", mid)
 	}
 
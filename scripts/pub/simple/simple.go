@@ -59,7 +59,7 @@ func main() {
 		client.WithConnInfos(conn.New(connHost, conn.WithPort(connPort))),
 	)
 
-	mc.OnPublish = func(mc client.MqttClient, userData interface{}, mid uint16) {
+	mc.OnPublish = func(mc *client.MqttClient, userData interface{}, mid uint16) {
 		fmt.Println("Publish performed with mid:", mid)
 	}
 
@@ -23,7 +23,6 @@ package main
 
 import (
 	"fmt"
-	"io/ioutil"
 	"log"
 	"math/rand"
 	"os"
@@ -31,6 +30,7 @@ import (
 
 	"github.com/easygithdev/mqtt/client"
 	"github.com/easygithdev/mqtt/client/conn"
+	"github.com/easygithdev/mqtt/client/logger"
 )
 
 func main() {
@@ -52,10 +52,6 @@ func main() {
 	// Show line numbers
 	log.SetFlags(log.LstdFlags | log.Lshortfile)
 
-	// Disable log
-	log.SetFlags(0)
-	log.SetOutput(ioutil.Discard)
-
 	///////////////////////////////////////////////////////////
 	// Init
 	///////////////////////////////////////////////////////////
@@ -67,8 +63,10 @@ func main() {
 		client.WithConnInfos(conn.New(connHost, conn.WithPort(connPort))),
 		// user data
 		client.WithUserData(&nbpub),
+		// silence the client
+		client.WithLogger(logger.Discard()),
 	)
-	mc.OnPublish = func(mc client.MqttClient, userData interface{}, mid uint16) {
+	mc.OnPublish = func(mc *client.MqttClient, userData interface{}, mid uint16) {
 		(*userData.(*int))++
 		fmt.Println("Publish performed with mid:", mid)
 	}
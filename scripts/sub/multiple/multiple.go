@@ -60,11 +60,11 @@ func main() {
 		client.WithConnInfos(conn.New(connHost, conn.WithPort(connPort))),
 	)
 
-	mc.OnSubscribe = func(mc client.MqttClient, userData interface{}, mid uint16) {
+	mc.OnSubscribe = func(mc *client.MqttClient, userData interface{}, mid uint16, grantedQos []byte) {
 		fmt.Println("mid:", mid)
 	}
 
-	mc.OnMessage = func(mc client.MqttClient, userData interface{}, message string) {
+	mc.OnMessage = func(mc *client.MqttClient, userData interface{}, message string) {
 		fmt.Println("msg: " + message)
 	}
 
@@ -81,17 +81,17 @@ func main() {
 	// Subscribe
 	///////////////////////////////////////////////////////////
 
-	resp1, err := mc.Subscribe(topic1, byte(qos))
-	if err != nil || !resp1 {
-		log.Printf("Subscribe Error: %s\n", err)
+	_, err1 := mc.Subscribe(topic1, byte(qos))
+	if err1 != nil {
+		log.Printf("Subscribe Error: %s\n", err1)
 	}
 
-	resp2, err := mc.Subscribe(topic2, byte(qos))
-	if err != nil || !resp2 {
-		log.Printf("Subscribe Error: %s\n", err)
+	_, err2 := mc.Subscribe(topic2, byte(qos))
+	if err2 != nil {
+		log.Printf("Subscribe Error: %s\n", err2)
 	}
 
-	if resp1 && resp2 {
+	if err1 == nil && err2 == nil {
 		mc.LoopForever()
 	}
 
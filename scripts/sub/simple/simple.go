@@ -59,11 +59,11 @@ func main() {
 		client.WithConnInfos(conn.New(connHost, conn.WithPort(connPort))),
 	)
 
-	mc.OnSubscribe = func(mc client.MqttClient, userData interface{}, mid uint16) {
-		fmt.Println("mid:", mid)
+	mc.OnSubscribe = func(mc *client.MqttClient, userData interface{}, mid uint16, grantedQos []byte) {
+		fmt.Println("mid:", mid, "granted:", grantedQos)
 	}
 
-	mc.OnMessage = func(mc client.MqttClient, userData interface{}, message string) {
+	mc.OnMessage = func(mc *client.MqttClient, userData interface{}, message string) {
 		fmt.Println("msg: " + message)
 	}
 
@@ -80,8 +80,8 @@ func main() {
 	// Subscribe
 	///////////////////////////////////////////////////////////
 
-	resp, err := mc.Subscribe(topic, byte(qos))
-	if err != nil || !resp {
+	_, err := mc.Subscribe(topic, byte(qos))
+	if err != nil {
 		log.Printf("Subscribe Error: %s\n", err)
 	}
 
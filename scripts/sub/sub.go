@@ -58,7 +58,7 @@ func main() {
 		client.WithConnInfos(conn.New(connHost, conn.WithPort(connPort))),
 	)
 
-	mc.OnMessage = func(mc client.MqttClient, userData interface{}, message string) {
+	mc.OnMessage = func(mc *client.MqttClient, userData interface{}, message string) {
 		fmt.Println("msg: " + message)
 	}
 
@@ -75,17 +75,17 @@ func main() {
 	// Subscribe
 	///////////////////////////////////////////////////////////
 
-	respSub1, errSub := mc.Subscribe(topic1, client.QOS_0)
-	if errSub != nil {
-		log.Printf("Subscribe Error: %s\n", errSub)
+	_, errSub1 := mc.Subscribe(topic1, client.QOS_0)
+	if errSub1 != nil {
+		log.Printf("Subscribe Error: %s\n", errSub1)
 	}
 
-	respSub2, errSub := mc.Subscribe(topic2, client.QOS_0)
-	if errSub != nil {
-		log.Printf("Subscribe Error: %s\n", errSub)
+	_, errSub2 := mc.Subscribe(topic2, client.QOS_0)
+	if errSub2 != nil {
+		log.Printf("Subscribe Error: %s\n", errSub2)
 	}
 
-	if respSub1 && respSub2 {
+	if errSub1 == nil && errSub2 == nil {
 		mc.LoopForever()
 	}
 
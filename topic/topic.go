@@ -0,0 +1,117 @@
+// MIT License
+
+// Copyright (c) 2022 Florent Brusciano
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+package topic
+
+import (
+	"errors"
+	"strings"
+	"unicode/utf8"
+)
+
+// Longest topic, the length of an encoded string is on 2 bytes
+const MAX_LEN = 65535
+
+var ErrEmpty = errors.New("topic must not be empty")
+var ErrTooLong = errors.New("topic longer than 65535 bytes")
+var ErrInvalidUTF8 = errors.New("topic is not valid UTF-8")
+var ErrNullCharacter = errors.New("topic must not contain the null character")
+var ErrWildcardInName = errors.New("topic name must not contain wildcards")
+var ErrInvalidMultiLevel = errors.New("multi-level wildcard must be the last level and alone in its level")
+var ErrInvalidSingleLevel = errors.New("single-level wildcard must be alone in its level")
+
+// Checks shared by the topic names and filters
+func validate(topic string) error {
+	if topic == "" {
+		return ErrEmpty
+	}
+	if len(topic) > MAX_LEN {
+		return ErrTooLong
+	}
+	if !utf8.ValidString(topic) {
+		return ErrInvalidUTF8
+	}
+	if strings.ContainsRune(topic, 0) {
+		return ErrNullCharacter
+	}
+	return nil
+}
+
+// Check a topic name, used to publish
+func ValidateName(name string) error {
+	if err := validate(name); err != nil {
+		return err
+	}
+	if strings.ContainsAny(name, SINGLE_LEVEL+MULTI_LEVEL) {
+		return ErrWildcardInName
+	}
+	return nil
+}
+
+// Check a topic filter, used to subscribe
+func ValidateFilter(filter string) error {
+	if err := validate(filter); err != nil {
+		return err
+	}
+
+	levels := Split(filter)
+	for i, level := range levels {
+		if strings.Contains(level, MULTI_LEVEL) && (level != MULTI_LEVEL || i != len(levels)-1) {
+			return ErrInvalidMultiLevel
+		}
+		if strings.Contains(level, SINGLE_LEVEL) && level != SINGLE_LEVEL {
+			return ErrInvalidSingleLevel
+		}
+	}
+
+	return nil
+}
+
+// Levels of a topic name or filter, an empty level is kept : /finance is "" and "finance"
+func Split(topic string) []string {
+	return strings.Split(topic, SEPARATOR)
+}
+
+// Tell if the topic name matches the topic filter
+func Match(filter string, name string) bool {
+
+	// Topics starting with $ are not matched by a leading wildcard
+	if strings.HasPrefix(name, "$") && (strings.HasPrefix(filter, SINGLE_LEVEL) || strings.HasPrefix(filter, MULTI_LEVEL)) {
+		return false
+	}
+
+	f := Split(filter)
+	n := Split(name)
+
+	for i, level := range f {
+		if level == MULTI_LEVEL {
+			return true
+		}
+		if i >= len(n) {
+			return false
+		}
+		if level != SINGLE_LEVEL && level != n[i] {
+			return false
+		}
+	}
+
+	return len(f) == len(n)
+}
@@ -0,0 +1,221 @@
+// MIT License
+
+// Copyright (c) 2022 Florent Brusciano
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+package topic
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestMatch(t *testing.T) {
+
+	for _, tc := range []struct {
+		filter string
+		name   string
+		match  bool
+	}{
+		{"sport/tennis/player1", "sport/tennis/player1", true},
+		{"sport/tennis/player1/#", "sport/tennis/player1", true},
+		{"sport/tennis/player1/#", "sport/tennis/player1/ranking", true},
+		{"sport/#", "sport", true},
+		{"#", "sport/tennis", true},
+		{"sport/tennis/#", "sport/tennis/player1/score/wimbledon", true},
+		{"sport/+", "sport/", true},
+		{"sport/+", "sport", false},
+		{"sport/+/player1", "sport/tennis/player1", true},
+		{"+/+", "/finance", true},
+		{"+", "/finance", false},
+		{"#", "$SYS/broker", false},
+		{"+/broker", "$SYS/broker", false},
+		{"$SYS/#", "$SYS/broker", true},
+		{"sport/tennis", "sport/tennis/player1", false},
+	} {
+		if Match(tc.filter, tc.name) != tc.match {
+			t.Errorf("Match(%s, %s) found %v; want %v", tc.filter, tc.name, !tc.match, tc.match)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+
+	long := strings.Repeat("a", MAX_LEN+1)
+
+	for _, tc := range []struct {
+		topic     string
+		nameErr   error
+		filterErr error
+	}{
+		{"sport/tennis/player1", nil, nil},
+		{"/finance", nil, nil},
+		{"sport/tennis/#", ErrWildcardInName, nil},
+		{"sport/+/player", ErrWildcardInName, nil},
+		{"+", ErrWildcardInName, nil},
+		{"#", ErrWildcardInName, nil},
+		{"", ErrEmpty, ErrEmpty},
+		{"sport/tennis#", ErrWildcardInName, ErrInvalidMultiLevel},
+		{"sport/#/player", ErrWildcardInName, ErrInvalidMultiLevel},
+		{"sport+", ErrWildcardInName, ErrInvalidSingleLevel},
+		{"sport/\x00", ErrNullCharacter, ErrNullCharacter},
+		{"sport/\xff", ErrInvalidUTF8, ErrInvalidUTF8},
+		{long, ErrTooLong, ErrTooLong},
+	} {
+		if err := ValidateName(tc.topic); err != tc.nameErr {
+			t.Errorf("ValidateName(%.20q) found %v; want %v", tc.topic, err, tc.nameErr)
+		}
+		if err := ValidateFilter(tc.topic); err != tc.filterErr {
+			t.Errorf("ValidateFilter(%.20q) found %v; want %v", tc.topic, err, tc.filterErr)
+		}
+	}
+}
+
+func TestSplit(t *testing.T) {
+
+	for topic, want := range map[string][]string{
+		"sport/tennis/player1": {"sport", "tennis", "player1"},
+		"/finance":             {"", "finance"},
+		"sport/":               {"sport", ""},
+		"#":                    {"#"},
+	} {
+		if found := Split(topic); fmt.Sprintf("%q", found) != fmt.Sprintf("%q", want) {
+			t.Errorf("Split(%s) found %q; want %q", topic, found, want)
+		}
+	}
+}
+
+func matched(entries []Entry) []string {
+	var found []string
+	for _, e := range entries {
+		found = append(found, fmt.Sprintf("%s=%v:%d", e.Filter, e.Id, e.Qos))
+	}
+	sort.Strings(found)
+	return found
+}
+
+func TestTrie(t *testing.T) {
+
+	trie := NewTrie()
+	for _, f := range []string{
+		"sport/tennis/player1",
+		"sport/tennis/player1/#",
+		"sport/#",
+		"sport/+",
+		"sport/+/player1",
+		"+/+",
+		"#",
+		"$SYS/#",
+		"/finance",
+	} {
+		trie.Insert(f, "a", 1)
+	}
+	trie.Insert("sport/#", "b", 2)
+
+	for topic, want := range map[string][]string{
+		"sport/tennis/player1": {
+			"#=a:1", "sport/#=a:1", "sport/#=b:2", "sport/+/player1=a:1",
+			"sport/tennis/player1/#=a:1", "sport/tennis/player1=a:1",
+		},
+		"sport":         {"#=a:1", "sport/#=a:1", "sport/#=b:2"},
+		"sport/":        {"#=a:1", "+/+=a:1", "sport/#=a:1", "sport/#=b:2", "sport/+=a:1"},
+		"/finance":      {"#=a:1", "+/+=a:1", "/finance=a:1"},
+		"$SYS/broker":   {"$SYS/#=a:1"},
+		"other/a/b/c/d": {"#=a:1"},
+	} {
+		if found := matched(trie.Match(topic)); fmt.Sprint(found) != fmt.Sprint(want) {
+			t.Errorf("Match(%s) found %v; want %v", topic, found, want)
+		}
+	}
+
+	if trie.Len() != 10 {
+		t.Errorf("Len found %d; want 10", trie.Len())
+	}
+
+	// Replace the QoS
+	if trie.Insert("sport/#", "b", 0) {
+		t.Errorf("Insert of an existing subscriber should return false")
+	}
+	if found := matched(trie.Match("sport")); fmt.Sprint(found) != "[#=a:1 sport/#=a:1 sport/#=b:0]" {
+		t.Errorf("Match(sport) found %v", found)
+	}
+
+	if !trie.Remove("sport/#", "a") || trie.Remove("sport/#", "a") || trie.Remove("unknown/filter", "a") {
+		t.Errorf("Remove found unexpected result")
+	}
+	trie.Remove("#", "a")
+	if found := matched(trie.Match("sport")); fmt.Sprint(found) != "[sport/#=b:0]" {
+		t.Errorf("Match(sport) found %v", found)
+	}
+
+	// Every node is removed with the last subscriber
+	for _, f := range []string{"sport/tennis/player1", "sport/tennis/player1/#", "sport/+", "sport/+/player1", "+/+", "$SYS/#", "/finance"} {
+		trie.Remove(f, "a")
+	}
+	trie.Remove("sport/#", "b")
+	if trie.Len() != 0 || len(trie.root.children) != 0 {
+		t.Errorf("Trie should be empty, found %d subscriber(s) and %d node(s)", trie.Len(), len(trie.root.children))
+	}
+}
+
+// 100k filters, like devices/<site>/<device>/<measure> with some wildcards
+func benchmarkTrie(size int) *Trie {
+	trie := NewTrie()
+	for i := 0; i < size; i++ {
+		var filter string
+		switch i % 10 {
+		case 0:
+			filter = fmt.Sprintf("devices/site%d/+/temperature", i%100)
+		case 1:
+			filter = fmt.Sprintf("devices/site%d/device%d/#", i%100, i)
+		default:
+			filter = fmt.Sprintf("devices/site%d/device%d/measure%d", i%100, i, i%7)
+		}
+		trie.Insert(filter, i, byte(i%3))
+	}
+	return trie
+}
+
+func BenchmarkTrieMatch(b *testing.B) {
+	trie := benchmarkTrie(100000)
+
+	topics := make([]string, 1000)
+	for i := range topics {
+		topics[i] = fmt.Sprintf("devices/site%d/device%d/measure%d", i%100, i*97, i%7)
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		trie.Match(topics[i%len(topics)])
+	}
+}
+
+func BenchmarkTrieInsertRemove(b *testing.B) {
+	trie := benchmarkTrie(100000)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		trie.Insert("devices/bench/+/temperature", i, 1)
+		trie.Remove("devices/bench/+/temperature", i)
+	}
+}
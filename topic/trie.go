@@ -0,0 +1,188 @@
+// MIT License
+
+// Copyright (c) 2022 Florent Brusciano
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+package topic
+
+import (
+	"strings"
+	"sync"
+)
+
+// Topic level separator and wildcards
+const SEPARATOR = "/"
+const SINGLE_LEVEL = "+"
+const MULTI_LEVEL = "#"
+
+// Subscriber of a topic filter, returned by Match
+type Entry struct {
+	Filter string
+	Id     interface{}
+	Qos    byte
+}
+
+// One level of the topic filters
+type node struct {
+	children map[string]*node
+
+	// filter ending at this node and its subscribers with their QoS
+	filter      string
+	subscribers map[interface{}]byte
+}
+
+func newNode() *node {
+	return &node{children: make(map[string]*node)}
+}
+
+// Tree of the topic filters, one level per node
+// Safe for concurrent use
+type Trie struct {
+	mu    sync.RWMutex
+	root  *node
+	count int
+}
+
+func NewTrie() *Trie {
+	return &Trie{root: newNode()}
+}
+
+// Add the subscriber to the filter, the QoS of an existing subscriber is replaced
+// Return true if the subscriber is new for the filter
+func (t *Trie) Insert(filter string, id interface{}, qos byte) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	n := t.root
+	for _, level := range strings.Split(filter, SEPARATOR) {
+		child, ok := n.children[level]
+		if !ok {
+			child = newNode()
+			n.children[level] = child
+		}
+		n = child
+	}
+
+	if n.subscribers == nil {
+		n.subscribers = make(map[interface{}]byte)
+		n.filter = filter
+	}
+
+	_, exists := n.subscribers[id]
+	n.subscribers[id] = qos
+	if !exists {
+		t.count++
+	}
+
+	return !exists
+}
+
+// Remove the subscriber from the filter, the empty nodes are removed
+// Return false if the subscriber was not found
+func (t *Trie) Remove(filter string, id interface{}) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	levels := strings.Split(filter, SEPARATOR)
+	path := make([]*node, 0, len(levels)+1)
+
+	n := t.root
+	path = append(path, n)
+	for _, level := range levels {
+		child, ok := n.children[level]
+		if !ok {
+			return false
+		}
+		n = child
+		path = append(path, n)
+	}
+
+	if _, ok := n.subscribers[id]; !ok {
+		return false
+	}
+	delete(n.subscribers, id)
+	t.count--
+	if len(n.subscribers) == 0 {
+		n.subscribers = nil
+		n.filter = ""
+	}
+
+	// Remove the empty nodes from the leaf
+	for i := len(levels); i > 0; i-- {
+		n := path[i]
+		if len(n.children) > 0 || n.subscribers != nil {
+			break
+		}
+		delete(path[i-1].children, levels[i-1])
+	}
+
+	return true
+}
+
+// Subscribers of the filters matching the topic name
+// A subscriber of several matching filters is returned once per filter
+func (t *Trie) Match(name string) []Entry {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	var entries []Entry
+
+	// The wildcards of the first level do not match the topics starting with $
+	levels := strings.Split(name, SEPARATOR)
+	entries = t.root.match(levels, 0, strings.HasPrefix(name, "$"), entries)
+
+	return entries
+}
+
+func (n *node) match(levels []string, i int, dollar bool, entries []Entry) []Entry {
+
+	// # matches the parent level and every level below
+	if child, ok := n.children[MULTI_LEVEL]; ok && !dollar {
+		entries = child.collect(entries)
+	}
+
+	if i == len(levels) {
+		return n.collect(entries)
+	}
+
+	if child, ok := n.children[levels[i]]; ok {
+		entries = child.match(levels, i+1, false, entries)
+	}
+
+	if child, ok := n.children[SINGLE_LEVEL]; ok && !dollar {
+		entries = child.match(levels, i+1, false, entries)
+	}
+
+	return entries
+}
+
+func (n *node) collect(entries []Entry) []Entry {
+	for id, qos := range n.subscribers {
+		entries = append(entries, Entry{Filter: n.filter, Id: id, Qos: qos})
+	}
+	return entries
+}
+
+// Number of subscribers of all filters
+func (t *Trie) Len() int {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	return t.count
+}